@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+)
+
+// Broadcast states
+const (
+	broadcastRunning   = "running"
+	broadcastCompleted = "completed"
+	broadcastCancelled = "cancelled"
+)
+
+// Broadcast recipient states. A recipient is sending from the moment its message Id is reserved until the
+// send returns, after a restart the status of that message tells whether it went out.
+const (
+	recipientPending   = "pending"
+	recipientSending   = "sending"
+	recipientSent      = "sent"
+	recipientFailed    = "failed"
+	recipientCancelled = "cancelled"
+)
+
+// broadcastTypes maps the message types a broadcast can send to the commands that send them
+var broadcastTypes = map[string]string{
+	"text":     "send.text",
+	"image":    "send.image",
+	"audio":    "send.audio",
+	"document": "send.document",
+	"video":    "send.video",
+	"sticker":  "send.sticker",
+	"location": "send.location",
+	"contact":  "send.contact",
+	"buttons":  "send.buttons",
+	"list":     "send.list",
+}
+
+// How long a broadcast waits before checking again for a disconnected session
+const broadcastSessionWait = 10 * time.Second
+
+// Placeholders of message templates, {{name}} is replaced by the name variable of each recipient
+var broadcastPlaceholder = regexp.MustCompile(`\{\{\s*([\w.-]+)\s*\}\}`)
+
+// broadcast is a message sent to a list of recipients, one at a time at PerMinute messages per minute
+type broadcast struct {
+	ID         string               `db:"id" json:"id"`
+	UserID     string               `db:"user_id" json:"-"`
+	Type       string               `db:"type" json:"type"`
+	Message    string               `db:"message" json:"-"`
+	PerMinute  int                  `db:"per_minute" json:"per_minute"`
+	Status     string               `db:"status" json:"status"`
+	CreatedAt  int64                `db:"created_at" json:"created_at"`
+	FinishedAt int64                `db:"finished_at" json:"finished_at"`
+	Progress   broadcastProgress    `db:"-" json:"progress"`
+	Recipients []broadcastRecipient `db:"-" json:"recipients"`
+}
+
+// Columns selected whenever a broadcast is loaded
+const broadcastColumns = "id, user_id, type, message, per_minute, status, created_at, finished_at"
+
+// broadcastProgress counts the recipients of a broadcast by state, Pending includes the one being sent
+type broadcastProgress struct {
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Sent      int `json:"sent"`
+	Failed    int `json:"failed"`
+	Cancelled int `json:"cancelled"`
+}
+
+// broadcastRecipient is the result of a broadcast for one recipient
+type broadcastRecipient struct {
+	Position  int    `db:"position" json:"position"`
+	Phone     string `db:"phone" json:"phone"`
+	Variables string `db:"variables" json:"-"`
+	Status    string `db:"status" json:"status"`
+	MessageID string `db:"message_id" json:"message_id"`
+	Error     string `db:"error" json:"error,omitempty"`
+	SentAt    int64  `db:"sent_at" json:"sent_at"`
+}
+
+// Columns selected whenever a broadcast recipient is loaded
+const broadcastRecipientColumns = "position, phone, variables, status, message_id, error, sent_at"
+
+// broadcastTarget is a recipient as given when creating a broadcast
+type broadcastTarget struct {
+	Phone     string
+	Variables map[string]string
+}
+
+// Cancel functions of the broadcasts being sent, by broadcast id
+var (
+	broadcastMutex   sync.Mutex
+	broadcastCancels = map[string]context.CancelFunc{}
+)
+
+// broadcastTargetsFromCSV reads recipients from CSV text with a header row. The phone column is required,
+// every column becomes a variable named after its header.
+func broadcastTargetsFromCSV(text string) ([]broadcastTarget, error) {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("invalid CSV: missing header row")
+	}
+
+	header := rows[0]
+	phoneColumn := -1
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if strings.EqualFold(header[i], "phone") {
+			phoneColumn = i
+		}
+	}
+	if phoneColumn < 0 {
+		return nil, errors.New("missing phone column in CSV")
+	}
+
+	targets := make([]broadcastTarget, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		variables := make(map[string]string, len(row))
+		for i, value := range row {
+			variables[header[i]] = strings.TrimSpace(value)
+		}
+		targets = append(targets, broadcastTarget{Phone: variables[header[phoneColumn]], Variables: variables})
+	}
+	return targets, nil
+}
+
+// prepareBroadcastTargets checks the recipients of a broadcast against its message template. Recipients whose
+// phone resolves to a chat already in the list are dropped, their number is returned.
+func prepareBroadcastTargets(targets []broadcastTarget, message string) ([]broadcastTarget, int, error) {
+	placeholders := map[string]bool{}
+	for _, match := range broadcastPlaceholder.FindAllStringSubmatch(message, -1) {
+		placeholders[match[1]] = true
+	}
+
+	seen := map[string]bool{}
+	prepared := make([]broadcastTarget, 0, len(targets))
+	duplicates := 0
+	for i, target := range targets {
+		target.Phone = strings.TrimSpace(target.Phone)
+		if target.Phone == "" {
+			return nil, 0, fmt.Errorf("missing Phone in recipient %d", i+1)
+		}
+		jid, ok := parseJID(target.Phone)
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid Phone in recipient %d", i+1)
+		}
+		if seen[jid.ToNonAD().String()] {
+			duplicates++
+			continue
+		}
+		seen[jid.ToNonAD().String()] = true
+
+		if target.Variables == nil {
+			target.Variables = map[string]string{}
+		}
+		if _, ok := target.Variables["phone"]; !ok {
+			target.Variables["phone"] = target.Phone
+		}
+		for name := range placeholders {
+			if _, ok := target.Variables[name]; !ok {
+				return nil, 0, fmt.Errorf("recipient %d has no value for {{%s}}", i+1, name)
+			}
+		}
+		prepared = append(prepared, target)
+	}
+	return prepared, duplicates, nil
+}
+
+// createBroadcast stores a broadcast and its recipients, it is sent once started
+func createBroadcast(db *sqlx.DB, userID, messageType, message string, perMinute int, targets []broadcastTarget) (*broadcast, error) {
+	id, err := GenerateRandomID()
+	if err != nil {
+		return nil, err
+	}
+	job := &broadcast{
+		ID:        id,
+		UserID:    userID,
+		Type:      messageType,
+		Message:   message,
+		PerMinute: perMinute,
+		Status:    broadcastRunning,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO broadcasts (id, user_id, type, message, per_minute, status, created_at, finished_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, 0)`,
+		job.ID, job.UserID, job.Type, job.Message, job.PerMinute, job.Status, job.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	for i, target := range targets {
+		variables, err := json.Marshal(target.Variables)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`INSERT INTO broadcast_recipients (broadcast_id, position, phone, variables, status)
+            VALUES ($1, $2, $3, $4, $5)`,
+			job.ID, i+1, target.Phone, string(variables), recipientPending)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	job.Progress = broadcastProgress{Total: len(targets), Pending: len(targets)}
+	return job, nil
+}
+
+// getBroadcast returns a broadcast with its progress and the recipients in the given state, all of them when
+// state is empty. sql.ErrNoRows means the broadcast does not exist.
+func getBroadcast(db *sqlx.DB, userID, id, state string) (*broadcast, error) {
+	var job broadcast
+	err := db.Get(&job, "SELECT "+broadcastColumns+" FROM broadcasts WHERE id=$1 AND user_id=$2", id, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+	}{}
+	err = db.Select(&counts, "SELECT status, COUNT(*) AS count FROM broadcast_recipients WHERE broadcast_id=$1 GROUP BY status", id)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		job.Progress.Total += c.Count
+		switch c.Status {
+		case recipientPending, recipientSending:
+			job.Progress.Pending += c.Count
+		case recipientSent:
+			job.Progress.Sent += c.Count
+		case recipientFailed:
+			job.Progress.Failed += c.Count
+		case recipientCancelled:
+			job.Progress.Cancelled += c.Count
+		}
+	}
+
+	job.Recipients = []broadcastRecipient{}
+	query := "SELECT " + broadcastRecipientColumns + " FROM broadcast_recipients WHERE broadcast_id=$1"
+	args := []interface{}{id}
+	if state != "" {
+		query += " AND status=$2"
+		args = append(args, state)
+	}
+	if err := db.Select(&job.Recipients, query+" ORDER BY position", args...); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// renderBroadcastMessage fills the placeholders in every string of the message template with the variables
+// of a recipient, and addresses the message to them with the given Id
+func renderBroadcastMessage(message string, recipient broadcastRecipient) (json.RawMessage, error) {
+	variables := map[string]string{}
+	if err := json.Unmarshal([]byte(recipient.Variables), &variables); err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(message), &payload); err != nil {
+		return nil, err
+	}
+
+	var fill func(v interface{}) interface{}
+	fill = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case string:
+			return broadcastPlaceholder.ReplaceAllStringFunc(v, func(placeholder string) string {
+				return variables[broadcastPlaceholder.FindStringSubmatch(placeholder)[1]]
+			})
+		case map[string]interface{}:
+			for key, value := range v {
+				v[key] = fill(value)
+			}
+		case []interface{}:
+			for i, value := range v {
+				v[i] = fill(value)
+			}
+		}
+		return v
+	}
+	fill(payload)
+
+	// A broadcast sends right away, a SendAt in the template would only schedule the message
+	delete(payload, "SendAt")
+	payload["Phone"] = recipient.Phone
+	payload["Id"] = recipient.MessageID
+	return json.Marshal(payload)
+}
+
+// StartBroadcasts resumes the broadcasts that were being sent when the server stopped
+func (s *server) StartBroadcasts() {
+	if err := settleInterruptedBroadcasts(s.db); err != nil {
+		log.Error().Err(err).Msg("Could not settle interrupted broadcast sends")
+	}
+
+	jobs := []broadcast{}
+	if err := s.db.Select(&jobs, "SELECT "+broadcastColumns+" FROM broadcasts WHERE status=$1", broadcastRunning); err != nil {
+		log.Error().Err(err).Msg("Could not load broadcasts to resume")
+		return
+	}
+	for _, job := range jobs {
+		log.Info().Str("id", job.ID).Str("userid", job.UserID).Msg("Resuming broadcast")
+		s.startBroadcast(job)
+	}
+}
+
+// settleInterruptedBroadcasts decides the fate of the recipients whose send was interrupted by a restart.
+// The message went out if the server acknowledged it, otherwise it is sent again with the same Id.
+func settleInterruptedBroadcasts(db *sqlx.DB) error {
+	interrupted := []struct {
+		BroadcastID string `db:"broadcast_id"`
+		Position    int    `db:"position"`
+		MessageID   string `db:"message_id"`
+		UserID      string `db:"user_id"`
+		JobStatus   string `db:"job_status"`
+	}{}
+	err := db.Select(&interrupted, `SELECT r.broadcast_id, r.position, r.message_id, b.user_id, b.status AS job_status
+        FROM broadcast_recipients r JOIN broadcasts b ON b.id = r.broadcast_id WHERE r.status=$1`, recipientSending)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range interrupted {
+		status, sentAt := recipientPending, int64(0)
+		if r.JobStatus != broadcastRunning {
+			status = recipientCancelled
+		}
+		sent, at, err := messageAcknowledged(db, r.UserID, r.MessageID)
+		if err != nil {
+			return err
+		}
+		if sent {
+			status, sentAt = recipientSent, at
+		}
+		if err := recordBroadcastResult(db, r.BroadcastID, r.Position, status, "", sentAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startBroadcast sends a broadcast in the background until it completes or is cancelled
+func (s *server) startBroadcast(job broadcast) {
+	ctx, cancel := context.WithCancel(context.Background())
+	broadcastMutex.Lock()
+	broadcastCancels[job.ID] = cancel
+	broadcastMutex.Unlock()
+
+	go func() {
+		defer func() {
+			broadcastMutex.Lock()
+			delete(broadcastCancels, job.ID)
+			broadcastMutex.Unlock()
+			cancel()
+		}()
+		s.runBroadcast(ctx, job)
+	}()
+}
+
+// cancelBroadcast stops a running broadcast and cancels its pending recipients. A message being sent
+// when the broadcast is cancelled still gets its result recorded. It returns false if the broadcast
+// was not running.
+func cancelBroadcast(db *sqlx.DB, userID, id string) (bool, error) {
+	res, err := db.Exec("UPDATE broadcasts SET status=$1, finished_at=$2 WHERE id=$3 AND user_id=$4 AND status=$5",
+		broadcastCancelled, time.Now().Unix(), id, userID, broadcastRunning)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	broadcastMutex.Lock()
+	if cancel, ok := broadcastCancels[id]; ok {
+		cancel()
+	}
+	broadcastMutex.Unlock()
+
+	_, err = db.Exec("UPDATE broadcast_recipients SET status=$1 WHERE broadcast_id=$2 AND status=$3", recipientCancelled, id, recipientPending)
+	return true, err
+}
+
+// recordBroadcastResult sets the state of a broadcast recipient
+func recordBroadcastResult(db sqlx.Execer, id string, position int, status, errText string, sentAt int64) error {
+	_, err := db.Exec("UPDATE broadcast_recipients SET status=$1, error=$2, sent_at=$3 WHERE broadcast_id=$4 AND position=$5",
+		status, errText, sentAt, id, position)
+	return err
+}
+
+// requeueBroadcastRecipient sets a recipient back to pending so it is sent again, or cancels it if the
+// broadcast was cancelled in the meantime. It returns the state the recipient was left in.
+func requeueBroadcastRecipient(db *sqlx.DB, id string, position int) (string, error) {
+	_, err := db.Exec(`UPDATE broadcast_recipients SET error='', sent_at=0,
+        status = CASE WHEN EXISTS (SELECT 1 FROM broadcasts WHERE id=$1 AND status=$2) THEN $3 ELSE $4 END
+        WHERE broadcast_id=$1 AND position=$5`,
+		id, broadcastRunning, recipientPending, recipientCancelled, position)
+	if err != nil {
+		return "", err
+	}
+	var status string
+	err = db.Get(&status, "SELECT status FROM broadcast_recipients WHERE broadcast_id=$1 AND position=$2", id, position)
+	return status, err
+}
+
+// runBroadcast sends the message of a broadcast to its pending recipients in order, at its rate. While the
+// session is disconnected it waits instead of failing the recipients.
+func (s *server) runBroadcast(ctx context.Context, job broadcast) {
+	interval := time.Minute / time.Duration(job.PerMinute)
+	action := broadcastTypes[job.Type]
+
+	for ctx.Err() == nil {
+		var next broadcastRecipient
+		err := s.db.Get(&next, "SELECT "+broadcastRecipientColumns+" FROM broadcast_recipients WHERE broadcast_id=$1 AND status=$2 ORDER BY position LIMIT 1",
+			job.ID, recipientPending)
+		if err == sql.ErrNoRows {
+			_, err = s.db.Exec("UPDATE broadcasts SET status=$1, finished_at=$2 WHERE id=$3 AND status=$4",
+				broadcastCompleted, time.Now().Unix(), job.ID, broadcastRunning)
+			if err != nil {
+				log.Error().Err(err).Str("id", job.ID).Msg("Could not complete broadcast")
+			}
+			log.Info().Str("id", job.ID).Msg("Broadcast completed")
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("id", job.ID).Msg("Could not load next broadcast recipient")
+			sleepContext(ctx, broadcastSessionWait)
+			continue
+		}
+
+		cli := connectedClient(job.UserID)
+		if cli == nil {
+			sleepContext(ctx, broadcastSessionWait)
+			continue
+		}
+		userinfo, err := s.lookupUserInfoByID(job.UserID)
+		if err != nil {
+			log.Error().Err(err).Str("id", job.ID).Msg("Could not look up broadcast user")
+			sleepContext(ctx, broadcastSessionWait)
+			continue
+		}
+
+		// The Id is kept when a send is retried, so the recipient cannot get the message twice
+		if next.MessageID == "" {
+			next.MessageID = cli.GenerateMessageID()
+		}
+		res, err := s.db.Exec("UPDATE broadcast_recipients SET status=$1, message_id=$2 WHERE broadcast_id=$3 AND position=$4 AND status=$5",
+			recipientSending, next.MessageID, job.ID, next.Position, recipientPending)
+		if err != nil {
+			log.Error().Err(err).Str("id", job.ID).Msg("Could not claim broadcast recipient")
+			sleepContext(ctx, broadcastSessionWait)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Cancelled in the meantime
+			continue
+		}
+
+		status, errText, sentAt := s.sendBroadcastMessage(userinfo, action, job.Message, next)
+		if status == recipientFailed && connectedClient(job.UserID) == nil {
+			// The session dropped during the send, the recipient is tried again once it is back
+			status, err = requeueBroadcastRecipient(s.db, job.ID, next.Position)
+			if err != nil {
+				log.Error().Err(err).Str("id", job.ID).Int("position", next.Position).Msg("Could not requeue broadcast recipient")
+			}
+		} else if err := recordBroadcastResult(s.db, job.ID, next.Position, status, errText, sentAt); err != nil {
+			log.Error().Err(err).Str("id", job.ID).Int("position", next.Position).Msg("Could not record broadcast result")
+		}
+		log.Info().Str("id", job.ID).Int("position", next.Position).Str("status", status).Msg("Broadcast message processed")
+
+		sleepContext(ctx, interval)
+	}
+}
+
+// sendBroadcastMessage sends the message of a broadcast to one recipient through the send endpoint of its type
+func (s *server) sendBroadcastMessage(userinfo Values, action, message string, recipient broadcastRecipient) (string, string, int64) {
+	payload, err := renderBroadcastMessage(message, recipient)
+	if err != nil {
+		return recipientFailed, err.Error(), 0
+	}
+	// A send that hangs would stall the whole broadcast
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(getEnvInt("BROADCAST_SEND_TIMEOUT_SECONDS", 60))*time.Second)
+	defer cancel()
+	code, envelope := s.executeCommand(ctx, userinfo, action, payload)
+	if code != http.StatusOK {
+		errText, _ := envelope["error"].(string)
+		if errText == "" {
+			errText = fmt.Sprintf("send failed with status %d", code)
+		}
+		return recipientFailed, errText, 0
+	}
+	return recipientSent, "", time.Now().Unix()
+}
+
+// broadcastTypeNames lists the message types a broadcast can send, sorted for error messages
+func broadcastTypeNames() []string {
+	names := make([]string, 0, len(broadcastTypes))
+	for name := range broadcastTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// connectedClient returns the client of a user if its session is connected and logged in, nil otherwise
+func connectedClient(userID string) *whatsmeow.Client {
+	cli := clientManager.GetWhatsmeowClient(userID)
+	if cli == nil || !cli.IsConnected() || !cli.IsLoggedIn() {
+		return nil
+	}
+	return cli
+}
+
+// sleepContext waits for d, or less if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestBroadcastTargetsFromCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []broadcastTarget
+		wantErr bool
+	}{
+		{
+			name: "phone and variables",
+			csv:  "Phone, name\n5491155551234, Ana\n5491155550000,Bob\n",
+			want: []broadcastTarget{
+				{Phone: "5491155551234", Variables: map[string]string{"Phone": "5491155551234", "name": "Ana"}},
+				{Phone: "5491155550000", Variables: map[string]string{"Phone": "5491155550000", "name": "Bob"}},
+			},
+		},
+		{name: "header only", csv: "phone\n", want: []broadcastTarget{}},
+		{name: "empty", csv: "", wantErr: true},
+		{name: "no phone column", csv: "name\nAna\n", wantErr: true},
+		{name: "uneven rows", csv: "phone,name\n1,Ana,extra\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := broadcastTargetsFromCSV(tt.csv)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrepareBroadcastTargets(t *testing.T) {
+	tests := []struct {
+		name           string
+		targets        []broadcastTarget
+		message        string
+		wantPhones     []string
+		wantDuplicates int
+		wantErr        bool
+	}{
+		{
+			name:       "no placeholders",
+			targets:    []broadcastTarget{{Phone: " 5491155551234 "}, {Phone: "5491155550000"}},
+			message:    `{"Body":"Hello"}`,
+			wantPhones: []string{"5491155551234", "5491155550000"},
+		},
+		{
+			name:           "same chat twice",
+			targets:        []broadcastTarget{{Phone: "5491155551234"}, {Phone: "+5491155551234"}, {Phone: "5491155551234@s.whatsapp.net"}},
+			message:        `{"Body":"Hello"}`,
+			wantPhones:     []string{"5491155551234"},
+			wantDuplicates: 2,
+		},
+		{
+			name:       "variables for every placeholder",
+			targets:    []broadcastTarget{{Phone: "1", Variables: map[string]string{"name": "Ana"}}},
+			message:    `{"Body":"Hi {{name}}, your number is {{ phone }}"}`,
+			wantPhones: []string{"1"},
+		},
+		{
+			name:    "missing variable",
+			targets: []broadcastTarget{{Phone: "1", Variables: map[string]string{"name": "Ana"}}, {Phone: "2"}},
+			message: `{"Body":"Hi {{name}}"}`,
+			wantErr: true,
+		},
+		{name: "missing phone", targets: []broadcastTarget{{Phone: " "}}, message: `{}`, wantErr: true},
+		{name: "invalid phone", targets: []broadcastTarget{{Phone: "@s.whatsapp.net"}}, message: `{}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		prepared, duplicates, err := prepareBroadcastTargets(tt.targets, tt.message)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		phones := []string{}
+		for _, target := range prepared {
+			phones = append(phones, target.Phone)
+			// The phone is always available as a variable
+			if target.Variables["phone"] == "" {
+				t.Errorf("%s: recipient %s has no phone variable", tt.name, target.Phone)
+			}
+		}
+		if !reflect.DeepEqual(phones, tt.wantPhones) || duplicates != tt.wantDuplicates {
+			t.Errorf("%s: got %v with %d duplicates, want %v with %d", tt.name, phones, duplicates, tt.wantPhones, tt.wantDuplicates)
+		}
+	}
+}
+
+func TestRenderBroadcastMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   string
+		variables string
+		want      map[string]interface{}
+		wantErr   bool
+	}{
+		{
+			name:      "text",
+			message:   `{"Body":"Hi {{name}}, order {{ order.id }} is ready","SendAt":1}`,
+			variables: `{"name":"Ana","order.id":"A-1"}`,
+			want:      map[string]interface{}{"Body": "Hi Ana, order A-1 is ready", "Phone": "5491155551234", "Id": "3EB0AA"},
+		},
+		{
+			name:      "nested strings",
+			message:   `{"Caption":"{{name}}","Sections":[{"Title":"For {{name}}","Rows":[{"Title":"{{name}}"}]}],"Count":2}`,
+			variables: `{"name":"Bob"}`,
+			want: map[string]interface{}{
+				"Caption":  "Bob",
+				"Sections": []interface{}{map[string]interface{}{"Title": "For Bob", "Rows": []interface{}{map[string]interface{}{"Title": "Bob"}}}},
+				"Count":    float64(2),
+				"Phone":    "5491155551234",
+				"Id":       "3EB0AA",
+			},
+		},
+		{
+			name:      "template Phone and Id are replaced",
+			message:   `{"Body":"x","Phone":"other","Id":"other"}`,
+			variables: `{}`,
+			want:      map[string]interface{}{"Body": "x", "Phone": "5491155551234", "Id": "3EB0AA"},
+		},
+		{
+			name:      "unknown placeholder is emptied",
+			message:   `{"Body":"[{{missing}}]"}`,
+			variables: `{}`,
+			want:      map[string]interface{}{"Body": "[]", "Phone": "5491155551234", "Id": "3EB0AA"},
+		},
+		{name: "invalid message", message: `{`, variables: `{}`, wantErr: true},
+		{name: "invalid variables", message: `{}`, variables: `[`, wantErr: true},
+	}
+	for _, tt := range tests {
+		recipient := broadcastRecipient{Phone: "5491155551234", MessageID: "3EB0AA", Variables: tt.variables}
+		data, err := renderBroadcastMessage(tt.message, recipient)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := map[string]interface{}{}
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newTestBroadcast stores a running text broadcast of the test user to the given phones
+func newTestBroadcast(t *testing.T, db *sqlx.DB, phones ...string) *broadcast {
+	t.Helper()
+	targets := []broadcastTarget{}
+	for _, phone := range phones {
+		targets = append(targets, broadcastTarget{Phone: phone, Variables: map[string]string{"phone": phone}})
+	}
+	job, err := createBroadcast(db, "user", "text", `{"Body":"hi"}`, 20, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// recipientStatuses returns the state of each recipient of a broadcast, by position
+func recipientStatuses(t *testing.T, db *sqlx.DB, id string) []string {
+	t.Helper()
+	statuses := []string{}
+	if err := db.Select(&statuses, "SELECT status FROM broadcast_recipients WHERE broadcast_id=$1 ORDER BY position", id); err != nil {
+		t.Fatal(err)
+	}
+	return statuses
+}
+
+func TestGetBroadcast(t *testing.T) {
+	db := newTestDB(t)
+	job := newTestBroadcast(t, db, "1", "2", "3", "4", "5", "6")
+	for position, status := range map[int]string{1: recipientSent, 2: recipientSent, 3: recipientFailed, 4: recipientCancelled, 5: recipientSending} {
+		if err := recordBroadcastResult(db, job.ID, position, status, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		state     string
+		positions []int
+	}{
+		{state: "", positions: []int{1, 2, 3, 4, 5, 6}},
+		{state: recipientSent, positions: []int{1, 2}},
+		{state: recipientFailed, positions: []int{3}},
+		{state: recipientPending, positions: []int{6}},
+	}
+	for _, tt := range tests {
+		got, err := getBroadcast(db, "user", job.ID, tt.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Progress counts every recipient whatever the state listed, the one being sent is pending
+		want := broadcastProgress{Total: 6, Pending: 2, Sent: 2, Failed: 1, Cancelled: 1}
+		if got.Progress != want {
+			t.Errorf("state %q: got progress %+v, want %+v", tt.state, got.Progress, want)
+		}
+		positions := []int{}
+		for _, r := range got.Recipients {
+			positions = append(positions, r.Position)
+		}
+		if !reflect.DeepEqual(positions, tt.positions) {
+			t.Errorf("state %q: got recipients %v, want %v", tt.state, positions, tt.positions)
+		}
+	}
+
+	if _, err := getBroadcast(db, "other", job.ID, ""); err != sql.ErrNoRows {
+		t.Errorf("broadcast of another user: got error %v, want sql.ErrNoRows", err)
+	}
+	if _, err := getBroadcast(db, "user", "missing", ""); err != sql.ErrNoRows {
+		t.Errorf("unknown broadcast: got error %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestCancelBroadcast(t *testing.T) {
+	db := newTestDB(t)
+	job := newTestBroadcast(t, db, "1", "2", "3")
+	if err := recordBroadcastResult(db, job.ID, 1, recipientSent, "", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordBroadcastResult(db, job.ID, 2, recipientSending, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	broadcastMutex.Lock()
+	broadcastCancels[job.ID] = func() { stopped = true }
+	broadcastMutex.Unlock()
+	defer func() {
+		broadcastMutex.Lock()
+		delete(broadcastCancels, job.ID)
+		broadcastMutex.Unlock()
+	}()
+
+	if ok, err := cancelBroadcast(db, "other", job.ID); ok || err != nil {
+		t.Fatalf("broadcast of another user: got %t, %v, want false", ok, err)
+	}
+	if ok, err := cancelBroadcast(db, "user", job.ID); !ok || err != nil {
+		t.Fatalf("got %t, %v, want true", ok, err)
+	}
+	if !stopped {
+		t.Error("the running broadcast was not stopped")
+	}
+	// The message being sent keeps its state until its result is recorded
+	want := []string{recipientSent, recipientSending, recipientCancelled}
+	if got := recipientStatuses(t, db, job.ID); !reflect.DeepEqual(got, want) {
+		t.Errorf("got recipients %v, want %v", got, want)
+	}
+	got, err := getBroadcast(db, "user", job.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != broadcastCancelled || got.FinishedAt == 0 {
+		t.Errorf("got status %s finished at %d, want cancelled", got.Status, got.FinishedAt)
+	}
+	if ok, err := cancelBroadcast(db, "user", job.ID); ok || err != nil {
+		t.Errorf("already cancelled: got %t, %v, want false", ok, err)
+	}
+}
+
+func TestRequeueBroadcastRecipient(t *testing.T) {
+	tests := []struct {
+		name      string
+		cancelled bool
+		want      string
+	}{
+		{name: "running", want: recipientPending},
+		{name: "cancelled during the send", cancelled: true, want: recipientCancelled},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		job := newTestBroadcast(t, db, "1")
+		if err := recordBroadcastResult(db, job.ID, 1, recipientSending, "", 0); err != nil {
+			t.Fatal(err)
+		}
+		if tt.cancelled {
+			if _, err := cancelBroadcast(db, "user", job.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		status, err := requeueBroadcastRecipient(db, job.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := recipientStatuses(t, db, job.ID); status != tt.want || got[0] != tt.want {
+			t.Errorf("%s: got %s, stored %s, want %s", tt.name, status, got[0], tt.want)
+		}
+	}
+}
+
+func TestSettleInterruptedBroadcasts(t *testing.T) {
+	sentAt := time.Unix(1717240000, 0)
+	tests := []struct {
+		name       string
+		cancelled  bool
+		sent       string
+		wantStatus string
+		wantSentAt int64
+	}{
+		{name: "not sent", wantStatus: recipientPending},
+		{name: "acknowledged", sent: messageStatusSent, wantStatus: recipientSent, wantSentAt: sentAt.Unix()},
+		{name: "send failed", sent: messageStatusFailed, wantStatus: recipientPending},
+		{name: "not sent, cancelled", cancelled: true, wantStatus: recipientCancelled},
+		{name: "acknowledged, cancelled", cancelled: true, sent: messageStatusSent, wantStatus: recipientSent, wantSentAt: sentAt.Unix()},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		job := newTestBroadcast(t, db, "5491155551234", "5491155554321")
+		_, err := db.Exec("UPDATE broadcast_recipients SET status=$1, message_id=$2 WHERE broadcast_id=$3 AND position=1",
+			recipientSending, "3EB0AA", job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.cancelled {
+			if _, err := cancelBroadcast(db, "user", job.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		chat := types.NewJID("5491155551234", types.DefaultUserServer)
+		switch tt.sent {
+		case messageStatusSent:
+			err = recordOutgoingMessage(db, "user", "3EB0AA", chat, sentAt)
+		case messageStatusFailed:
+			storeFailedMessage(db, "user", chat, "3EB0AA", errors.New("timed out"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := settleInterruptedBroadcasts(db); err != nil {
+			t.Fatal(err)
+		}
+		got, err := getBroadcast(db, "user", job.ID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := got.Recipients[0]
+		if first.Status != tt.wantStatus || first.SentAt != tt.wantSentAt || first.MessageID != "3EB0AA" {
+			t.Errorf("%s: got %s sent at %d with Id %s, want %s sent at %d", tt.name, first.Status, first.SentAt, first.MessageID, tt.wantStatus, tt.wantSentAt)
+		}
+		want := recipientPending
+		if tt.cancelled {
+			want = recipientCancelled
+		}
+		if got.Recipients[1].Status != want {
+			t.Errorf("%s: got second recipient %s, want %s", tt.name, got.Recipients[1].Status, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// callSettings are the per-user call options set with /session/calls/config
+type callSettings struct {
+	RejectCalls   bool   `db:"reject_calls" json:"reject_calls"`
+	RejectMessage string `db:"reject_calls_message" json:"reject_calls_message"`
+}
+
+// callDetails summarizes a call event in the "call" field of the webhook payload,
+// so receivers do not have to dig into the raw call node
+func callDetails(rawEvt interface{}) map[string]interface{} {
+	var meta types.BasicCallMeta
+	var node *waBinary.Node
+	details := map[string]interface{}{}
+
+	switch evt := rawEvt.(type) {
+	case *events.CallOffer:
+		meta, node = evt.BasicCallMeta, evt.Data
+		details["platform"] = evt.RemotePlatform
+		details["version"] = evt.RemoteVersion
+	case *events.CallAccept:
+		meta, node = evt.BasicCallMeta, evt.Data
+		details["platform"] = evt.RemotePlatform
+		details["version"] = evt.RemoteVersion
+	case *events.CallTerminate:
+		meta, node = evt.BasicCallMeta, evt.Data
+		details["reason"] = evt.Reason
+	case *events.CallOfferNotice:
+		meta, node = evt.BasicCallMeta, evt.Data
+		details["isVideo"] = evt.Media == "video"
+		details["isGroup"] = evt.Type == "group"
+	case *events.CallRelayLatency:
+		meta, node = evt.BasicCallMeta, evt.Data
+	default:
+		return details
+	}
+
+	details["id"] = meta.CallID
+	details["from"] = meta.From.String()
+	details["creator"] = meta.CallCreator.String()
+	details["timestamp"] = meta.Timestamp.Unix()
+
+	if node != nil {
+		// Offers list the media they carry, group calls name the group they belong to
+		if _, ok := details["isVideo"]; !ok {
+			_, details["isVideo"] = node.GetOptionalChildByTag("video")
+		}
+		if groupJID, ok := node.Attrs["group-jid"]; ok {
+			details["isGroup"] = true
+			details["groupJid"] = toJIDString(groupJID)
+		}
+	}
+	for _, key := range []string{"isVideo", "isGroup"} {
+		if _, ok := details[key]; !ok {
+			details[key] = false
+		}
+	}
+	return details
+}
+
+func toJIDString(v interface{}) string {
+	switch jid := v.(type) {
+	case types.JID:
+		return jid.String()
+	case string:
+		return jid
+	}
+	return ""
+}
+
+// callEventContext lets webhook filters match call events on the caller, or the group of a group call
+func callEventContext(details map[string]interface{}) webhookEventContext {
+	chat := details["from"]
+	isGroup, _ := details["isGroup"].(bool)
+	if groupJID, ok := details["groupJid"].(string); ok && groupJID != "" {
+		chat = groupJID
+	}
+	jid, err := types.ParseJID(toJIDString(chat))
+	if err != nil || jid.IsEmpty() {
+		return webhookEventContext{}
+	}
+	return webhookEventContext{HasChat: true, Chat: jid.ToNonAD(), IsGroup: isGroup}
+}
+
+// rejectCall declines an incoming call when the user turned on automatic rejection,
+// and answers the caller with the configured text. It reports whether the call was rejected.
+func (mycli *MyClient) rejectCall(evt *events.CallOffer) bool {
+	var settings callSettings
+	err := mycli.db.Get(&settings, "SELECT reject_calls, reject_calls_message FROM users WHERE id=$1", mycli.userID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Msg("Could not load call settings")
+		return false
+	}
+	if !settings.RejectCalls {
+		return false
+	}
+
+	if err := mycli.WAClient.RejectCall(evt.From, evt.CallID); err != nil {
+		log.Error().Err(err).Str("callID", evt.CallID).Str("from", evt.From.String()).Msg("Failed to reject call")
+		return false
+	}
+	log.Info().Str("callID", evt.CallID).Str("from", evt.From.String()).Msg("Call rejected")
+
+	if settings.RejectMessage != "" {
+		msg := &waE2E.Message{Conversation: proto.String(settings.RejectMessage)}
+		_, err := mycli.WAClient.SendMessage(context.Background(), evt.From.ToNonAD(), msg)
+		if err != nil {
+			log.Error().Err(err).Str("to", evt.From.String()).Msg("Failed to send call rejection message")
+		}
+	}
+	return true
+}
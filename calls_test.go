@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestCallDetails(t *testing.T) {
+	caller := types.NewADJID("5491155551234", 0, 3)
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	meta := types.BasicCallMeta{From: caller, Timestamp: time.Unix(100, 0), CallCreator: caller, CallID: "CALL1"}
+	remote := types.CallRemoteMeta{RemotePlatform: "android", RemoteVersion: "2.24.1"}
+	videoOffer := &waBinary.Node{Tag: "offer", Content: []waBinary.Node{{Tag: "audio"}, {Tag: "video"}}}
+	groupOffer := &waBinary.Node{Tag: "offer", Attrs: waBinary.Attrs{"group-jid": group}, Content: []waBinary.Node{{Tag: "audio"}}}
+
+	tests := []struct {
+		name string
+		evt  interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "offer",
+			evt:  &events.CallOffer{BasicCallMeta: meta, CallRemoteMeta: remote, Data: &waBinary.Node{Tag: "offer", Content: []waBinary.Node{{Tag: "audio"}}}},
+			want: map[string]interface{}{"platform": "android", "version": "2.24.1", "isVideo": false, "isGroup": false},
+		},
+		{
+			name: "video offer",
+			evt:  &events.CallOffer{BasicCallMeta: meta, CallRemoteMeta: remote, Data: videoOffer},
+			want: map[string]interface{}{"platform": "android", "version": "2.24.1", "isVideo": true, "isGroup": false},
+		},
+		{
+			name: "group offer",
+			evt:  &events.CallOffer{BasicCallMeta: meta, CallRemoteMeta: remote, Data: groupOffer},
+			want: map[string]interface{}{"platform": "android", "version": "2.24.1", "isVideo": false, "isGroup": true, "groupJid": group.String()},
+		},
+		{
+			name: "group offer with the jid as text",
+			evt:  &events.CallAccept{BasicCallMeta: meta, CallRemoteMeta: remote, Data: &waBinary.Node{Tag: "accept", Attrs: waBinary.Attrs{"group-jid": group.String()}}},
+			want: map[string]interface{}{"platform": "android", "version": "2.24.1", "isVideo": false, "isGroup": true, "groupJid": group.String()},
+		},
+		{
+			name: "video group notice",
+			evt:  &events.CallOfferNotice{BasicCallMeta: meta, Media: "video", Type: "group"},
+			want: map[string]interface{}{"isVideo": true, "isGroup": true},
+		},
+		{
+			name: "audio notice",
+			evt:  &events.CallOfferNotice{BasicCallMeta: meta, Media: "audio", Data: videoOffer},
+			want: map[string]interface{}{"isVideo": false, "isGroup": false},
+		},
+		{
+			name: "notice of a group named in the node",
+			evt:  &events.CallOfferNotice{BasicCallMeta: meta, Media: "audio", Data: groupOffer},
+			want: map[string]interface{}{"isVideo": false, "isGroup": true, "groupJid": group.String()},
+		},
+		{
+			name: "terminate",
+			evt:  &events.CallTerminate{BasicCallMeta: meta, Reason: "timeout"},
+			want: map[string]interface{}{"reason": "timeout", "isVideo": false, "isGroup": false},
+		},
+	}
+	for _, tt := range tests {
+		tt.want["id"] = "CALL1"
+		tt.want["from"] = caller.String()
+		tt.want["creator"] = caller.String()
+		tt.want["timestamp"] = int64(100)
+		if got := callDetails(tt.evt); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := callDetails(&events.CallReject{BasicCallMeta: meta}); len(got) != 0 {
+		t.Errorf("reject: got %v, want no details", got)
+	}
+}
+
+func TestCallEventContext(t *testing.T) {
+	caller := types.NewADJID("5491155551234", 0, 3)
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	tests := []struct {
+		name    string
+		details map[string]interface{}
+		want    webhookEventContext
+	}{
+		{"direct call", map[string]interface{}{"from": caller.String(), "isGroup": false}, webhookEventContext{HasChat: true, Chat: caller.ToNonAD()}},
+		{"group call", map[string]interface{}{"from": caller.String(), "isGroup": true, "groupJid": group.String()}, webhookEventContext{HasChat: true, Chat: group, IsGroup: true}},
+		{"group call without a jid", map[string]interface{}{"from": caller.String(), "isGroup": true}, webhookEventContext{HasChat: true, Chat: caller.ToNonAD(), IsGroup: true}},
+		{"no caller", map[string]interface{}{}, webhookEventContext{}},
+	}
+	for _, tt := range tests {
+		if got := callEventContext(tt.details); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// chatExport describes the archive produced by POST /chat/export
+type chatExport struct {
+	Chat     types.JID
+	From     int64
+	To       int64
+	Location *time.Location
+	Media    bool
+}
+
+// exportedMessage is a stored message as written to messages.json, along with the file of its media in the archive
+type exportedMessage struct {
+	storedMessage
+	MediaFile  string `json:"media_file,omitempty"`
+	MediaError string `json:"media_error,omitempty"`
+}
+
+// exportMessages returns the stored messages of the exported chat and date range, oldest first
+func exportMessages(db *sqlx.DB, userID string, e chatExport) ([]storedMessage, error) {
+	where, args := messageQuery{Chat: e.Chat.ToNonAD().String(), From: e.From, To: e.To}.where(userID, "", nil)
+
+	messages := []storedMessage{}
+	err := db.Select(&messages, "SELECT "+storedMessageColumns+" FROM messages WHERE "+where+" ORDER BY timestamp, id", args...)
+	return messages, err
+}
+
+// writeChatExport writes the ZIP archive of a chat: messages.json, a readable transcript.html, a chat.txt in the
+// format of WhatsApp exports and the media files. Media that cannot be fetched is reported in messages.json.
+func writeChatExport(ctx context.Context, w io.Writer, userID string, cli *whatsmeow.Client, e chatExport, messages []storedMessage) error {
+	archive := zip.NewWriter(w)
+
+	exported := make([]exportedMessage, len(messages))
+	for i, m := range messages {
+		exported[i].storedMessage = m
+		if !e.Media || m.Media == "" || m.Revoked {
+			continue
+		}
+		media, err := fetchExportMedia(ctx, userID, cli, m)
+		if err != nil {
+			log.Warn().Err(err).Str("id", m.ID).Msg("Could not export media")
+			exported[i].MediaError = err.Error()
+			continue
+		}
+		name := "media/" + exportMediaName(i+1, m)
+		readErr, err := addExportMedia(archive, name, time.Unix(m.Timestamp, 0), media)
+		if err != nil {
+			return err
+		}
+		// The transcripts only point to complete files
+		if readErr != nil {
+			log.Warn().Err(readErr).Str("id", m.ID).Msg("Could not export media")
+			exported[i].MediaError = readErr.Error()
+			continue
+		}
+		exported[i].MediaFile = name
+	}
+
+	f, err := archive.Create("messages.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(map[string]interface{}{
+		"chat":        e.Chat.ToNonAD().String(),
+		"from":        e.From,
+		"to":          e.To,
+		"exported_at": time.Now().Unix(),
+		"messages":    exported,
+	})
+	if err != nil {
+		return err
+	}
+
+	if f, err = archive.Create("chat.txt"); err != nil {
+		return err
+	}
+	for _, m := range exported {
+		text := exportMessageText(m)
+		if m.MediaFile != "" {
+			text = strings.TrimSpace("<attached: " + path.Base(m.MediaFile) + "> " + text)
+		}
+		ts := time.Unix(m.Timestamp, 0).In(e.Location).Format("02/01/2006, 15:04:05")
+		if _, err := fmt.Fprintf(f, "[%s] %s: %s\n", ts, exportSenderName(m.storedMessage), text); err != nil {
+			return err
+		}
+	}
+
+	if f, err = archive.Create("transcript.html"); err != nil {
+		return err
+	}
+	if err := writeChatTranscript(f, e, exported); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// fetchExportMedia opens the media of a message on S3 when media_delivery uploaded it there, or downloads it
+// again from WhatsApp into a temporary file, as WhatsApp only keeps media for a limited time
+func fetchExportMedia(ctx context.Context, userID string, cli *whatsmeow.Client, m storedMessage) (io.ReadCloser, error) {
+	if m.S3Key != "" {
+		body, err := GetS3Manager().DownloadFromS3(ctx, userID, m.S3Key)
+		if err == nil {
+			return body, nil
+		}
+		log.Warn().Err(err).Str("id", m.ID).Msg("Could not fetch media from S3, downloading it again")
+	}
+	if m.MediaDownload == "" {
+		return nil, errors.New("media was stored without download information")
+	}
+	if cli == nil || !cli.IsConnected() {
+		return nil, errors.New("no session to download media")
+	}
+	var d mediaDownload
+	if err := json.Unmarshal([]byte(m.MediaDownload), &d); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp("", "wuzapi-export-*")
+	if err != nil {
+		return nil, err
+	}
+	tmp := &exportTempFile{file}
+	err = cli.DownloadMediaWithPathToFile(ctx, d.DirectPath, d.FileEncSHA256, d.FileSHA256, d.MediaKey, int(d.FileLength), whatsmeow.MediaType(d.MediaType), "", file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// addExportMedia copies media into the archive as it is read, and closes it. A failed read leaves a partial
+// file in the archive and is returned as readErr, err is a failure to write the archive.
+func addExportMedia(archive *zip.Writer, name string, modified time.Time, media io.ReadCloser) (readErr, err error) {
+	defer media.Close()
+	// Media files are already compressed, they are stored as is
+	f, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return nil, err
+	}
+	src := &exportMediaReader{r: media}
+	if _, err := io.Copy(f, src); src.err != nil {
+		return src.err, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// exportTempFile is a downloaded media file, removed once it is copied into the archive
+type exportTempFile struct {
+	*os.File
+}
+
+func (f *exportTempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// exportMediaReader keeps the error of reading the media apart from the ones of writing the archive
+type exportMediaReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *exportMediaReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// exportMediaName names a media file after its position in the chat and its message, keeping the extension
+// of the original file name or the one of its mime type
+func exportMediaName(position int, m storedMessage) string {
+	var media mediaContent
+	json.Unmarshal([]byte(m.Media), &media)
+
+	ext := filepath.Ext(media.FileName)
+	if ext == "" {
+		if exts, _ := mime.ExtensionsByType(media.MimeType); len(exts) > 0 {
+			ext = exts[0]
+		} else {
+			ext = ".bin"
+		}
+	}
+	return fmt.Sprintf("%05d-%s%s", position, m.ID, ext)
+}
+
+// exportSenderName is the push name of the sender, or their phone number
+func exportSenderName(m storedMessage) string {
+	if m.PushName != "" {
+		return m.PushName
+	}
+	jid, err := types.ParseJID(m.Sender)
+	if err == nil && jid.Server == types.DefaultUserServer {
+		return "+" + jid.User
+	}
+	return m.Sender
+}
+
+// exportMessageText describes a message in words, using the markers of WhatsApp exports
+func exportMessageText(m exportedMessage) string {
+	if m.Revoked {
+		return "This message was deleted"
+	}
+
+	var content messageContent
+	json.Unmarshal([]byte(m.Content), &content)
+
+	text := m.Text
+	switch {
+	case content.Location != nil:
+		text = strings.TrimSpace(fmt.Sprintf("location: https://maps.google.com/?q=%f,%f %s", content.Location.Latitude, content.Location.Longitude, text))
+	case len(content.Contacts) > 0:
+		names := make([]string, 0, len(content.Contacts))
+		for _, contact := range content.Contacts {
+			names = append(names, contact.DisplayName)
+		}
+		text = "contact card: " + strings.Join(names, ", ")
+	case content.Poll != nil:
+		text = "POLL: " + content.Poll.Name
+		for _, option := range content.Poll.Options {
+			text += "\nOPTION: " + option
+		}
+	case m.Media != "" && m.MediaFile == "":
+		text = strings.TrimSpace("<Media omitted> " + text)
+	case m.Media == "" && text == "":
+		text = "<" + m.Type + ">"
+	}
+	if m.Edited {
+		text += " <This message was edited>"
+	}
+	return text
+}
+
+var chatTranscriptTemplate = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; background: #efeae2; margin: 0 auto; max-width: 900px; padding: 16px; }
+.message { width: fit-content; max-width: 70%; margin: 6px 0; padding: 6px 10px; border-radius: 8px; background: #fff; }
+.message.me { margin-left: auto; background: #d9fdd3; }
+.meta { font-size: 12px; color: #667781; }
+.text { white-space: pre-wrap; overflow-wrap: anywhere; }
+.deleted { font-style: italic; color: #667781; }
+img, video { display: block; max-width: 100%; margin: 4px 0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">{{.Range}}, exported {{.ExportedAt}}, {{len .Messages}} messages</p>
+{{range .Messages}}<div class="message{{if .FromMe}} me{{end}}">
+<div class="meta">{{.Sender}} · {{.Time}}</div>
+{{if .File}}{{if eq .Kind "image" "sticker"}}<a href="{{.File}}"><img src="{{.File}}" alt=""></a>
+{{else if eq .Kind "video"}}<video controls src="{{.File}}"></video>
+{{else if eq .Kind "audio"}}<audio controls src="{{.File}}"></audio>
+{{else}}<a href="{{.File}}">{{.File}}</a>
+{{end}}{{end}}<div class="text{{if .Deleted}} deleted{{end}}">{{.Text}}</div>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// writeChatTranscript renders the chat as an HTML page, with the media of the archive shown inline
+func writeChatTranscript(w io.Writer, e chatExport, messages []exportedMessage) error {
+	type transcriptMessage struct {
+		Sender  string
+		Time    string
+		Text    string
+		FromMe  bool
+		Deleted bool
+		File    string
+		Kind    string
+	}
+
+	const layout = "02/01/2006 15:04:05"
+	rangeText := "All messages"
+	switch {
+	case e.From > 0 && e.To > 0:
+		rangeText = "From " + time.Unix(e.From, 0).In(e.Location).Format(layout) + " to " + time.Unix(e.To, 0).In(e.Location).Format(layout)
+	case e.From > 0:
+		rangeText = "From " + time.Unix(e.From, 0).In(e.Location).Format(layout)
+	case e.To > 0:
+		rangeText = "Until " + time.Unix(e.To, 0).In(e.Location).Format(layout)
+	}
+
+	page := struct {
+		Title      string
+		Range      string
+		ExportedAt string
+		Messages   []transcriptMessage
+	}{
+		Title:      "Chat with " + e.Chat.ToNonAD().String(),
+		Range:      rangeText,
+		ExportedAt: time.Now().In(e.Location).Format(layout + " MST"),
+		Messages:   make([]transcriptMessage, 0, len(messages)),
+	}
+	for _, m := range messages {
+		page.Messages = append(page.Messages, transcriptMessage{
+			Sender:  exportSenderName(m.storedMessage),
+			Time:    time.Unix(m.Timestamp, 0).In(e.Location).Format(layout),
+			Text:    exportMessageText(m),
+			FromMe:  m.IsFromMe,
+			Deleted: m.Revoked,
+			File:    m.MediaFile,
+			Kind:    m.Type,
+		})
+	}
+	return chatTranscriptTemplate.Execute(w, page)
+}
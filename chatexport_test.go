@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// failingReader returns data and then a read error
+type failingReader struct {
+	data []byte
+	done bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, errors.New("connection reset")
+	}
+	r.done = true
+	return copy(p, r.data), nil
+}
+
+func (r *failingReader) Close() error { return nil }
+
+// readZip returns the files of a ZIP archive by name, in the order they were written
+func readZip(t *testing.T, data []byte) ([]string, map[string]string) {
+	t.Helper()
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	files := map[string]string{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, f.Name)
+		files[f.Name] = string(content)
+	}
+	return names, files
+}
+
+func TestExportMediaName(t *testing.T) {
+	tests := []struct {
+		name  string
+		media mediaContent
+		want  string
+	}{
+		{"file name", mediaContent{MimeType: "application/pdf", FileName: "invoice.PDF"}, "00007-3EB0AA.PDF"},
+		{"mime type", mediaContent{MimeType: "image/png"}, "00007-3EB0AA.png"},
+		{"unknown mime type", mediaContent{MimeType: "application/x-wuzapi"}, "00007-3EB0AA.bin"},
+		{"no media", mediaContent{}, "00007-3EB0AA.bin"},
+	}
+	for _, tt := range tests {
+		m := storedMessage{ID: "3EB0AA", Media: newJSONText(tt.media)}
+		if got := exportMediaName(7, m); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExportMessageText(t *testing.T) {
+	image := newJSONText(mediaContent{MimeType: "image/jpeg"})
+	tests := []struct {
+		name string
+		m    exportedMessage
+		want string
+	}{
+		{"text", exportedMessage{storedMessage: storedMessage{Type: "text", Text: "hello"}}, "hello"},
+		{"edited", exportedMessage{storedMessage: storedMessage{Type: "text", Text: "hello", Edited: true}}, "hello <This message was edited>"},
+		{"deleted", exportedMessage{storedMessage: storedMessage{Type: "text", Text: "hello", Revoked: true}}, "This message was deleted"},
+		{"media included", exportedMessage{storedMessage: storedMessage{Type: "image", Text: "look", Media: image}, MediaFile: "media/00001-A.jpg"}, "look"},
+		{"media left out", exportedMessage{storedMessage: storedMessage{Type: "image", Text: "look", Media: image}}, "<Media omitted> look"},
+		{"media left out without caption", exportedMessage{storedMessage: storedMessage{Type: "image", Media: image}}, "<Media omitted>"},
+		{
+			"location",
+			exportedMessage{storedMessage: storedMessage{Type: "location", Content: newJSONText(messageContent{Location: &locationContent{Latitude: -34.6, Longitude: -58.38}})}},
+			"location: https://maps.google.com/?q=-34.600000,-58.380000",
+		},
+		{
+			"contacts",
+			exportedMessage{storedMessage: storedMessage{Type: "contacts", Content: newJSONText(messageContent{Contacts: []contactContent{{DisplayName: "Ana"}, {DisplayName: "Bob"}}})}},
+			"contact card: Ana, Bob",
+		},
+		{
+			"poll",
+			exportedMessage{storedMessage: storedMessage{Type: "poll", Content: newJSONText(messageContent{Poll: &pollContent{Name: "Lunch?", Options: []string{"Yes", "No"}}})}},
+			"POLL: Lunch?\nOPTION: Yes\nOPTION: No",
+		},
+		{"nothing to show", exportedMessage{storedMessage: storedMessage{Type: "other"}}, "<other>"},
+	}
+	for _, tt := range tests {
+		if got := exportMessageText(tt.m); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAddExportMedia(t *testing.T) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	modified := time.Unix(1717240000, 0)
+	readErr, err := addExportMedia(archive, "media/00001-A.jpg", modified, io.NopCloser(strings.NewReader("complete")))
+	if readErr != nil || err != nil {
+		t.Fatalf("got %v, %v", readErr, err)
+	}
+	// A failed read is not a failure to write the archive
+	readErr, err = addExportMedia(archive, "media/00002-B.jpg", modified, &failingReader{data: []byte("part")})
+	if readErr == nil || err != nil {
+		t.Fatalf("got %v, %v, want a read error", readErr, err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, files := readZip(t, buf.Bytes())
+	if files["media/00001-A.jpg"] != "complete" || files["media/00002-B.jpg"] != "part" {
+		t.Errorf("got files %q", files)
+	}
+}
+
+func TestWriteChatExport(t *testing.T) {
+	chat := types.NewJID("5491155551234", types.DefaultUserServer)
+	messages := []storedMessage{
+		{ID: "M1", Chat: chat.String(), Sender: chat.String(), Timestamp: 1717240000, Type: "text", Text: "hi", PushName: "Ana"},
+		{ID: "M2", Chat: chat.String(), Sender: "5491100000000@s.whatsapp.net", IsFromMe: true, Timestamp: 1717240060, Type: "text", Text: "hello", Edited: true},
+		// Media stored before download information was kept cannot be fetched again
+		{ID: "M3", Chat: chat.String(), Sender: chat.String(), Timestamp: 1717240120, Type: "image", Text: "look", Media: newJSONText(mediaContent{MimeType: "image/jpeg"})},
+		{ID: "M4", Chat: chat.String(), Sender: chat.String(), Timestamp: 1717240180, Type: "text", Revoked: true},
+	}
+	loc, err := time.LoadLocation("America/Argentina/Buenos_Aires")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := chatExport{Chat: chat, Location: loc, Media: true}
+
+	var buf bytes.Buffer
+	if err := writeChatExport(context.Background(), &buf, "user", nil, e, messages); err != nil {
+		t.Fatal(err)
+	}
+	names, files := readZip(t, buf.Bytes())
+	if want := []string{"messages.json", "chat.txt", "transcript.html"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got files %v, want %v", names, want)
+	}
+
+	var doc struct {
+		Chat     string `json:"chat"`
+		Messages []struct {
+			ID         string `json:"id"`
+			MediaFile  string `json:"media_file"`
+			MediaError string `json:"media_error"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal([]byte(files["messages.json"]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Chat != chat.String() || len(doc.Messages) != 4 {
+		t.Fatalf("got messages.json %+v", doc)
+	}
+	if m := doc.Messages[2]; m.ID != "M3" || m.MediaFile != "" || m.MediaError != "media was stored without download information" {
+		t.Errorf("got media message %+v", m)
+	}
+
+	wantTxt := "[01/06/2024, 08:06:40] Ana: hi\n" +
+		"[01/06/2024, 08:07:40] +5491100000000: hello <This message was edited>\n" +
+		"[01/06/2024, 08:08:40] +5491155551234: <Media omitted> look\n" +
+		"[01/06/2024, 08:09:40] +5491155551234: This message was deleted\n"
+	if files["chat.txt"] != wantTxt {
+		t.Errorf("got chat.txt\n%s\nwant\n%s", files["chat.txt"], wantTxt)
+	}
+
+	html := files["transcript.html"]
+	for _, want := range []string{"Chat with 5491155551234@s.whatsapp.net", "4 messages", `class="message me"`, "&lt;Media omitted&gt; look", `class="text deleted"`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("transcript.html does not contain %q", want)
+		}
+	}
+	if strings.Contains(html, "<img") {
+		t.Error("transcript.html shows media that is not in the archive")
+	}
+}
+
+func TestWriteChatExportWithoutMedia(t *testing.T) {
+	chat := types.NewJID("5491155551234", types.DefaultUserServer)
+	messages := []storedMessage{
+		{ID: "M1", Chat: chat.String(), Sender: chat.String(), Timestamp: 1717240000, Type: "image", Media: newJSONText(mediaContent{MimeType: "image/jpeg"})},
+	}
+	var buf bytes.Buffer
+	if err := writeChatExport(context.Background(), &buf, "user", nil, chatExport{Chat: chat, Location: time.UTC}, messages); err != nil {
+		t.Fatal(err)
+	}
+	_, files := readZip(t, buf.Bytes())
+	// Media left out on purpose is not an error
+	if strings.Contains(files["messages.json"], "media_error") || files["chat.txt"] != "[01/06/2024, 11:06:40] +5491155551234: <Media omitted>\n" {
+		t.Errorf("got messages.json %s and chat.txt %q", files["messages.json"], files["chat.txt"])
+	}
+}
+
+func TestExportChatNeedsMessageStore(t *testing.T) {
+	s := &server{db: newTestDB(t)}
+	r := httptest.NewRequest("POST", "/chat/export", strings.NewReader(`{"Chat":"5491155551234"}`))
+	r = r.WithContext(context.WithValue(r.Context(), "userinfo", Values{map[string]string{"Id": "user"}}))
+	w := httptest.NewRecorder()
+	s.ExportChat().ServeHTTP(w, r)
+	// An empty archive would read as a chat without messages
+	if w.Code != http.StatusConflict || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got status %d with %s, want 409", w.Code, w.Header().Get("Content-Type"))
+	}
+}
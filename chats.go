@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/proto/waSyncAction"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// mutedForever is stored in muted_until for chats muted without an end
+const mutedForever = -1
+
+const chatColumns = "jid, name, last_message_id, last_message_sender, last_message_from_me, last_message_type, last_message_text, last_message_at, unread_count, muted_until, archived, pinned_at, ephemeral_timer"
+
+// chatSummary is a row of the chats table, one per conversation the session knows about
+type chatSummary struct {
+	JID               string `db:"jid" json:"jid"`
+	Name              string `db:"name" json:"name"`
+	IsGroup           bool   `db:"-" json:"is_group"`
+	LastMessageID     string `db:"last_message_id" json:"last_message_id"`
+	LastMessageSender string `db:"last_message_sender" json:"last_message_sender"`
+	LastMessageFromMe bool   `db:"last_message_from_me" json:"last_message_from_me"`
+	LastMessageType   string `db:"last_message_type" json:"last_message_type"`
+	LastMessageText   string `db:"last_message_text" json:"last_message_text"`
+	LastMessageAt     int64  `db:"last_message_at" json:"last_message_at"`
+	UnreadCount       int    `db:"unread_count" json:"unread_count"`
+	Muted             bool   `db:"-" json:"muted"`
+	MutedUntil        int64  `db:"muted_until" json:"muted_until"`
+	Archived          bool   `db:"archived" json:"archived"`
+	Pinned            bool   `db:"-" json:"pinned"`
+	PinnedAt          int64  `db:"pinned_at" json:"pinned_at"`
+	EphemeralTimer    int64  `db:"ephemeral_timer" json:"ephemeral_timer"`
+}
+
+// isListedChat reports whether a JID belongs in the chat list, status updates are not a conversation
+func isListedChat(jid types.JID) bool {
+	return !jid.IsEmpty() && jid.ToNonAD() != types.StatusBroadcastJID
+}
+
+// updateChat creates the row of a chat if needed and applies set to it. Placeholders in set start at $3.
+func updateChat(db sqlx.Execer, userID, jid, set string, args ...interface{}) error {
+	_, err := db.Exec("INSERT INTO chats (user_id, jid) VALUES ($1, $2) ON CONFLICT (user_id, jid) DO NOTHING", userID, jid)
+	if err != nil || set == "" {
+		return err
+	}
+	_, err = db.Exec("UPDATE chats SET "+set+" WHERE user_id=$1 AND jid=$2", append([]interface{}{userID, jid}, args...)...)
+	return err
+}
+
+// setChatLastMessage makes m the last message of its chat, unless the chat already has a newer one or
+// this very message. It reports whether m became the last message.
+// Its text is only kept for users with the message store on.
+func setChatLastMessage(db sqlx.Execer, userID string, m storedMessage, keepText bool) (bool, error) {
+	if !keepText {
+		m.Text = ""
+	}
+	if err := updateChat(db, userID, m.Chat, ""); err != nil {
+		return false, err
+	}
+	res, err := db.Exec(`UPDATE chats SET last_message_id=$3, last_message_sender=$4, last_message_from_me=$5,
+        last_message_type=$6, last_message_text=$7, last_message_at=$8
+        WHERE user_id=$1 AND jid=$2 AND (last_message_at < $8 OR (last_message_at = $8 AND last_message_id <> $3))`,
+		userID, m.Chat, m.ID, m.Sender, m.IsFromMe, m.Type, m.Text, m.Timestamp)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// isChatPreview reports whether a message can be shown as the last message of a chat. Edits, revokes, reactions,
+// votes and other protocol messages change existing messages instead.
+func isChatPreview(msg *waE2E.Message, content messageContent) bool {
+	if msg == nil || msg.GetProtocolMessage() != nil {
+		return false
+	}
+	switch content.Kind {
+	case "edit", "revoke", "reaction", "poll_vote":
+		return false
+	}
+	return true
+}
+
+// recordChatMessage updates the chat of a message received or sent: its last message, unread count and
+// disappearing messages timer. The text of the last message is only kept when keepText is set.
+func recordChatMessage(db sqlx.Execer, userID string, info types.MessageInfo, msg *waE2E.Message, content messageContent, keepText bool) error {
+	if !isListedChat(info.Chat) {
+		return nil
+	}
+	jid := info.Chat.ToNonAD().String()
+
+	// The setting message changes the timer, other messages carry the timer in use
+	if pm := msg.GetProtocolMessage(); pm != nil && pm.GetType() == waE2E.ProtocolMessage_EPHEMERAL_SETTING {
+		return updateChat(db, userID, jid, "ephemeral_timer=$3", pm.GetEphemeralExpiration())
+	}
+	if ctxInfo := messageContextInfo(msg); ctxInfo != nil && ctxInfo.Expiration != nil {
+		if err := updateChat(db, userID, jid, "ephemeral_timer=$3", ctxInfo.GetExpiration()); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case content.Kind == "edit" && content.Edit != nil:
+		if !keepText {
+			return nil
+		}
+		_, err := db.Exec("UPDATE chats SET last_message_text=$3 WHERE user_id=$1 AND jid=$2 AND last_message_id=$4",
+			userID, jid, content.Text, content.Edit.ID)
+		return err
+	case content.Kind == "revoke" && content.Revoke != nil:
+		_, err := db.Exec("UPDATE chats SET last_message_text='', last_message_type='revoked' WHERE user_id=$1 AND jid=$2 AND last_message_id=$3",
+			userID, jid, content.Revoke.ID)
+		return err
+	case !isChatPreview(msg, content):
+		return nil
+	}
+
+	// Messages delivered again and older ones synced late leave the unread count alone
+	latest, err := setChatLastMessage(db, userID, newStoredMessage(info, msg, content, ""), keepText)
+	if err != nil || !latest {
+		return err
+	}
+	// Answering a chat reads it
+	if info.IsFromMe {
+		return updateChat(db, userID, jid, "unread_count=0")
+	}
+	return updateChat(db, userID, jid, "unread_count=unread_count+1")
+}
+
+// markChatRead clears the unread count of a chat
+func markChatRead(db sqlx.Execer, userID string, chat types.JID) error {
+	if !isListedChat(chat) {
+		return nil
+	}
+	return updateChat(db, userID, chat.ToNonAD().String(), "unread_count=0")
+}
+
+// muteEnd converts the end of a mute sent by WhatsApp to muted_until, in seconds
+func muteEnd(muted bool, endMillis int64) int64 {
+	switch {
+	case !muted:
+		return 0
+	case endMillis < 0:
+		return mutedForever
+	}
+	return endMillis / 1000
+}
+
+// applyChatAppState updates the chat list from mute, pin, archive, read, contact and delete actions
+// synced from the other devices of the account
+func (mycli *MyClient) applyChatAppState(evt *events.AppState) {
+	if len(evt.Index) < 2 {
+		return
+	}
+	chat, err := types.ParseJID(evt.Index[1])
+	if err != nil || !isListedChat(chat) {
+		return
+	}
+	jid := chat.ToNonAD().String()
+	act := evt.SyncActionValue
+
+	switch evt.Index[0] {
+	case appstate.IndexMute:
+		mute := act.GetMuteAction()
+		err = updateChat(mycli.db, mycli.userID, jid, "muted_until=$3", muteEnd(mute.GetMuted(), mute.GetMuteEndTimestamp()))
+	case appstate.IndexPin:
+		var pinnedAt int64
+		if act.GetPinAction().GetPinned() {
+			pinnedAt = act.GetTimestamp() / 1000
+		}
+		err = updateChat(mycli.db, mycli.userID, jid, "pinned_at=$3", pinnedAt)
+	case appstate.IndexArchive:
+		err = updateChat(mycli.db, mycli.userID, jid, "archived=$3", act.GetArchiveChatAction().GetArchived())
+	case appstate.IndexMarkChatAsRead:
+		if act.GetMarkChatAsReadAction().GetRead() {
+			err = updateChat(mycli.db, mycli.userID, jid, "unread_count=0")
+		} else {
+			// Chats marked as unread show as having one unread message
+			err = updateChat(mycli.db, mycli.userID, jid, "unread_count=CASE WHEN unread_count = 0 THEN 1 ELSE unread_count END")
+		}
+	case appstate.IndexContact:
+		// Only conversations are named, the address book is not added to the chat list
+		if name := contactActionName(act.GetContactAction()); name != "" {
+			_, err = mycli.db.Exec("UPDATE chats SET name=$3 WHERE user_id=$1 AND jid=$2", mycli.userID, jid, name)
+		}
+	case appstate.IndexClearChat:
+		err = updateChat(mycli.db, mycli.userID, jid, `last_message_id='', last_message_sender='', last_message_from_me=$3,
+            last_message_type='', last_message_text='', unread_count=0`, false)
+	case appstate.IndexDeleteChat:
+		_, err = mycli.db.Exec("DELETE FROM chats WHERE user_id=$1 AND jid=$2", mycli.userID, jid)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("chat", jid).Str("action", evt.Index[0]).Msg("Failed to update chat")
+	}
+}
+
+func contactActionName(contact *waSyncAction.ContactAction) string {
+	if contact.GetFullName() != "" {
+		return contact.GetFullName()
+	}
+	return contact.GetFirstName()
+}
+
+// recordGroupChat keeps the name and disappearing messages timer of a group
+func (mycli *MyClient) recordGroupChat(group types.JID, name *types.GroupName, ephemeral *types.GroupEphemeral) {
+	jid := group.ToNonAD().String()
+	err := updateChat(mycli.db, mycli.userID, jid, "")
+	if err == nil && name != nil {
+		err = updateChat(mycli.db, mycli.userID, jid, "name=$3", name.Name)
+	}
+	if err == nil && ephemeral != nil {
+		var timer uint32
+		if ephemeral.IsEphemeral {
+			timer = ephemeral.DisappearingTimer
+		}
+		err = updateChat(mycli.db, mycli.userID, jid, "ephemeral_timer=$3", timer)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("chat", jid).Msg("Failed to update group chat")
+	}
+}
+
+// recordHistoryChat adds a conversation of a history sync to the chat list. Its state (name, unread count, flags)
+// is only taken from syncs that describe whole conversations, on demand syncs only bring older messages.
+func recordHistoryChat(db sqlx.Execer, userID string, chat types.JID, conv *waHistorySync.Conversation, last *storedMessage, withState, keepText bool) error {
+	if !isListedChat(chat) {
+		return nil
+	}
+	jid := chat.ToNonAD().String()
+	if err := updateChat(db, userID, jid, ""); err != nil {
+		return err
+	}
+	if withState {
+		unread := conv.GetUnreadCount()
+		if unread == 0 && conv.GetMarkedAsUnread() {
+			unread = 1
+		}
+		// History syncs give the end of a mute in seconds, with all bits set for chats muted forever
+		mutedUntil := int64(mutedForever)
+		if end := conv.GetMuteEndTime(); end <= math.MaxInt64 {
+			mutedUntil = int64(end)
+		}
+		err := updateChat(db, userID, jid, "unread_count=$3, muted_until=$4, archived=$5, pinned_at=$6, ephemeral_timer=$7",
+			unread, mutedUntil, conv.GetArchived(), int64(conv.GetPinned()), conv.GetEphemeralExpiration())
+		if err != nil {
+			return err
+		}
+		name := conv.GetName()
+		if name == "" {
+			name = conv.GetDisplayName()
+		}
+		if name != "" {
+			if err := updateChat(db, userID, jid, "name=$3", name); err != nil {
+				return err
+			}
+		}
+	}
+	if last != nil {
+		_, err := setChatLastMessage(db, userID, *last, keepText)
+		return err
+	}
+	return nil
+}
+
+// listChats returns the chats of a user, pinned chats first, then by their last message
+func listChats(db *sqlx.DB, userID string) ([]chatSummary, error) {
+	chats := []chatSummary{}
+	err := db.Select(&chats, "SELECT "+chatColumns+" FROM chats WHERE user_id=$1 ORDER BY pinned_at DESC, last_message_at DESC, jid", userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	for i := range chats {
+		c := &chats[i]
+		jid, _ := types.ParseJID(c.JID)
+		c.IsGroup = jid.Server == types.GroupServer
+		c.Muted = c.MutedUntil == mutedForever || c.MutedUntil > now
+		c.Pinned = c.PinnedAt > 0
+	}
+	return chats, nil
+}
+
+// resolveChatNames names chats from the contacts of the session, and from the joined groups for groups
+// whose name is not known yet. Group names found are saved.
+func resolveChatNames(db *sqlx.DB, userID string, cli *whatsmeow.Client, chats []chatSummary) {
+	if cli == nil || cli.Store.Contacts == nil {
+		return
+	}
+	contacts, err := cli.Store.Contacts.GetAllContacts(context.Background())
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not load contacts for chat names")
+	}
+
+	var groups map[string]string
+	for i := range chats {
+		c := &chats[i]
+		jid, err := types.ParseJID(c.JID)
+		if err != nil {
+			continue
+		}
+		if !c.IsGroup {
+			if contact, ok := contacts[jid]; ok {
+				if name := contactName(contact); name != "" {
+					c.Name = name
+				}
+			}
+			continue
+		}
+		if c.Name != "" || !cli.IsConnected() {
+			continue
+		}
+		if groups == nil {
+			groups = map[string]string{}
+			joined, err := cli.GetJoinedGroups()
+			if err != nil {
+				log.Warn().Err(err).Msg("Could not load joined groups for chat names")
+			}
+			for _, group := range joined {
+				groups[group.JID.String()] = group.Name
+			}
+		}
+		if name := groups[c.JID]; name != "" {
+			c.Name = name
+			if _, err := db.Exec("UPDATE chats SET name=$3 WHERE user_id=$1 AND jid=$2", userID, c.JID, name); err != nil {
+				log.Error().Err(err).Str("chat", c.JID).Msg("Failed to save group name")
+			}
+		}
+	}
+}
+
+// contactName picks the name shown for a contact: the address book name, then the business or push name
+func contactName(contact types.ContactInfo) string {
+	switch {
+	case contact.FullName != "":
+		return contact.FullName
+	case contact.FirstName != "":
+		return contact.FirstName
+	case contact.BusinessName != "":
+		return contact.BusinessName
+	}
+	return contact.PushName
+}
+
+// recordReceivedChatMessage updates the chat list from a message event
+func (mycli *MyClient) recordReceivedChatMessage(evt *events.Message) {
+	keepText := messageStoreEnabled(mycli.db, mycli.userID)
+	if err := recordChatMessage(mycli.db, mycli.userID, evt.Info, evt.Message, eventMessageContent(evt), keepText); err != nil {
+		log.Error().Err(err).Str("id", evt.Info.ID).Msg("Failed to update chat")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waSyncAction"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+var testChat = types.NewJID("5491155551234", types.DefaultUserServer)
+
+// getTestChat returns the chat of the test user with a JID, failing the test if it is not listed
+func getTestChat(t *testing.T, db *sqlx.DB, jid string) chatSummary {
+	t.Helper()
+	chats, err := listChats(db, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chats {
+		if c.JID == jid {
+			return c
+		}
+	}
+	t.Fatalf("chat %s not listed", jid)
+	return chatSummary{}
+}
+
+// textMessage builds a text message of testChat, sent at the given unix time
+func textMessage(id string, ts int64, fromMe bool, text string) (types.MessageInfo, *waE2E.Message) {
+	info := types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: testChat, Sender: testChat, IsFromMe: fromMe},
+		ID:            id,
+		Timestamp:     time.Unix(ts, 0),
+	}
+	return info, &waE2E.Message{Conversation: proto.String(text)}
+}
+
+func TestRecordChatMessage(t *testing.T) {
+	key := func(id string) *waCommon.MessageKey {
+		return &waCommon.MessageKey{ID: proto.String(id), RemoteJID: proto.String(testChat.String()), FromMe: proto.Bool(true)}
+	}
+	edit := &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+		Type:          waE2E.ProtocolMessage_MESSAGE_EDIT.Enum(),
+		Key:           key("M3"),
+		EditedMessage: &waE2E.Message{Conversation: proto.String("three, edited")},
+	}}
+	revoke := &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{Type: waE2E.ProtocolMessage_REVOKE.Enum(), Key: key("M3")}}
+	reaction := &waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{Key: key("M3"), Text: proto.String("👍")}}
+
+	// Each step is recorded on top of the previous ones
+	tests := []struct {
+		name       string
+		id         string
+		ts         int64
+		fromMe     bool
+		text       string
+		msg        *waE2E.Message
+		wantID     string
+		wantType   string
+		wantText   string
+		wantUnread int
+	}{
+		{name: "first message", id: "M1", ts: 100, text: "one", wantID: "M1", wantType: "text", wantText: "one", wantUnread: 1},
+		{name: "delivered again", id: "M1", ts: 100, text: "one", wantID: "M1", wantType: "text", wantText: "one", wantUnread: 1},
+		{name: "older message", id: "M0", ts: 50, text: "zero", wantID: "M1", wantType: "text", wantText: "one", wantUnread: 1},
+		{name: "same second", id: "M2", ts: 100, text: "two", wantID: "M2", wantType: "text", wantText: "two", wantUnread: 2},
+		{name: "answer", id: "M3", ts: 200, fromMe: true, text: "three", wantID: "M3", wantType: "text", wantText: "three", wantUnread: 0},
+		{name: "older message after answer", id: "M1b", ts: 150, text: "late", wantID: "M3", wantType: "text", wantText: "three", wantUnread: 0},
+		{name: "edit", id: "E1", ts: 210, fromMe: true, msg: edit, wantID: "M3", wantType: "text", wantText: "three, edited", wantUnread: 0},
+		{name: "reaction", id: "R1", ts: 220, msg: reaction, wantID: "M3", wantType: "text", wantText: "three, edited", wantUnread: 0},
+		{name: "revoke", id: "V1", ts: 230, fromMe: true, msg: revoke, wantID: "M3", wantType: "revoked", wantText: "", wantUnread: 0},
+	}
+	db := newTestDB(t)
+	for _, tt := range tests {
+		info, msg := textMessage(tt.id, tt.ts, tt.fromMe, tt.text)
+		if tt.msg != nil {
+			msg = tt.msg
+		}
+		if err := recordChatMessage(db, "user", info, msg, buildMessageContent(msg), true); err != nil {
+			t.Fatal(err)
+		}
+		c := getTestChat(t, db, testChat.String())
+		if c.LastMessageID != tt.wantID || c.LastMessageType != tt.wantType || c.LastMessageText != tt.wantText || c.UnreadCount != tt.wantUnread {
+			t.Errorf("%s: got last message %s %s %q with %d unread, want %s %s %q with %d unread", tt.name,
+				c.LastMessageID, c.LastMessageType, c.LastMessageText, c.UnreadCount, tt.wantID, tt.wantType, tt.wantText, tt.wantUnread)
+		}
+	}
+}
+
+func TestRecordChatMessageWithoutText(t *testing.T) {
+	db := newTestDB(t)
+	info, msg := textMessage("M1", 100, true, "secret")
+	if err := recordChatMessage(db, "user", info, msg, buildMessageContent(msg), false); err != nil {
+		t.Fatal(err)
+	}
+	edit := &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+		Type:          waE2E.ProtocolMessage_MESSAGE_EDIT.Enum(),
+		Key:           &waCommon.MessageKey{ID: proto.String("M1"), RemoteJID: proto.String(testChat.String()), FromMe: proto.Bool(true)},
+		EditedMessage: &waE2E.Message{Conversation: proto.String("still secret")},
+	}}
+	info, _ = textMessage("E1", 110, true, "")
+	if err := recordChatMessage(db, "user", info, edit, buildMessageContent(edit), false); err != nil {
+		t.Fatal(err)
+	}
+	if c := getTestChat(t, db, testChat.String()); c.LastMessageID != "M1" || c.LastMessageText != "" {
+		t.Errorf("got last message %s %q, want M1 without text", c.LastMessageID, c.LastMessageText)
+	}
+}
+
+func TestRecordChatMessageTimer(t *testing.T) {
+	db := newTestDB(t)
+	info, _ := textMessage("M1", 100, false, "")
+	msg := &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+		Text:        proto.String("hi"),
+		ContextInfo: &waE2E.ContextInfo{Expiration: proto.Uint32(86400)},
+	}}
+	if err := recordChatMessage(db, "user", info, msg, buildMessageContent(msg), true); err != nil {
+		t.Fatal(err)
+	}
+	if c := getTestChat(t, db, testChat.String()); c.EphemeralTimer != 86400 || c.UnreadCount != 1 {
+		t.Errorf("got timer %d with %d unread, want 86400 with 1 unread", c.EphemeralTimer, c.UnreadCount)
+	}
+
+	setting := &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+		Type:                waE2E.ProtocolMessage_EPHEMERAL_SETTING.Enum(),
+		EphemeralExpiration: proto.Uint32(0),
+	}}
+	info, _ = textMessage("S1", 110, false, "")
+	if err := recordChatMessage(db, "user", info, setting, buildMessageContent(setting), true); err != nil {
+		t.Fatal(err)
+	}
+	if c := getTestChat(t, db, testChat.String()); c.EphemeralTimer != 0 || c.LastMessageID != "M1" {
+		t.Errorf("got timer %d and last message %s, want 0 and M1", c.EphemeralTimer, c.LastMessageID)
+	}
+
+	// Status updates are not a conversation
+	info.Chat = types.StatusBroadcastJID
+	if err := recordChatMessage(db, "user", info, msg, buildMessageContent(msg), true); err != nil {
+		t.Fatal(err)
+	}
+	if chats, _ := listChats(db, "user"); len(chats) != 1 {
+		t.Errorf("got %d chats, want 1", len(chats))
+	}
+}
+
+func TestApplyChatAppState(t *testing.T) {
+	future := time.Now().Add(time.Hour).UnixMilli()
+	tests := []struct {
+		name  string
+		index string
+		act   *waSyncAction.SyncActionValue
+		check func(c chatSummary) bool
+	}{
+		{
+			name:  "mute until",
+			index: appstate.IndexMute,
+			act:   &waSyncAction.SyncActionValue{MuteAction: &waSyncAction.MuteAction{Muted: proto.Bool(true), MuteEndTimestamp: proto.Int64(future)}},
+			check: func(c chatSummary) bool { return c.Muted && c.MutedUntil == future/1000 },
+		},
+		{
+			name:  "mute forever",
+			index: appstate.IndexMute,
+			act:   &waSyncAction.SyncActionValue{MuteAction: &waSyncAction.MuteAction{Muted: proto.Bool(true), MuteEndTimestamp: proto.Int64(-1)}},
+			check: func(c chatSummary) bool { return c.Muted && c.MutedUntil == mutedForever },
+		},
+		{
+			name:  "pin",
+			index: appstate.IndexPin,
+			act:   &waSyncAction.SyncActionValue{Timestamp: proto.Int64(1717240000000), PinAction: &waSyncAction.PinAction{Pinned: proto.Bool(true)}},
+			check: func(c chatSummary) bool { return c.Pinned && c.PinnedAt == 1717240000 },
+		},
+		{
+			name:  "archive",
+			index: appstate.IndexArchive,
+			act:   &waSyncAction.SyncActionValue{ArchiveChatAction: &waSyncAction.ArchiveChatAction{Archived: proto.Bool(true)}},
+			check: func(c chatSummary) bool { return c.Archived },
+		},
+		{
+			name:  "mark read",
+			index: appstate.IndexMarkChatAsRead,
+			act:   &waSyncAction.SyncActionValue{MarkChatAsReadAction: &waSyncAction.MarkChatAsReadAction{Read: proto.Bool(true)}},
+			check: func(c chatSummary) bool { return c.UnreadCount == 0 },
+		},
+		{
+			name:  "mark unread keeps the count",
+			index: appstate.IndexMarkChatAsRead,
+			act:   &waSyncAction.SyncActionValue{MarkChatAsReadAction: &waSyncAction.MarkChatAsReadAction{Read: proto.Bool(false)}},
+			check: func(c chatSummary) bool { return c.UnreadCount == 3 },
+		},
+		{
+			name:  "contact name",
+			index: appstate.IndexContact,
+			act:   &waSyncAction.SyncActionValue{ContactAction: &waSyncAction.ContactAction{FullName: proto.String("Ana Pérez"), FirstName: proto.String("Ana")}},
+			check: func(c chatSummary) bool { return c.Name == "Ana Pérez" },
+		},
+		{
+			name:  "clear",
+			index: appstate.IndexClearChat,
+			act:   &waSyncAction.SyncActionValue{ClearChatAction: &waSyncAction.ClearChatAction{}},
+			check: func(c chatSummary) bool {
+				return c.LastMessageID == "" && c.LastMessageText == "" && c.UnreadCount == 0 && c.LastMessageAt == 102
+			},
+		},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		mycli := &MyClient{db: db, userID: "user"}
+		for i, id := range []string{"M1", "M2", "M3"} {
+			info, msg := textMessage(id, int64(100+i), false, "hi")
+			if err := recordChatMessage(db, "user", info, msg, buildMessageContent(msg), true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mycli.applyChatAppState(&events.AppState{Index: []string{tt.index, testChat.String()}, SyncActionValue: tt.act})
+		if c := getTestChat(t, db, testChat.String()); !tt.check(c) {
+			t.Errorf("%s: got chat %+v", tt.name, c)
+		}
+	}
+}
+
+func TestApplyChatAppStateDelete(t *testing.T) {
+	db := newTestDB(t)
+	mycli := &MyClient{db: db, userID: "user"}
+	info, msg := textMessage("M1", 100, false, "hi")
+	if err := recordChatMessage(db, "user", info, msg, buildMessageContent(msg), true); err != nil {
+		t.Fatal(err)
+	}
+	mycli.applyChatAppState(&events.AppState{
+		Index:           []string{appstate.IndexDeleteChat, testChat.String()},
+		SyncActionValue: &waSyncAction.SyncActionValue{DeleteChatAction: &waSyncAction.DeleteChatAction{}},
+	})
+	if chats, err := listChats(db, "user"); err != nil || len(chats) != 0 {
+		t.Errorf("got %d chats, %v, want none", len(chats), err)
+	}
+}
+
+func TestListChats(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().Unix()
+	rows := []struct {
+		jid        string
+		lastAt     int64
+		pinnedAt   int64
+		mutedUntil int64
+	}{
+		{jid: "1@s.whatsapp.net", lastAt: 300},
+		{jid: "2@s.whatsapp.net", lastAt: 100, pinnedAt: 10, mutedUntil: mutedForever},
+		{jid: "3@s.whatsapp.net", lastAt: 200, mutedUntil: now - 60},
+		{jid: "120363000000000000@g.us", lastAt: 400, mutedUntil: now + 60},
+		{jid: "4@s.whatsapp.net", lastAt: 100, pinnedAt: 20},
+	}
+	for _, r := range rows {
+		err := updateChat(db, "user", r.jid, "last_message_at=$3, pinned_at=$4, muted_until=$5", r.lastAt, r.pinnedAt, r.mutedUntil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO users (id, name, token) VALUES ($1, $2, $3)", "other", "Other", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateChat(db, "other", "5@s.whatsapp.net", "last_message_at=$3", 500); err != nil {
+		t.Fatal(err)
+	}
+
+	chats, err := listChats(db, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pinned chats first, most recently pinned on top, then by last message
+	want := []struct {
+		jid    string
+		group  bool
+		muted  bool
+		pinned bool
+	}{
+		{jid: "4@s.whatsapp.net", pinned: true},
+		{jid: "2@s.whatsapp.net", muted: true, pinned: true},
+		{jid: "120363000000000000@g.us", group: true, muted: true},
+		{jid: "1@s.whatsapp.net"},
+		{jid: "3@s.whatsapp.net"},
+	}
+	if len(chats) != len(want) {
+		t.Fatalf("got %d chats, want %d", len(chats), len(want))
+	}
+	for i, w := range want {
+		c := chats[i]
+		if c.JID != w.jid || c.IsGroup != w.group || c.Muted != w.muted || c.Pinned != w.pinned {
+			t.Errorf("chat %d: got %s group %t muted %t pinned %t, want %+v", i, c.JID, c.IsGroup, c.Muted, c.Pinned, w)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// command maps an action name to the REST handler that implements it
+type command struct {
+	method  string
+	path    string
+	handler func(s *server) http.HandlerFunc
+}
+
+// Actions that can be run over persistent connections (WebSocket, message queues).
+// They reuse the REST handlers, so payloads are the same as the documented request bodies.
+var commands = map[string]command{
+	"send.text":      {"POST", "/chat/send/text", (*server).SendMessage},
+	"send.image":     {"POST", "/chat/send/image", (*server).SendImage},
+	"send.audio":     {"POST", "/chat/send/audio", (*server).SendAudio},
+	"send.document":  {"POST", "/chat/send/document", (*server).SendDocument},
+	"send.video":     {"POST", "/chat/send/video", (*server).SendVideo},
+	"send.sticker":   {"POST", "/chat/send/sticker", (*server).SendSticker},
+	"send.location":  {"POST", "/chat/send/location", (*server).SendLocation},
+	"send.contact":   {"POST", "/chat/send/contact", (*server).SendContact},
+	"send.poll":      {"POST", "/chat/send/poll", (*server).SendPoll},
+	"send.edit":      {"POST", "/chat/send/edit", (*server).SendEditMessage},
+	"send.buttons":   {"POST", "/chat/send/buttons", (*server).SendButtons},
+	"send.list":      {"POST", "/chat/send/list", (*server).SendList},
+	"react":          {"POST", "/chat/react", (*server).React},
+	"delete":         {"POST", "/chat/delete", (*server).DeleteMessage},
+	"markread":       {"POST", "/chat/markread", (*server).MarkRead},
+	"chat.presence":  {"POST", "/chat/presence", (*server).ChatPresence},
+	"presence":       {"POST", "/user/presence", (*server).SendPresence},
+	"user.check":     {"POST", "/user/check", (*server).CheckUser},
+	"user.info":      {"POST", "/user/info", (*server).GetUser},
+	"session.status": {"GET", "/session/status", (*server).GetStatus},
+}
+
+// commandNames lists the supported actions, sorted for error messages
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandError builds the envelope of a command that could not be run
+func commandError(status int, msg string) (int, map[string]interface{}) {
+	return status, map[string]interface{}{
+		"code":    status,
+		"success": false,
+		"error":   msg,
+	}
+}
+
+// commandResponseWriter captures what a handler writes so it can be returned to the caller
+type commandResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *commandResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *commandResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *commandResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// sendContext is the context a send endpoint talks to WhatsApp with. Requests with a deadline, like the sends
+// of scheduled messages, are bound by it. Others are not cut short when the HTTP client goes away.
+func sendContext(r *http.Request) context.Context {
+	if _, ok := r.Context().Deadline(); ok {
+		return r.Context()
+	}
+	return context.Background()
+}
+
+// executeCommand runs an action for a user and returns the HTTP status and the response envelope
+// ({"code": ..., "success": ..., "data" or "error": ...}), exactly as the REST endpoint would answer
+func (s *server) executeCommand(ctx context.Context, userinfo Values, action string, payload json.RawMessage) (int, map[string]interface{}) {
+	cmd, ok := commands[action]
+	if !ok {
+		return commandError(http.StatusBadRequest, "unknown action, supported actions: "+strings.Join(commandNames(), ", "))
+	}
+	if len(payload) == 0 {
+		payload = json.RawMessage("{}")
+	}
+
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, "userinfo", userinfo), cmd.method, cmd.path, bytes.NewReader(payload))
+	if err != nil {
+		return commandError(http.StatusInternalServerError, err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var handler http.Handler = cmd.handler(s)
+	if isSendAction(action) {
+		handler = s.schedulable(action, handler)
+	}
+	rec := &commandResponseWriter{header: http.Header{}, status: http.StatusOK}
+	handler.ServeHTTP(rec, req)
+
+	envelope := map[string]interface{}{}
+	if err := json.Unmarshal(rec.body.Bytes(), &envelope); err != nil {
+		envelope = map[string]interface{}{
+			"code":    rec.status,
+			"success": rec.status < 400,
+			"data":    rec.body.String(),
+		}
+	}
+	return rec.status, envelope
+}
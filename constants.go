@@ -8,6 +8,8 @@ var supportedEventTypes = []string{
 	"Receipt",
 	"MediaRetry",
 	"ReadReceipt",
+	"PollVote",
+	"ScheduledMessage",
 
 	// Groups and Contacts
 	"GroupInfo",
@@ -41,6 +43,8 @@ var supportedEventTypes = []string{
 	"AppState",
 	"AppStateSyncComplete",
 	"HistorySync",
+	"HistorySyncProgress",
+	"HistorySyncComplete",
 	"OfflineSyncCompleted",
 	"OfflineSyncPreview",
 
@@ -70,6 +74,10 @@ var supportedEventTypes = []string{
 	// Facebook/Meta Bridge
 	"FBMessage",
 
+	// Webhook health
+	"WebhookUnhealthy",
+	"WebhookRecovered",
+
 	// Special - receives all events
 	"All",
 }
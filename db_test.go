@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestDB returns a migrated SQLite database in a temporary directory, with a user "user" of token "token"
+func newTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := initializeSQLite(DatabaseConfig{Type: "sqlite", Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := initializeSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO users (id, name, token) VALUES ($1, $2, $3)", "user", "Test", "token"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamEvent is an event as delivered to live subscribers such as the SSE stream
+type StreamEvent struct {
+	ID   uint64
+	Type string
+	Data []byte
+}
+
+// userEventStream keeps the recent events of one user and the channels listening to them
+type userEventStream struct {
+	nextID      uint64
+	buffer      []StreamEvent
+	subscribers map[chan StreamEvent]struct{}
+}
+
+// EventBroker fans out session events to live subscribers and keeps a short
+// per-user history so a subscriber that reconnects can resume where it stopped
+type EventBroker struct {
+	mu         sync.Mutex
+	users      map[string]*userEventStream
+	bufferSize int
+}
+
+// Global event broker instance, created in main once the environment is loaded
+var eventBroker *EventBroker
+
+func NewEventBroker(bufferSize int) *EventBroker {
+	return &EventBroker{
+		users:      make(map[string]*userEventStream),
+		bufferSize: bufferSize,
+	}
+}
+
+func (b *EventBroker) stream(userID string) *userEventStream {
+	s, ok := b.users[userID]
+	if !ok {
+		// IDs start from the current time so they keep growing across restarts
+		s = &userEventStream{
+			nextID:      uint64(time.Now().UnixMilli()),
+			subscribers: make(map[chan StreamEvent]struct{}),
+		}
+		b.users[userID] = s
+	}
+	return s
+}
+
+// Publish records an event for a user and hands it to every subscriber.
+// Subscribers that cannot keep up are disconnected, they can resume from the buffer.
+func (b *EventBroker) Publish(userID, eventType string, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.stream(userID)
+	s.nextID++
+	evt := StreamEvent{ID: s.nextID, Type: eventType, Data: data}
+
+	if b.bufferSize > 0 {
+		if len(s.buffer) >= b.bufferSize {
+			s.buffer = append(s.buffer[:0], s.buffer[len(s.buffer)-b.bufferSize+1:]...)
+		}
+		s.buffer = append(s.buffer, evt)
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- evt:
+		default:
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the buffered events newer than lastID and a channel for the following ones.
+// The channel is closed when the subscriber falls behind; cancel must be called when done.
+func (b *EventBroker) Subscribe(userID string, lastID uint64) ([]StreamEvent, <-chan StreamEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.stream(userID)
+	backlog := []StreamEvent{}
+	if lastID > 0 {
+		for _, evt := range s.buffer {
+			if evt.ID > lastID {
+				backlog = append(backlog, evt)
+			}
+		}
+	}
+
+	ch := make(chan StreamEvent, 64)
+	s.subscribers[ch] = struct{}{}
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, cancel
+}
+
+// Forget drops the buffered events of a user, used when the user is deleted
+func (b *EventBroker) Forget(userID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.users[userID]; ok {
+		// Channels are removed as they are closed, so the cancel of their subscribers does nothing
+		for ch := range s.subscribers {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+		delete(b.users, userID)
+	}
+}
+
+// parseEventFilter validates a list of event types for a live subscriber.
+// The result is empty, meaning every event, when the list is empty or contains "All".
+func parseEventFilter(list []string) (map[string]bool, error) {
+	filter := map[string]bool{}
+	for _, e := range list {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !Find(supportedEventTypes, e) {
+			return nil, fmt.Errorf("unsupported event type %q", e)
+		}
+		filter[e] = true
+	}
+	if filter["All"] {
+		return map[string]bool{}, nil
+	}
+	return filter, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestEventBrokerForgetThenCancel(t *testing.T) {
+	b := NewEventBroker(10)
+	_, events, cancel := b.Subscribe("user", 0)
+
+	b.Forget("user")
+	if _, ok := <-events; ok {
+		t.Fatal("subscriber channel still open after Forget")
+	}
+	// Closing the channel a second time would panic
+	cancel()
+}
+
+func TestEventBrokerResume(t *testing.T) {
+	b := NewEventBroker(2)
+	for i := 0; i < 3; i++ {
+		b.Publish("user", "Message", []byte("{}"))
+	}
+	backlog, _, cancel := b.Subscribe("user", 1)
+	defer cancel()
+	if len(backlog) != 2 {
+		t.Fatalf("got %d buffered events, want the last 2", len(backlog))
+	}
+
+	first := backlog[0].ID
+	backlog, _, cancel2 := b.Subscribe("user", first)
+	defer cancel2()
+	if len(backlog) != 1 || backlog[0].ID <= first {
+		t.Fatalf("resuming after %d returned %+v", first, backlog)
+	}
+}
+
+func TestParseEventFilter(t *testing.T) {
+	tests := []struct {
+		list    []string
+		want    int
+		wantErr bool
+	}{
+		{nil, 0, false},
+		{[]string{"Message", " Receipt "}, 2, false},
+		{[]string{"Message", "All"}, 0, false},
+		{[]string{"NotAnEvent"}, 0, true},
+	}
+	for _, tt := range tests {
+		filter, err := parseEventFilter(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEventFilter(%v) error = %v", tt.list, err)
+			continue
+		}
+		if err == nil && len(filter) != tt.want {
+			t.Errorf("parseEventFilter(%v) = %v, want %d types", tt.list, filter, tt.want)
+		}
+	}
+}
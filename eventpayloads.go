@@ -0,0 +1,332 @@
+package main
+
+import (
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// eventDetails returns the webhook type of a whatsmeow event without a dedicated branch in myEventHandler,
+// and a summary of it with stable field names that is sent as "details" next to the raw event.
+// ok is false for events that are not delivered.
+func eventDetails(rawEvt interface{}) (eventType string, details map[string]interface{}, ok bool) {
+	switch evt := rawEvt.(type) {
+	case *events.UndecryptableMessage:
+		details = messageInfoDetails(evt.Info)
+		details["isUnavailable"] = evt.IsUnavailable
+		details["unavailableType"] = string(evt.UnavailableType)
+		details["decryptFailMode"] = string(evt.DecryptFailMode)
+		return "UndecryptableMessage", details, true
+	case *events.MediaRetry:
+		details = map[string]interface{}{
+			"messageId": evt.MessageID,
+			"chat":      evt.ChatID.String(),
+			"sender":    jidString(evt.SenderID),
+			"isFromMe":  evt.FromMe,
+			"timestamp": unixTime(evt.Timestamp),
+			"success":   evt.Error == nil,
+		}
+		if evt.Error != nil {
+			details["errorCode"] = evt.Error.Code
+		}
+		return "MediaRetry", details, true
+	case *events.GroupInfo:
+		return "GroupInfo", groupInfoDetails(evt), true
+	case *events.JoinedGroup:
+		participants := make([]string, 0, len(evt.Participants))
+		for _, p := range evt.Participants {
+			participants = append(participants, p.JID.String())
+		}
+		details = map[string]interface{}{
+			"jid":          evt.JID.String(),
+			"name":         evt.Name,
+			"topic":        evt.Topic,
+			"owner":        jidString(evt.OwnerJID),
+			"reason":       evt.Reason,
+			"type":         evt.Type,
+			"participants": participants,
+		}
+		if evt.Sender != nil {
+			details["sender"] = evt.Sender.String()
+		}
+		return "JoinedGroup", details, true
+	case *events.Picture:
+		return "Picture", map[string]interface{}{
+			"jid":       evt.JID.String(),
+			"author":    jidString(evt.Author),
+			"timestamp": unixTime(evt.Timestamp),
+			"removed":   evt.Remove,
+			"pictureId": evt.PictureID,
+		}, true
+	case *events.Blocklist:
+		changes := make([]map[string]interface{}, 0, len(evt.Changes))
+		for _, change := range evt.Changes {
+			changes = append(changes, blocklistChangeDetails(change))
+		}
+		return "Blocklist", map[string]interface{}{
+			"action":  string(evt.Action),
+			"changes": changes,
+		}, true
+	case *events.KeepAliveTimeout:
+		return "KeepAliveTimeout", map[string]interface{}{
+			"errorCount":  evt.ErrorCount,
+			"lastSuccess": unixTime(evt.LastSuccess),
+		}, true
+	case *events.KeepAliveRestored:
+		return "KeepAliveRestored", map[string]interface{}{}, true
+	case *events.ClientOutdated:
+		return "ClientOutdated", map[string]interface{}{}, true
+	case *events.TemporaryBan:
+		return "TemporaryBan", map[string]interface{}{
+			"code":      int(evt.Code),
+			"reason":    evt.Code.String(),
+			"expiresIn": int64(evt.Expire.Seconds()),
+		}, true
+	case *events.StreamError:
+		return "StreamError", map[string]interface{}{"code": evt.Code}, true
+	case *events.StreamReplaced:
+		return "StreamReplaced", map[string]interface{}{}, true
+	case *events.PairSuccess:
+		return "PairSuccess", map[string]interface{}{
+			"jid":          jidString(evt.ID),
+			"lid":          jidString(evt.LID),
+			"businessName": evt.BusinessName,
+			"platform":     evt.Platform,
+		}, true
+	case *events.PairError:
+		return "PairError", map[string]interface{}{
+			"jid":          jidString(evt.ID),
+			"lid":          jidString(evt.LID),
+			"businessName": evt.BusinessName,
+			"platform":     evt.Platform,
+			"error":        errorString(evt.Error),
+		}, true
+	case *events.QRScannedWithoutMultidevice:
+		return "QRScannedWithoutMultidevice", map[string]interface{}{}, true
+	case *events.PrivacySettings:
+		return "PrivacySettings", privacySettingsDetails(evt), true
+	case *events.PushNameSetting:
+		return "PushNameSetting", map[string]interface{}{
+			"pushName":  evt.Action.GetName(),
+			"timestamp": unixTime(evt.Timestamp),
+		}, true
+	case *events.UserAbout:
+		return "UserAbout", map[string]interface{}{
+			"jid":       evt.JID.String(),
+			"status":    evt.Status,
+			"timestamp": unixTime(evt.Timestamp),
+		}, true
+	case *events.AppState:
+		details = map[string]interface{}{"index": evt.Index}
+		if evt.SyncActionValue != nil {
+			details["timestamp"] = evt.SyncActionValue.GetTimestamp() / 1000
+		}
+		return "AppState", details, true
+	case *events.AppStateSyncComplete:
+		return "AppStateSyncComplete", map[string]interface{}{"name": string(evt.Name)}, true
+	case *events.OfflineSyncPreview:
+		return "OfflineSyncPreview", map[string]interface{}{
+			"total":          evt.Total,
+			"appDataChanges": evt.AppDataChanges,
+			"messages":       evt.Messages,
+			"notifications":  evt.Notifications,
+			"receipts":       evt.Receipts,
+		}, true
+	case *events.OfflineSyncCompleted:
+		return "OfflineSyncCompleted", map[string]interface{}{"count": evt.Count}, true
+	case *events.IdentityChange:
+		return "IdentityChange", map[string]interface{}{
+			"jid":       evt.JID.String(),
+			"timestamp": unixTime(evt.Timestamp),
+			"implicit":  evt.Implicit,
+		}, true
+	case *events.CATRefreshError:
+		return "CATRefreshError", map[string]interface{}{"error": errorString(evt.Error)}, true
+	case *events.NewsletterJoin:
+		details = map[string]interface{}{
+			"id":          evt.ID.String(),
+			"name":        evt.ThreadMeta.Name.Text,
+			"description": evt.ThreadMeta.Description.Text,
+			"subscribers": evt.ThreadMeta.SubscriberCount,
+			"inviteCode":  evt.ThreadMeta.InviteCode,
+		}
+		if evt.ViewerMeta != nil {
+			details["role"] = string(evt.ViewerMeta.Role)
+			details["mute"] = string(evt.ViewerMeta.Mute)
+		}
+		return "NewsletterJoin", details, true
+	case *events.NewsletterLeave:
+		return "NewsletterLeave", map[string]interface{}{
+			"id":   evt.ID.String(),
+			"role": string(evt.Role),
+		}, true
+	case *events.NewsletterMuteChange:
+		return "NewsletterMuteChange", map[string]interface{}{
+			"id":   evt.ID.String(),
+			"mute": string(evt.Mute),
+		}, true
+	case *events.NewsletterLiveUpdate:
+		messages := make([]map[string]interface{}, 0, len(evt.Messages))
+		for _, msg := range evt.Messages {
+			messages = append(messages, map[string]interface{}{
+				"serverId":       int(msg.MessageServerID),
+				"messageId":      msg.MessageID,
+				"type":           msg.Type,
+				"timestamp":      unixTime(msg.Timestamp),
+				"views":          msg.ViewsCount,
+				"reactionCounts": msg.ReactionCounts,
+			})
+		}
+		return "NewsletterLiveUpdate", map[string]interface{}{
+			"jid":       evt.JID.String(),
+			"timestamp": unixTime(evt.Time),
+			"messages":  messages,
+		}, true
+	case *events.FBMessage:
+		return "FBMessage", messageInfoDetails(evt.Info), true
+	}
+	return "", nil, false
+}
+
+// setEventDetails fills in the type and details of the webhook payload, reporting whether the event is delivered
+func setEventDetails(postmap map[string]interface{}, rawEvt interface{}) bool {
+	eventType, details, ok := eventDetails(rawEvt)
+	if !ok {
+		return false
+	}
+	postmap["type"] = eventType
+	postmap["details"] = details
+	return true
+}
+
+func messageInfoDetails(info types.MessageInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        info.ID,
+		"chat":      info.Chat.String(),
+		"sender":    info.Sender.String(),
+		"isFromMe":  info.IsFromMe,
+		"isGroup":   info.IsGroup,
+		"pushName":  info.PushName,
+		"timestamp": unixTime(info.Timestamp),
+	}
+}
+
+// groupInfoDetails only lists what changed, plus the group and who changed it
+func groupInfoDetails(evt *events.GroupInfo) map[string]interface{} {
+	details := map[string]interface{}{
+		"jid":       evt.JID.String(),
+		"timestamp": unixTime(evt.Timestamp),
+	}
+	if evt.Sender != nil {
+		details["sender"] = evt.Sender.String()
+	}
+	if evt.Name != nil {
+		details["name"] = evt.Name.Name
+	}
+	if evt.Topic != nil {
+		details["topic"] = evt.Topic.Topic
+	}
+	if evt.Locked != nil {
+		details["locked"] = evt.Locked.IsLocked
+	}
+	if evt.Announce != nil {
+		details["announce"] = evt.Announce.IsAnnounce
+	}
+	if evt.Ephemeral != nil {
+		details["disappearingTimer"] = evt.Ephemeral.DisappearingTimer
+	}
+	if evt.MembershipApprovalMode != nil {
+		details["joinApprovalRequired"] = evt.MembershipApprovalMode.IsJoinApprovalRequired
+	}
+	if evt.Delete != nil {
+		details["deleted"] = evt.Delete.Deleted
+	}
+	if evt.NewInviteLink != nil {
+		details["inviteLink"] = *evt.NewInviteLink
+	}
+	if evt.JoinReason != "" {
+		details["joinReason"] = evt.JoinReason
+	}
+	for key, jids := range map[string][]types.JID{
+		"join":    evt.Join,
+		"leave":   evt.Leave,
+		"promote": evt.Promote,
+		"demote":  evt.Demote,
+	} {
+		if len(jids) > 0 {
+			details[key] = jidStrings(jids)
+		}
+	}
+	return details
+}
+
+func blocklistChangeDetails(change events.BlocklistChange) map[string]interface{} {
+	return map[string]interface{}{
+		"jid":    change.JID.String(),
+		"action": string(change.Action),
+	}
+}
+
+func privacySettingsDetails(evt *events.PrivacySettings) map[string]interface{} {
+	// Listed in a fixed order, so the same change always produces the same payload
+	changed := []string{}
+	for _, setting := range []struct {
+		name    string
+		changed bool
+	}{
+		{"groupAdd", evt.GroupAddChanged},
+		{"lastSeen", evt.LastSeenChanged},
+		{"status", evt.StatusChanged},
+		{"profile", evt.ProfileChanged},
+		{"readReceipts", evt.ReadReceiptsChanged},
+		{"online", evt.OnlineChanged},
+		{"callAdd", evt.CallAddChanged},
+	} {
+		if setting.changed {
+			changed = append(changed, setting.name)
+		}
+	}
+	return map[string]interface{}{
+		"settings": map[string]interface{}{
+			"groupAdd":     string(evt.NewSettings.GroupAdd),
+			"lastSeen":     string(evt.NewSettings.LastSeen),
+			"status":       string(evt.NewSettings.Status),
+			"profile":      string(evt.NewSettings.Profile),
+			"readReceipts": string(evt.NewSettings.ReadReceipts),
+			"online":       string(evt.NewSettings.Online),
+			"callAdd":      string(evt.NewSettings.CallAdd),
+		},
+		"changed": changed,
+	}
+}
+
+// jidString leaves absent JIDs empty instead of writing the zero JID
+func jidString(jid types.JID) string {
+	if jid.IsEmpty() {
+		return ""
+	}
+	return jid.String()
+}
+
+func jidStrings(jids []types.JID) []string {
+	out := make([]string, 0, len(jids))
+	for _, jid := range jids {
+		out = append(out, jid.String())
+	}
+	return out
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestPrivacySettingsDetails(t *testing.T) {
+	evt := &events.PrivacySettings{
+		NewSettings:         types.PrivacySettings{LastSeen: types.PrivacySettingContacts, CallAdd: types.PrivacySettingKnown},
+		CallAddChanged:      true,
+		GroupAddChanged:     true,
+		ReadReceiptsChanged: true,
+		LastSeenChanged:     true,
+	}
+	want := []string{"groupAdd", "lastSeen", "readReceipts", "callAdd"}
+	// Run it a few times, map iteration would shuffle the names
+	for i := 0; i < 10; i++ {
+		details := privacySettingsDetails(evt)
+		if got := details["changed"]; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got changed %v, want %v", got, want)
+		}
+		settings := details["settings"].(map[string]interface{})
+		if settings["lastSeen"] != "contacts" || settings["callAdd"] != "known" || settings["online"] != "" {
+			t.Errorf("got settings %v", settings)
+		}
+	}
+}
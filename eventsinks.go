@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// SinkEvent is a session event on its way out of wuzapi, already checked against the user subscriptions
+type SinkEvent struct {
+	UserID   string
+	Token    string
+	Type     string
+	Data     []byte // JSON, as posted to webhooks
+	FilePath string // media saved for the event, if any
+	Context  webhookEventContext
+}
+
+// EventSink is a destination for session events. Send is called from the event handler,
+// sinks talking to remote services should queue the event and deliver it in the background.
+type EventSink interface {
+	Name() string
+	Send(evt SinkEvent) error
+}
+
+const (
+	sinkScopeAll  = "all"  // receives the events of every user
+	sinkScopeUser = "user" // receives the events of the users that enabled it
+)
+
+type registeredSink struct {
+	sink  EventSink
+	scope string
+}
+
+// Sinks are registered once at startup and read without locking afterwards
+var eventSinks []registeredSink
+
+func RegisterEventSink(sink EventSink, scope string) {
+	eventSinks = append(eventSinks, registeredSink{sink: sink, scope: scope})
+	log.Info().Str("sink", sink.Name()).Str("scope", scope).Msg("Event sink registered")
+}
+
+// InitEventSinks registers the sinks configured for this deployment
+func InitEventSinks(db *sqlx.DB) {
+	RegisterEventSink(&userWebhookSink{db: db}, sinkScopeAll)
+	if *globalWebhook != "" {
+		RegisterEventSink(&globalWebhookSink{}, sinkScopeAll)
+	}
+	if rabbitEnabled {
+		RegisterEventSink(&rabbitSink{}, sinkScopeAll)
+	}
+	if url := os.Getenv("NATS_URL"); url != "" {
+		sink, err := NewNATSSink(url)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not set up NATS event sink")
+		} else {
+			RegisterEventSink(sink, sinkScopeFromEnv("NATS_SCOPE"))
+		}
+	}
+	if url := os.Getenv("REDIS_URL"); url != "" {
+		sink, err := NewRedisSink(url)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not set up Redis event sink")
+		} else {
+			RegisterEventSink(sink, sinkScopeFromEnv("REDIS_SCOPE"))
+		}
+	}
+}
+
+func sinkScopeFromEnv(key string) string {
+	if strings.EqualFold(os.Getenv(key), sinkScopeUser) {
+		return sinkScopeUser
+	}
+	return sinkScopeAll
+}
+
+// userSelectableSinks lists the sinks users can turn on for themselves
+func userSelectableSinks() []string {
+	names := []string{}
+	for _, rs := range eventSinks {
+		if rs.scope == sinkScopeUser {
+			names = append(names, rs.sink.Name())
+		}
+	}
+	return names
+}
+
+func getUserEventSinks(db *sqlx.DB, userID string) ([]string, error) {
+	var raw string
+	if err := db.Get(&raw, "SELECT event_sinks FROM users WHERE id=$1", userID); err != nil {
+		return nil, err
+	}
+	sinks := []string{}
+	if raw == "" {
+		return sinks, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &sinks); err != nil {
+		return nil, err
+	}
+	return sinks, nil
+}
+
+// dispatchEvent hands an event to every sink that applies to the user
+func dispatchEvent(db *sqlx.DB, evt SinkEvent) {
+	var enabled map[string]bool
+	for _, rs := range eventSinks {
+		if rs.scope == sinkScopeUser {
+			// Only looked up when a user scoped sink exists
+			if enabled == nil {
+				enabled = map[string]bool{}
+				names, err := getUserEventSinks(db, evt.UserID)
+				if err != nil {
+					log.Error().Err(err).Str("userID", evt.UserID).Msg("Could not load user event sinks")
+				}
+				for _, name := range names {
+					enabled[name] = true
+				}
+			}
+			if !enabled[rs.sink.Name()] {
+				continue
+			}
+		}
+		if err := rs.sink.Send(evt); err != nil {
+			log.Error().Err(err).Str("sink", rs.sink.Name()).Str("userID", evt.UserID).Str("eventType", evt.Type).Msg("Failed to send event to sink")
+		}
+	}
+}
+
+// userWebhookSink delivers events to the webhooks configured by the user
+type userWebhookSink struct {
+	db *sqlx.DB
+}
+
+func (s *userWebhookSink) Name() string { return "webhook" }
+
+func (s *userWebhookSink) Send(evt SinkEvent) error {
+	dispatchUserWebhooks(s.db, evt.UserID, evt.Token, evt.Type, evt.Data, evt.FilePath, evt.Context)
+	return nil
+}
+
+// globalWebhookSink delivers events of every user to WUZAPI_GLOBAL_WEBHOOK
+type globalWebhookSink struct{}
+
+func (s *globalWebhookSink) Name() string { return "global_webhook" }
+
+func (s *globalWebhookSink) Send(evt SinkEvent) error {
+	sendToGlobalWebHook(evt.Data, evt.Token, evt.UserID, evt.Type)
+	return nil
+}
+
+// rabbitSink publishes events to RabbitMQ, see rabbitmq.go
+type rabbitSink struct{}
+
+func (s *rabbitSink) Name() string { return "rabbitmq" }
+
+func (s *rabbitSink) Send(evt SinkEvent) error {
+	return PublishToRabbit(evt.UserID, evt.Type, evt.Data)
+}
+
+// asyncSink runs publish in a background worker so slow brokers do not hold up event handling.
+// Events are published in order and retried a few times before being dropped.
+type asyncSink struct {
+	name    string
+	queue   chan SinkEvent
+	publish func(evt SinkEvent) error
+}
+
+const asyncSinkAttempts = 3
+
+func newAsyncSink(name string, publish func(evt SinkEvent) error) *asyncSink {
+	s := &asyncSink{
+		name:    name,
+		queue:   make(chan SinkEvent, getEnvInt("EVENT_SINK_BUFFER", 10000)),
+		publish: publish,
+	}
+	go s.run()
+	return s
+}
+
+func (s *asyncSink) Name() string { return s.name }
+
+func (s *asyncSink) Send(evt SinkEvent) error {
+	select {
+	case s.queue <- evt:
+		return nil
+	default:
+		return errors.New("sink buffer is full, event dropped")
+	}
+}
+
+func (s *asyncSink) run() {
+	for evt := range s.queue {
+		var err error
+		for attempt := 1; attempt <= asyncSinkAttempts; attempt++ {
+			if err = s.publish(evt); err == nil {
+				break
+			}
+			if attempt < asyncSinkAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err != nil {
+			log.Error().Err(err).Str("sink", s.name).Str("userID", evt.UserID).Str("eventType", evt.Type).Msg("Dropping event after failed attempts")
+		}
+	}
+}
+
+// sinkSubjectToken makes a value usable as one token of a NATS subject or RabbitMQ routing key,
+// where dots separate tokens and *, > and # are wildcards
+func sinkSubjectToken(v string) string {
+	return strings.NewReplacer(".", "_", " ", "", "*", "_", ">", "_", "#", "_").Replace(v)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// recordingSink keeps the events sent to it
+type recordingSink struct {
+	name   string
+	err    error
+	events []SinkEvent
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) Send(evt SinkEvent) error {
+	s.events = append(s.events, evt)
+	return s.err
+}
+
+// withEventSinks replaces the registered sinks for the duration of a test
+func withEventSinks(t *testing.T, sinks ...registeredSink) {
+	t.Helper()
+	saved := eventSinks
+	eventSinks = sinks
+	t.Cleanup(func() { eventSinks = saved })
+}
+
+func TestDispatchEventScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string // users.event_sinks
+		want    map[string]int
+	}{
+		{"no user sinks", "", map[string]int{"all": 1, "nats": 0, "redis": 0}},
+		{"one user sink", `["nats"]`, map[string]int{"all": 1, "nats": 1, "redis": 0}},
+		{"both user sinks", `["nats","redis"]`, map[string]int{"all": 1, "nats": 1, "redis": 1}},
+		{"unknown sink", `["kafka"]`, map[string]int{"all": 1, "nats": 0, "redis": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if _, err := db.Exec("UPDATE users SET event_sinks=$1 WHERE id=$2", tt.enabled, "user"); err != nil {
+				t.Fatal(err)
+			}
+			sinks := map[string]*recordingSink{"all": {name: "all"}, "nats": {name: "nats"}, "redis": {name: "redis"}}
+			withEventSinks(t,
+				registeredSink{sink: sinks["all"], scope: sinkScopeAll},
+				registeredSink{sink: sinks["nats"], scope: sinkScopeUser},
+				registeredSink{sink: sinks["redis"], scope: sinkScopeUser},
+			)
+
+			dispatchEvent(db, SinkEvent{UserID: "user", Type: "Message", Data: []byte("{}")})
+			for name, want := range tt.want {
+				if got := len(sinks[name].events); got != want {
+					t.Errorf("sink %s got %d events, want %d", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatchEventFanOut(t *testing.T) {
+	db := newTestDB(t)
+	failing := &recordingSink{name: "failing", err: errors.New("unreachable")}
+	after := &recordingSink{name: "after"}
+	withEventSinks(t,
+		registeredSink{sink: failing, scope: sinkScopeAll},
+		registeredSink{sink: after, scope: sinkScopeAll},
+	)
+
+	evt := SinkEvent{UserID: "user", Token: "token", Type: "Receipt", Data: []byte(`{"type":"Receipt"}`)}
+	dispatchEvent(db, evt)
+	// A failing sink does not keep the event from the following ones
+	if len(failing.events) != 1 || len(after.events) != 1 {
+		t.Fatalf("got %d and %d events, want 1 each", len(failing.events), len(after.events))
+	}
+	if got := after.events[0]; got.UserID != evt.UserID || got.Type != evt.Type || string(got.Data) != string(evt.Data) {
+		t.Errorf("sink got %+v, want %+v", got, evt)
+	}
+}
+
+func TestDispatchEventUnknownUser(t *testing.T) {
+	db := newTestDB(t)
+	global := &recordingSink{name: "global"}
+	user := &recordingSink{name: "user"}
+	withEventSinks(t,
+		registeredSink{sink: global, scope: sinkScopeAll},
+		registeredSink{sink: user, scope: sinkScopeUser},
+	)
+
+	// The user sinks cannot be loaded, global sinks still get the event
+	dispatchEvent(db, SinkEvent{UserID: "missing", Type: "Message"})
+	if len(global.events) != 1 || len(user.events) != 0 {
+		t.Fatalf("got %d global and %d user events, want 1 and 0", len(global.events), len(user.events))
+	}
+}
+
+func TestSinkScopeFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", sinkScopeAll},
+		{"all", sinkScopeAll},
+		{"user", sinkScopeUser},
+		{"USER", sinkScopeUser},
+		{"other", sinkScopeAll},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_SINK_SCOPE", tt.value)
+		if got := sinkScopeFromEnv("TEST_SINK_SCOPE"); got != tt.want {
+			t.Errorf("sinkScopeFromEnv(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSinkSubjectToken(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Message", "Message"},
+		{"Chat Presence", "ChatPresence"},
+		{"a.b", "a_b"},
+		{"*>#", "___"},
+	}
+	for _, tt := range tests {
+		if got := sinkSubjectToken(tt.in); got != tt.want {
+			t.Errorf("sinkSubjectToken(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 	"github.com/nfnt/resize"
 	"github.com/patrickmn/go-cache"
 	"github.com/rs/zerolog/log"
@@ -55,62 +56,84 @@ func (s *server) authadmin(next http.Handler) http.Handler {
 func (s *server) authalice(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var ctx context.Context
-		txtid := ""
-		name := ""
-		jid := ""
-		proxy_url := ""
-		qrcode := ""
-
 		// Get token from headers or uri parameters
 		token := r.Header.Get("token")
 		if token == "" {
 			token = strings.Join(r.URL.Query()["token"], "")
 		}
 
-		myuserinfo, found := userinfocache.Get(token)
-		if !found {
-			log.Info().Msg("Looking for user information in DB")
-			// Checks DB from matching user and store user values in context
-			rows, err := s.db.Query("SELECT id,name,jid,proxy_url,qrcode FROM users WHERE token=$1 LIMIT 1", token)
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			defer rows.Close()
-			for rows.Next() {
-				err = rows.Scan(&txtid, &name, &jid, &proxy_url, &qrcode)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, err)
-					return
-				}
-				v := Values{map[string]string{
-					"Id":     txtid,
-					"Name":   name,
-					"Jid":    jid,
-					"Token":  token,
-					"Proxy":  proxy_url,
-					"Qrcode": qrcode,
-				}}
-
-				userinfocache.Set(token, v, cache.NoExpiration)
-				log.Info().Str("name", name).Msg("User info name from DB")
-				ctx = context.WithValue(r.Context(), "userinfo", v)
-			}
-		} else {
-			ctx = context.WithValue(r.Context(), "userinfo", myuserinfo)
-			log.Info().Str("name", myuserinfo.(Values).Get("name")).Msg("User info name from Cache")
-			txtid = myuserinfo.(Values).Get("Id")
+		userinfo, found, err := s.lookupUserInfo(token)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
 		}
-
-		if txtid == "" {
+		if !found {
 			s.Respond(w, r, http.StatusUnauthorized, errors.New("unauthorized"))
 			return
 		}
+		ctx := context.WithValue(r.Context(), "userinfo", userinfo)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// lookupUserInfo returns the user values for a token, from the cache or the database
+func (s *server) lookupUserInfo(token string) (Values, bool, error) {
+	myuserinfo, found := userinfocache.Get(token)
+	if found {
+		log.Info().Str("name", myuserinfo.(Values).Get("name")).Msg("User info name from Cache")
+		return myuserinfo.(Values), myuserinfo.(Values).Get("Id") != "", nil
+	}
+
+	txtid := ""
+	name := ""
+	jid := ""
+	proxy_url := ""
+	qrcode := ""
+
+	log.Info().Msg("Looking for user information in DB")
+	// Checks DB from matching user and store user values in context
+	rows, err := s.db.Query("SELECT id,name,jid,proxy_url,qrcode FROM users WHERE token=$1 LIMIT 1", token)
+	if err != nil {
+		return Values{}, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = rows.Scan(&txtid, &name, &jid, &proxy_url, &qrcode)
+		if err != nil {
+			return Values{}, false, err
+		}
+		v := Values{map[string]string{
+			"Id":     txtid,
+			"Name":   name,
+			"Jid":    jid,
+			"Token":  token,
+			"Proxy":  proxy_url,
+			"Qrcode": qrcode,
+		}}
+
+		userinfocache.Set(token, v, cache.NoExpiration)
+		log.Info().Str("name", name).Msg("User info name from DB")
+		return v, txtid != "", nil
+	}
+	return Values{}, false, rows.Err()
+}
+
+// lookupUserInfoByID returns the user values the handlers expect for a user id, for work done on behalf of a user
+func (s *server) lookupUserInfoByID(userID string) (Values, error) {
+	var token string
+	if err := s.db.Get(&token, "SELECT token FROM users WHERE id=$1", userID); err != nil {
+		return Values{}, err
+	}
+	userinfo, found, err := s.lookupUserInfo(token)
+	if err != nil {
+		return Values{}, err
+	}
+	if !found {
+		return Values{}, errors.New("user not found")
+	}
+	return userinfo, nil
+}
+
 // Connects to Whatsapp Servers
 func (s *server) Connect() http.HandlerFunc {
 
@@ -239,7 +262,24 @@ func (s *server) ListWebhooks() http.HandlerFunc {
 			if h.Events != "" {
 				events = strings.Split(h.Events, ",")
 			}
-			response = append(response, map[string]interface{}{"id": h.ID, "url": h.URL, "events": events})
+			response = append(response, map[string]interface{}{
+				"id":      h.ID,
+				"url":     h.URL,
+				"events":  events,
+				"secret":  maskSecret(h.Secret),
+				"format":  h.Format,
+				"headers": maskWebhookHeaders(h.Headers),
+				"filters": decodeWebhookFilters(h.Filters),
+				"ordered": h.Ordered,
+				"health": map[string]interface{}{
+					"status":               h.Health,
+					"consecutive_failures": h.ConsecutiveFailures,
+					"last_error":           h.LastError,
+					"last_error_at":        h.LastErrorAt,
+					"last_success_at":      h.LastSuccessAt,
+					"paused_until":         h.PausedUntil,
+				},
+			})
 		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -253,8 +293,13 @@ func (s *server) ListWebhooks() http.HandlerFunc {
 // CreateWebhook creates a new webhook for the user
 func (s *server) CreateWebhook() http.HandlerFunc {
 	type webhookStruct struct {
-		URL    string   `json:"url"`
-		Events []string `json:"events"`
+		URL     string            `json:"url"`
+		Events  []string          `json:"events"`
+		Secret  string            `json:"secret"`
+		Format  string            `json:"format"`
+		Headers map[string]string `json:"headers"`
+		Filters WebhookFilters    `json:"filters"`
+		Ordered bool              `json:"ordered"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
@@ -272,20 +317,48 @@ func (s *server) CreateWebhook() http.HandlerFunc {
 			}
 			validEvents = append(validEvents, e)
 		}
+		if err := validateWebhookSettings(t.Format, t.Headers); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := t.Filters.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		headers, err := encodeWebhookHeaders(t.Headers)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not encode headers"))
+			return
+		}
+		filters, err := encodeWebhookFilters(t.Filters)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not encode filters"))
+			return
+		}
 		id, err := GenerateRandomID()
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 		eventstring := strings.Join(validEvents, ",")
-		_, err = s.db.Exec("INSERT INTO user_webhooks (id, user_id, url, events) VALUES ($1,$2,$3,$4)", id, txtid, t.URL, eventstring)
+		_, err = s.db.Exec("INSERT INTO user_webhooks (id, user_id, url, events, secret, format, headers, filters, ordered) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)",
+			id, txtid, t.URL, eventstring, t.Secret, t.Format, headers, filters, t.Ordered)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not create webhook"))
 			return
 		}
 		union, _ := getUserSubscribedEvents(s.db, txtid)
 		clientManager.UpdateMyClientSubscriptions(txtid, union)
-		response := map[string]interface{}{"id": id, "url": t.URL, "events": validEvents}
+		response := map[string]interface{}{
+			"id":      id,
+			"url":     t.URL,
+			"events":  validEvents,
+			"secret":  maskSecret(t.Secret),
+			"format":  t.Format,
+			"headers": maskWebhookHeaders(headers),
+			"filters": t.Filters,
+			"ordered": t.Ordered,
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -298,8 +371,13 @@ func (s *server) CreateWebhook() http.HandlerFunc {
 // UpdateWebhook updates an existing webhook by ID
 func (s *server) UpdateWebhook() http.HandlerFunc {
 	type webhookStruct struct {
-		URL    string   `json:"url"`
-		Events []string `json:"events"`
+		URL     string             `json:"url"`
+		Events  []string           `json:"events"`
+		Secret  *string            `json:"secret"` // nil keeps the current secret, "" removes it
+		Format  *string            `json:"format"`
+		Headers *map[string]string `json:"headers"` // nil keeps the current headers, {} removes them
+		Filters *WebhookFilters    `json:"filters"` // nil keeps the current filters, {} removes them
+		Ordered *bool              `json:"ordered"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -319,15 +397,89 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 			}
 			validEvents = append(validEvents, e)
 		}
-		eventstring := strings.Join(validEvents, ",")
-		_, err := s.db.Exec("UPDATE user_webhooks SET url=$1, events=$2 WHERE id=$3 AND user_id=$4", t.URL, eventstring, hookID, txtid)
+		format := ""
+		if t.Format != nil {
+			format = *t.Format
+		}
+		var headers map[string]string
+		if t.Headers != nil {
+			headers = *t.Headers
+		}
+		if err := validateWebhookSettings(format, headers); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if t.Filters != nil {
+			if err := t.Filters.validate(); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		// Everything is changed in one statement, so a failure cannot leave the webhook half updated
+		set := []string{"url=$1", "events=$2"}
+		args := []interface{}{t.URL, strings.Join(validEvents, ",")}
+		setColumn := func(column string, value interface{}) {
+			args = append(args, value)
+			set = append(set, fmt.Sprintf("%s=$%d", column, len(args)))
+		}
+		if t.Secret != nil {
+			setColumn("secret", *t.Secret)
+		}
+		if t.Format != nil {
+			setColumn("format", format)
+		}
+		if t.Headers != nil {
+			encoded, err := encodeWebhookHeaders(headers)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not encode headers"))
+				return
+			}
+			setColumn("headers", encoded)
+		}
+		if t.Filters != nil {
+			encoded, err := encodeWebhookFilters(*t.Filters)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not encode filters"))
+				return
+			}
+			setColumn("filters", encoded)
+		}
+		if t.Ordered != nil {
+			setColumn("ordered", *t.Ordered)
+		}
+		args = append(args, hookID, txtid)
+		res, err := s.db.Exec(fmt.Sprintf("UPDATE user_webhooks SET %s WHERE id=$%d AND user_id=$%d", strings.Join(set, ", "), len(args)-1, len(args)), args...)
 		if err != nil {
+			log.Error().Err(err).Str("webhookID", hookID).Msg("Could not update webhook")
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not update webhook"))
 			return
 		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("webhook not found"))
+			return
+		}
+		// A changed configuration deserves a fresh start, so a paused webhook is resumed
+		res, err = s.db.Exec("UPDATE user_webhooks SET health=$1, consecutive_failures=0, paused_until=0 WHERE id=$2 AND user_id=$3 AND health=$4",
+			webhookHealthy, hookID, txtid, webhookUnhealthy)
+		if err != nil {
+			log.Warn().Err(err).Str("webhookID", hookID).Msg("Could not reset webhook health")
+		} else if n, _ := res.RowsAffected(); n == 1 && webhookQueue != nil {
+			webhookQueue.releaseDeferred(hookID)
+		}
+		var hook UserWebhook
+		s.db.Get(&hook, "SELECT "+userWebhookColumns+" FROM user_webhooks WHERE id=$1 AND user_id=$2", hookID, txtid)
 		union, _ := getUserSubscribedEvents(s.db, txtid)
 		clientManager.UpdateMyClientSubscriptions(txtid, union)
-		response := map[string]interface{}{"id": hookID, "url": t.URL, "events": validEvents}
+		response := map[string]interface{}{
+			"id":      hookID,
+			"url":     t.URL,
+			"events":  validEvents,
+			"secret":  maskSecret(hook.Secret),
+			"format":  hook.Format,
+			"headers": maskWebhookHeaders(hook.Headers),
+			"filters": decodeWebhookFilters(hook.Filters),
+			"ordered": hook.Ordered,
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -348,6 +500,11 @@ func (s *server) DeleteWebhook() http.HandlerFunc {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not delete webhook"))
 			return
 		}
+		// Drop pending deliveries and the history of the removed webhook
+		_, err = s.db.Exec("DELETE FROM webhook_deliveries WHERE webhook_id=$1 AND user_id=$2", hookID, txtid)
+		if err != nil {
+			log.Warn().Err(err).Str("webhookID", hookID).Msg("Could not remove webhook deliveries")
+		}
 		union, _ := getUserSubscribedEvents(s.db, txtid)
 		clientManager.UpdateMyClientSubscriptions(txtid, union)
 		response := map[string]interface{}{"Details": "Webhook removed successfully"}
@@ -360,6 +517,374 @@ func (s *server) DeleteWebhook() http.HandlerFunc {
 	}
 }
 
+// ListWebhookDeliveries returns the most recent deliveries of a webhook with every attempt made for them
+func (s *server) ListWebhookDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		hookID := vars["id"]
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var count int
+		err := s.db.Get(&count, "SELECT COUNT(*) FROM user_webhooks WHERE id=$1 AND user_id=$2", hookID, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not get webhook"))
+			return
+		}
+		if count == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("webhook not found"))
+			return
+		}
+
+		limit := 50
+		if l := r.URL.Query().Get("limit"); l != "" {
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit < 1 || limit > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("limit must be between 1 and 500"))
+				return
+			}
+		}
+
+		query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE webhook_id=$1 AND user_id=$2"
+		args := []interface{}{hookID, txtid}
+		if status := r.URL.Query().Get("status"); status != "" {
+			query += " AND status=$3"
+			args = append(args, status)
+		}
+		query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT %d", limit)
+
+		deliveries := []WebhookDelivery{}
+		if err := s.db.Select(&deliveries, query, args...); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not get webhook deliveries"))
+			return
+		}
+
+		// Only the attempts of the deliveries in the page are loaded
+		attempts := []WebhookAttempt{}
+		if len(deliveries) > 0 {
+			ids := make([]string, len(deliveries))
+			for i, d := range deliveries {
+				ids[i] = d.ID
+			}
+			query, args, err := sqlx.In(`SELECT id, delivery_id, webhook_id, attempt, status_code, latency_ms, response_body, error, created_at
+				FROM webhook_attempts WHERE delivery_id IN (?) ORDER BY attempt ASC`, ids)
+			if err == nil {
+				err = s.db.Select(&attempts, s.db.Rebind(query), args...)
+			}
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("could not get webhook attempts"))
+				return
+			}
+		}
+		attemptsByDelivery := make(map[string][]map[string]interface{})
+		for _, a := range attempts {
+			attemptsByDelivery[a.DeliveryID] = append(attemptsByDelivery[a.DeliveryID], map[string]interface{}{
+				"attempt":     a.Attempt,
+				"status_code": a.StatusCode,
+				"latency_ms":  a.LatencyMs,
+				"response":    a.ResponseBody,
+				"error":       a.Error,
+				"created_at":  a.CreatedAt,
+			})
+		}
+
+		response := []map[string]interface{}{}
+		for _, d := range deliveries {
+			history := attemptsByDelivery[d.ID]
+			if history == nil {
+				history = []map[string]interface{}{}
+			}
+			response = append(response, map[string]interface{}{
+				"id":              d.ID,
+				"event_type":      d.EventType,
+				"url":             d.URL,
+				"status":          d.Status,
+				"attempts":        d.Attempts,
+				"next_attempt_at": d.NextAttemptAt,
+				"last_error":      d.LastError,
+				"created_at":      d.CreatedAt,
+				"updated_at":      d.UpdatedAt,
+				"history":         history,
+			})
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// ReplayWebhookDelivery queues a copy of a previous delivery to the webhook's current URL
+func (s *server) ReplayWebhookDelivery() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		hookID := vars["id"]
+		deliveryID := vars["deliveryId"]
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var hook UserWebhook
+		err := s.db.Get(&hook, "SELECT "+userWebhookColumns+" FROM user_webhooks WHERE id=$1 AND user_id=$2", hookID, txtid)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("webhook not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not get webhook"))
+			return
+		}
+
+		var d WebhookDelivery
+		err = s.db.Get(&d, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id=$1 AND webhook_id=$2 AND user_id=$3", deliveryID, hookID, txtid)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("delivery not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not get delivery"))
+			return
+		}
+
+		payload := map[string]string{}
+		if err := json.Unmarshal([]byte(d.Payload), &payload); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not decode stored payload"))
+			return
+		}
+		if webhookQueue == nil {
+			s.Respond(w, r, http.StatusServiceUnavailable, errors.New("webhook queue is not running"))
+			return
+		}
+		chatJID := ""
+		if hook.Ordered {
+			chatJID = d.ChatJID
+		}
+		newID, err := webhookQueue.Enqueue(txtid, hook.ID, hook.URL, d.EventType, payload, d.FilePath, chatJID)
+		if err != nil {
+			log.Error().Err(err).Str("deliveryID", deliveryID).Msg("Could not queue webhook replay")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not queue replay"))
+			return
+		}
+
+		response := map[string]interface{}{"id": newID, "replay_of": d.ID, "status": deliveryPending}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// TestWebhook sends a synthetic event to a webhook right away and returns what the receiver answered
+func (s *server) TestWebhook() http.HandlerFunc {
+	type testStruct struct {
+		Type string `json:"type"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		hookID := vars["id"]
+		userinfo := r.Context().Value("userinfo").(Values)
+		txtid := userinfo.Get("Id")
+
+		var t testStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+				return
+			}
+		}
+		if t.Type == "" {
+			t.Type = "Message"
+		}
+		if t.Type == "All" || !Find(supportedEventTypes, t.Type) {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("unsupported event type %q", t.Type))
+			return
+		}
+
+		var hook UserWebhook
+		err := s.db.Get(&hook, "SELECT "+userWebhookColumns+" FROM user_webhooks WHERE id=$1 AND user_id=$2", hookID, txtid)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("webhook not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not get webhook"))
+			return
+		}
+		opts, err := getWebhookOptions(s.db, hook.ID)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not get webhook options"))
+			return
+		}
+
+		ownJID, _ := types.ParseJID(userinfo.Get("Jid"))
+		postmap := deliveryPayload(buildTestEvent(t.Type, ownJID.ToNonAD()))
+		jsonData, err := json.Marshal(postmap)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("could not encode test event"))
+			return
+		}
+
+		payload := userWebhookPayload(jsonData, userinfo.Get("Token"), userinfo.Get("Name"))
+		resp, callErr := callHook(hook.URL, payload, txtid, opts)
+
+		response := map[string]interface{}{
+			"url":         hook.URL,
+			"type":        postmap["type"],
+			"payload":     postmap,
+			"delivered":   callErr == nil,
+			"error":       "",
+			"status_code": 0,
+			"headers":     map[string][]string{},
+			"body":        "",
+			"latency_ms":  int64(0),
+		}
+		if callErr != nil {
+			response["error"] = callErr.Error()
+		}
+		if resp != nil {
+			response["status_code"] = resp.StatusCode
+			response["latency_ms"] = resp.Latency.Milliseconds()
+			if resp.Header != nil {
+				response["headers"] = resp.Header
+			}
+			response["body"] = strings.ToValidUTF8(string(resp.Body), "")
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// StreamEvents pushes the session events to the client as Server-Sent Events
+func (s *server) StreamEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		filter, err := parseEventFilter(strings.Split(r.URL.Query().Get("events"), ","))
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		lastID, err := lastEventIDFromRequest(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		// The stream outlives the server write timeout
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			log.Warn().Err(err).Msg("Could not clear write deadline for event stream")
+		}
+
+		backlog, events, cancel := eventBroker.Subscribe(txtid, lastID)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(evt StreamEvent) error {
+			if len(filter) > 0 && !filter[evt.Type] {
+				return nil
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", evt.ID, evt.Type, evt.Data); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		// Tell EventSource clients how long to wait before reconnecting
+		fmt.Fprint(w, "retry: 3000\n\n")
+		if err := rc.Flush(); err != nil {
+			log.Warn().Err(err).Msg("Event stream does not support flushing")
+			return
+		}
+		for _, evt := range backlog {
+			if err := send(evt); err != nil {
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(25 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case evt, ok := <-events:
+				if !ok {
+					// Too slow to keep up, the client reconnects with Last-Event-ID and resumes from the buffer
+					return
+				}
+				if err := send(evt); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// WebSocket streams the session events and runs send commands over a single connection
+func (s *server) WebSocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userinfo := r.Context().Value("userinfo").(Values)
+
+		filter, err := parseEventFilter(strings.Split(r.URL.Query().Get("events"), ","))
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		lastID, err := lastEventIDFromRequest(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade already wrote the error response
+			log.Warn().Err(err).Msg("WebSocket upgrade failed")
+			return
+		}
+		ws := &wsSession{
+			s:        s,
+			conn:     conn,
+			userinfo: userinfo,
+			out:      make(chan wsMessage, 64),
+			filter:   filter,
+		}
+		ws.run(lastID)
+	}
+}
+
+// lastEventIDFromRequest reads the event ID to resume from, sent by browsers as Last-Event-ID
+// when reconnecting or by other clients as the lastEventId query parameter
+func lastEventIDFromRequest(r *http.Request) (uint64, error) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	if lastEventID == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid Last-Event-ID")
+	}
+	return id, nil
+}
+
 // Gets QR code encoded in Base64
 func (s *server) GetQR() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -667,7 +1192,7 @@ func (s *server) SendDocument() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaDocument)
+				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(sendContext(r), filedata, whatsmeow.MediaDocument)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
 					return
@@ -709,11 +1234,13 @@ func (s *server) SendDocument() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -790,7 +1317,7 @@ func (s *server) SendAudio() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaAudio)
+				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(sendContext(r), filedata, whatsmeow.MediaAudio)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
 					return
@@ -830,11 +1357,13 @@ func (s *server) SendAudio() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -913,7 +1442,7 @@ func (s *server) SendImage() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaImage)
+				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(sendContext(r), filedata, whatsmeow.MediaImage)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
 					return
@@ -986,11 +1515,13 @@ func (s *server) SendImage() http.HandlerFunc {
 			msg.ImageMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1068,7 +1599,7 @@ func (s *server) SendSticker() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaImage)
+				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(sendContext(r), filedata, whatsmeow.MediaImage)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 					return
@@ -1109,11 +1640,13 @@ func (s *server) SendSticker() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1192,7 +1725,7 @@ func (s *server) SendVideo() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaVideo)
+				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(sendContext(r), filedata, whatsmeow.MediaVideo)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to upload file: %v", err)))
 					return
@@ -1234,11 +1767,13 @@ func (s *server) SendVideo() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1327,11 +1862,13 @@ func (s *server) SendContact() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1422,11 +1959,13 @@ func (s *server) SendLocation() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1522,15 +2061,18 @@ func (s *server) SendButtons() http.HandlerFunc {
 			Buttons:     buttons,
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
+		msg := &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
 			Message: &waE2E.Message{
 				ButtonsMessage: msg2,
 			},
-		}}, whatsmeow.SendRequestExtra{ID: msgid})
+		}}
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1669,15 +2211,17 @@ func (s *server) SendList() http.HandlerFunc {
 		}
 
 		resp, err := clientManager.GetWhatsmeowClient(txtid).SendMessage(
-			context.Background(),
+			sendContext(r),
 			recipient,
 			msg,
 			whatsmeow.SendRequestExtra{ID: msgid},
 		)
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		response := map[string]interface{}{
 			"Details":   "Sent",
@@ -1766,11 +2310,13 @@ func (s *server) SendMessage() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1840,14 +2386,24 @@ func (s *server) SendPoll() http.HandlerFunc {
 		}
 
 		pollMessage := clientManager.GetWhatsmeowClient(txtid).BuildPollCreation(req.Header, req.Options, 1)
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, pollMessage, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, pollMessage, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("failed to send poll: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, pollMessage, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Poll sent")
 
+		ownJID := clientManager.GetWhatsmeowClient(txtid).Store.ID
+		if ownJID != nil {
+			err = recordPoll(s.db, txtid, msgid, recipient, *ownJID, pollMessage.GetPollCreationMessage(), resp.Timestamp)
+			if err != nil {
+				log.Error().Err(err).Str("id", msgid).Msg("Failed to store poll")
+			}
+		}
+
 		response := map[string]interface{}{"Details": "Poll sent successfully", "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -1904,11 +2460,13 @@ func (s *server) DeleteMessage() http.HandlerFunc {
 			return
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, clientManager.GetWhatsmeowClient(txtid).BuildRevoke(recipient, types.EmptyJID, msgid))
+		revoke := clientManager.GetWhatsmeowClient(txtid).BuildRevoke(recipient, types.EmptyJID, msgid)
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, revoke)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, revoke, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message deleted")
 		response := map[string]interface{}{"Details": "Deleted", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -1997,11 +2555,13 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, clientManager.GetWhatsmeowClient(txtid).BuildEdit(recipient, msgid, msg))
+		editMsg := clientManager.GetWhatsmeowClient(txtid).BuildEdit(recipient, msgid, msg)
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(sendContext(r), recipient, editMsg)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending edit message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, editMsg.GetEditedMessage().GetMessage(), resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message edit sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -2969,9 +3529,11 @@ func (s *server) React() http.HandlerFunc {
 
 		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
+			storeFailedMessage(s.db, txtid, recipient, msgid, err)
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msg, resp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp.Unix(), "Id": msgid}
@@ -3027,6 +3589,9 @@ func (s *server) MarkRead() http.HandlerFunc {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("failure marking messages as read"))
 			return
 		}
+		if err := markChatRead(s.db, txtid, t.Chat); err != nil {
+			log.Error().Err(err).Msg("Failed to update chat unread count")
+		}
 
 		response := map[string]interface{}{"Details": "Message(s) marked as read"}
 		responseJson, err := json.Marshal(response)
@@ -4278,6 +4843,7 @@ func (s *server) DeleteUser() http.HandlerFunc {
 			})
 			return
 		}
+		eventBroker.Forget(userID)
 		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
 			"code":    http.StatusOK,
 			"data":    map[string]string{"id": userID},
@@ -4362,6 +4928,7 @@ func (s *server) DeleteUserComplete() http.HandlerFunc {
 		clientManager.DeleteMyClient(id)
 		clientManager.DeleteHTTPClient(id)
 		userinfocache.Delete(token)
+		eventBroker.Forget(id)
 
 		// 4. Remove media files
 		userDirectory := filepath.Join(s.exPath, "files", id)
@@ -4800,3 +5367,619 @@ func (s *server) DeleteS3Config() http.HandlerFunc {
 		}
 	}
 }
+
+// Get event sinks
+func (s *server) GetEventSinks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		enabled, err := getUserEventSinks(s.db, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get event sinks"))
+			return
+		}
+
+		sinks := []map[string]interface{}{}
+		for _, rs := range eventSinks {
+			sinks = append(sinks, map[string]interface{}{
+				"name":    rs.sink.Name(),
+				"scope":   rs.scope,
+				"enabled": rs.scope == sinkScopeAll || Find(enabled, rs.sink.Name()),
+			})
+		}
+
+		response := map[string]interface{}{"sinks": sinks}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Set event sinks, selects which of the user scoped sinks receive the user events
+func (s *server) SetEventSinks() http.HandlerFunc {
+	type sinksStruct struct {
+		Sinks []string `json:"sinks"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		decoder := json.NewDecoder(r.Body)
+		var t sinksStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+
+		selectable := userSelectableSinks()
+		sinks := []string{}
+		for _, name := range t.Sinks {
+			if !Find(selectable, name) {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("sink %q cannot be selected, available sinks: %s", name, strings.Join(selectable, ", ")))
+				return
+			}
+			if !Find(sinks, name) {
+				sinks = append(sinks, name)
+			}
+		}
+
+		encoded, err := json.Marshal(sinks)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		_, err = s.db.Exec("UPDATE users SET event_sinks = $1 WHERE id = $2", string(encoded), txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save event sinks"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Event sinks configured successfully", "sinks": sinks}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get call settings
+func (s *server) GetCallConfig() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var settings callSettings
+		err := s.db.Get(&settings, "SELECT reject_calls, reject_calls_message FROM users WHERE id=$1", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get call configuration"))
+			return
+		}
+
+		responseJson, err := json.Marshal(settings)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Configure calls, incoming calls can be rejected automatically with an optional text reply
+func (s *server) SetCallConfig() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		decoder := json.NewDecoder(r.Body)
+		var t callSettings
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+
+		_, err = s.db.Exec("UPDATE users SET reject_calls = $1, reject_calls_message = $2 WHERE id = $3", t.RejectCalls, t.RejectMessage, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save call configuration"))
+			return
+		}
+
+		response := map[string]interface{}{
+			"Details":              "Call configuration saved successfully",
+			"reject_calls":         t.RejectCalls,
+			"reject_calls_message": t.RejectMessage,
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get the results of a poll, counted from the votes received since it was sent or seen
+func (s *server) GetPollResults() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		pollID := mux.Vars(r)["id"]
+
+		results, err := pollResults(s.db, txtid, pollID)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("poll not found"))
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("pollID", pollID).Msg("Failed to get poll results")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get poll results"))
+			return
+		}
+
+		responseJson, err := json.Marshal(results)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get message store settings
+func (s *server) GetStoreConfig() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var enabled bool
+		err := s.db.Get(&enabled, "SELECT store_messages FROM users WHERE id=$1", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get message store configuration"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"store_messages": enabled})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Turn the message store on or off, messages already stored are kept
+func (s *server) SetStoreConfig() http.HandlerFunc {
+	type storeConfigStruct struct {
+		StoreMessages *bool `json:"store_messages"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		decoder := json.NewDecoder(r.Body)
+		var t storeConfigStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode payload"))
+			return
+		}
+		if t.StoreMessages == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing store_messages in payload"))
+			return
+		}
+
+		_, err = s.db.Exec("UPDATE users SET store_messages = $1 WHERE id = $2", *t.StoreMessages, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to save message store configuration"))
+			return
+		}
+
+		response := map[string]interface{}{
+			"Details":        "Message store configuration saved successfully",
+			"store_messages": *t.StoreMessages,
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// List stored messages, newest first
+func (s *server) ListMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		q, err := messageQueryFromRequest(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		messages, next, err := listMessages(s.db, txtid, q)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list messages")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list messages"))
+			return
+		}
+
+		response := map[string]interface{}{
+			"messages":    messages,
+			"next_cursor": next,
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Search stored messages
+func (s *server) SearchMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		text := strings.TrimSpace(r.URL.Query().Get("q"))
+		if text == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing q in query string"))
+			return
+		}
+		q, err := messageQueryFromRequest(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		messages, next, err := searchMessages(s.db, txtid, text, q)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to search messages")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to search messages"))
+			return
+		}
+
+		response := map[string]interface{}{
+			"messages":    messages,
+			"next_cursor": next,
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// List chats
+func (s *server) ListChats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		chats, err := listChats(s.db, txtid)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list chats")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list chats"))
+			return
+		}
+		resolveChatNames(s.db, txtid, clientManager.GetWhatsmeowClient(txtid), chats)
+
+		responseJson, err := json.Marshal(map[string]interface{}{"chats": chats})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get the status of a sent message
+func (s *server) GetMessageStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		msgID := mux.Vars(r)["id"]
+
+		message, err := getOutgoingMessage(s.db, txtid, msgID)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("message not found"))
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("id", msgID).Msg("Failed to get message status")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get message status"))
+			return
+		}
+
+		responseJson, err := json.Marshal(message)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Export a chat as a ZIP archive
+func (s *server) ExportChat() http.HandlerFunc {
+
+	type exportRequest struct {
+		Chat     string
+		From     int64
+		To       int64
+		Timezone string
+		Media    *bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		// Without the message store the archive would be empty, which reads as a chat without messages
+		if !messageStoreEnabled(s.db, txtid) {
+			s.Respond(w, r, http.StatusConflict, errors.New("message store is disabled, enable it with /session/store/config to export chats"))
+			return
+		}
+
+		var t exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		if t.Chat == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Chat in Payload"))
+			return
+		}
+		chat, ok := parseJID(t.Chat)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid Chat"))
+			return
+		}
+		if t.From < 0 || t.To < 0 || (t.To > 0 && t.To < t.From) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid date range, From and To are unix timestamps with From before To"))
+			return
+		}
+		export := chatExport{Chat: chat, From: t.From, To: t.To, Location: time.UTC, Media: t.Media == nil || *t.Media}
+		if t.Timezone != "" {
+			loc, err := time.LoadLocation(t.Timezone)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("invalid Timezone"))
+				return
+			}
+			export.Location = loc
+		}
+
+		messages, err := exportMessages(s.db, txtid, export)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to load messages to export")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to export chat"))
+			return
+		}
+
+		// Fetching media can take longer than the server write timeout
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(30 * time.Minute)); err != nil {
+			log.Debug().Err(err).Msg("Could not extend write deadline for chat export")
+		}
+		fileName := fmt.Sprintf("chat-%s-%s.zip", chat.User, time.Now().Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+		w.WriteHeader(http.StatusOK)
+
+		err = writeChatExport(r.Context(), w, txtid, clientManager.GetWhatsmeowClient(txtid), export, messages)
+		if err != nil {
+			log.Error().Err(err).Str("chat", chat.String()).Msg("Failed to write chat export")
+			return
+		}
+		log.Info().Str("chat", chat.String()).Int("messages", len(messages)).Msg("Chat exported")
+	}
+}
+
+// Create a broadcast that sends a message to a list of recipients in the background
+func (s *server) CreateBroadcast() http.HandlerFunc {
+
+	type broadcastRequest struct {
+		Type       string
+		Message    json.RawMessage
+		Recipients []broadcastTarget
+		CSV        string
+		PerMinute  int
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var t broadcastRequest
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		if t.Type == "" {
+			t.Type = "text"
+		}
+		if _, ok := broadcastTypes[t.Type]; !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid Type, supported types: "+strings.Join(broadcastTypeNames(), ", ")))
+			return
+		}
+		if len(t.Message) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Message in Payload"))
+			return
+		}
+		var message map[string]interface{}
+		if err := json.Unmarshal(t.Message, &message); err != nil || message == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid Message, it must be the JSON body of the send endpoint"))
+			return
+		}
+		if t.PerMinute == 0 {
+			t.PerMinute = getEnvInt("BROADCAST_PER_MINUTE", 20)
+		}
+		if t.PerMinute < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid PerMinute"))
+			return
+		}
+
+		targets := t.Recipients
+		if t.CSV != "" {
+			fromCSV, err := broadcastTargetsFromCSV(t.CSV)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			targets = append(targets, fromCSV...)
+		}
+		if len(targets) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Recipients or CSV in Payload"))
+			return
+		}
+		targets, duplicates, err := prepareBroadcastTargets(targets, string(t.Message))
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		job, err := createBroadcast(s.db, txtid, t.Type, string(t.Message), t.PerMinute, targets)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to create broadcast")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to create broadcast"))
+			return
+		}
+		s.startBroadcast(*job)
+		log.Info().Str("id", job.ID).Int("recipients", len(targets)).Int("per_minute", job.PerMinute).Msg("Broadcast created")
+
+		response := map[string]interface{}{"id": job.ID, "status": job.Status, "recipients": len(targets), "duplicates": duplicates}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Get the progress of a broadcast and the result for each recipient
+func (s *server) GetBroadcast() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		job, err := getBroadcast(s.db, txtid, id, r.URL.Query().Get("status"))
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("broadcast not found"))
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to get broadcast")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get broadcast"))
+			return
+		}
+
+		responseJson, err := json.Marshal(job)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Cancel a running broadcast, the recipients not sent yet are skipped
+func (s *server) CancelBroadcast() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		cancelled, err := cancelBroadcast(s.db, txtid, id)
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to cancel broadcast")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to cancel broadcast"))
+			return
+		}
+		job, err := getBroadcast(s.db, txtid, id, "")
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("broadcast not found"))
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to get broadcast")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get broadcast"))
+			return
+		}
+		if !cancelled {
+			s.Respond(w, r, http.StatusConflict, errors.New("broadcast already "+job.Status))
+			return
+		}
+		log.Info().Str("id", id).Msg("Broadcast cancelled")
+
+		responseJson, err := json.Marshal(job)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// List the scheduled messages, the pending ones unless another status is asked for
+func (s *server) ListScheduledMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "":
+			status = scheduledPending
+		case scheduledPending, scheduledSent, scheduledFailed, scheduledSkipped, scheduledCancelled:
+		default:
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid status, use pending, sent, failed, skipped or cancelled"))
+			return
+		}
+
+		messages, err := listScheduledMessages(s.db, txtid, status)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list scheduled messages")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to list scheduled messages"))
+			return
+		}
+
+		responseJson, err := json.Marshal(map[string]interface{}{"messages": messages})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Cancel a scheduled message that was not sent yet
+func (s *server) CancelScheduledMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		cancelled, err := cancelScheduledMessage(s.db, txtid, id)
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to cancel scheduled message")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to cancel scheduled message"))
+			return
+		}
+		message, err := getScheduledMessage(s.db, txtid, id)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("scheduled message not found"))
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to get scheduled message")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to get scheduled message"))
+			return
+		}
+		if !cancelled {
+			s.Respond(w, r, http.StatusConflict, errors.New("scheduled message already "+message.Status))
+			return
+		}
+		log.Info().Str("id", id).Msg("Scheduled message cancelled")
+
+		responseJson, err := json.Marshal(message)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
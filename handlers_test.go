@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// serveAsUser runs a handler for the test user with the given route variables and returns the response
+func serveAsUser(handler http.Handler, method, target, body string, vars map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), "userinfo", Values{map[string]string{"Id": "user", "Token": "token"}}))
+	r = mux.SetURLVars(r, vars)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// responseData decodes the data of a response envelope into v
+func responseData(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(envelope.Data, v); err != nil {
+		t.Fatalf("could not decode %s: %v", envelope.Data, err)
+	}
+}
+
+// getTestWebhook loads a webhook of the test user
+func getTestWebhook(t *testing.T, db *sqlx.DB, id string) UserWebhook {
+	t.Helper()
+	var hook UserWebhook
+	if err := db.Get(&hook, "SELECT "+userWebhookColumns+" FROM user_webhooks WHERE id=$1", id); err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func TestUpdateWebhook(t *testing.T) {
+	db := newTestDB(t)
+	s := &server{db: db}
+	_, err := db.Exec(`INSERT INTO user_webhooks (id, user_id, url, events, secret, format, headers, filters, ordered)
+        VALUES ('hook', 'user', 'http://old.example.com', 'Message', 'old', 'json', '{"X-Old":"1"}', '{"chat_type":"group"}', true)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		id         string
+		body       string
+		wantStatus int
+		want       UserWebhook
+	}{
+		{
+			name:       "url and events only",
+			id:         "hook",
+			body:       `{"url":"http://new.example.com","events":["Message","ReadReceipt","Unknown"]}`,
+			wantStatus: http.StatusOK,
+			want: UserWebhook{URL: "http://new.example.com", Events: "Message,ReadReceipt", Secret: "old", Format: "json",
+				Headers: `{"X-Old":"1"}`, Filters: `{"chat_type":"group"}`, Ordered: true},
+		},
+		{
+			name:       "every setting",
+			id:         "hook",
+			body:       `{"url":"http://new.example.com","events":["All"],"secret":"","format":"cloudevents","headers":{"X-New":"2"},"filters":{},"ordered":false}`,
+			wantStatus: http.StatusOK,
+			want:       UserWebhook{URL: "http://new.example.com", Events: "All", Format: "cloudevents", Headers: `{"X-New":"2"}`},
+		},
+		{
+			name:       "invalid format",
+			id:         "hook",
+			body:       `{"url":"http://other.example.com","events":["All"],"format":"xml"}`,
+			wantStatus: http.StatusBadRequest,
+			want:       UserWebhook{URL: "http://new.example.com", Events: "All", Format: "cloudevents", Headers: `{"X-New":"2"}`},
+		},
+		{
+			name:       "unknown webhook",
+			id:         "missing",
+			body:       `{"url":"http://other.example.com","events":["All"],"ordered":true}`,
+			wantStatus: http.StatusNotFound,
+			want:       UserWebhook{URL: "http://new.example.com", Events: "All", Format: "cloudevents", Headers: `{"X-New":"2"}`},
+		},
+	}
+	for _, tt := range tests {
+		w := serveAsUser(s.UpdateWebhook(), "PUT", "/webhooks/"+tt.id, tt.body, map[string]string{"id": tt.id})
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, w.Code, tt.wantStatus, w.Body)
+		}
+		got := getTestWebhook(t, db, "hook")
+		if got.URL != tt.want.URL || got.Events != tt.want.Events || got.Secret != tt.want.Secret || got.Format != tt.want.Format ||
+			got.Headers != tt.want.Headers || got.Filters != tt.want.Filters || got.Ordered != tt.want.Ordered {
+			t.Errorf("%s: got webhook %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateWebhookOfAnotherUser(t *testing.T) {
+	db := newTestDB(t)
+	s := &server{db: db}
+	if _, err := db.Exec("INSERT INTO users (id, name, token) VALUES ('other', 'Other', 'other')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO user_webhooks (id, user_id, url, events) VALUES ('hook', 'other', 'http://example.com', 'All')"); err != nil {
+		t.Fatal(err)
+	}
+	w := serveAsUser(s.UpdateWebhook(), "PUT", "/webhooks/hook", `{"url":"http://attacker.example.com","events":["All"]}`, map[string]string{"id": "hook"})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", w.Code)
+	}
+	if got := getTestWebhook(t, db, "hook"); got.URL != "http://example.com" {
+		t.Errorf("got url %s, want it unchanged", got.URL)
+	}
+}
+
+// insertTestDelivery stores a delivery of the test user with the given number of recorded attempts
+func insertTestDelivery(t *testing.T, db *sqlx.DB, id, hookID, status string, createdAt int64, chatJID string, attempts int) {
+	t.Helper()
+	_, err := db.Exec(`INSERT INTO webhook_deliveries (id, user_id, webhook_id, url, event_type, payload, file_path, status, attempts, next_attempt_at, last_error, created_at, updated_at, chat_jid, seq)
+        VALUES ($1, 'user', $2, 'http://old.example.com', 'Message', '{"jsonData":"{}"}', '', $3, $4, 0, '', $5, $5, $6, $5)`,
+		id, hookID, status, attempts, createdAt, chatJID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= attempts; i++ {
+		_, err := db.Exec(`INSERT INTO webhook_attempts (id, delivery_id, webhook_id, attempt, status_code, latency_ms, response_body, error, created_at)
+            VALUES ($1, $2, $3, $4, 500, 10, '', '', $5)`, fmt.Sprintf("%s-%d", id, i), id, hookID, i, createdAt+int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListWebhookDeliveries(t *testing.T) {
+	db := newTestDB(t)
+	s := &server{db: db}
+	if _, err := db.Exec("INSERT INTO user_webhooks (id, user_id, url, events) VALUES ('hook', 'user', 'http://example.com', 'All'), ('other', 'user', 'http://example.com', 'All')"); err != nil {
+		t.Fatal(err)
+	}
+	insertTestDelivery(t, db, "d1", "hook", deliveryDead, 100, "", 3)
+	insertTestDelivery(t, db, "d2", "hook", deliveryDelivered, 200, "", 1)
+	insertTestDelivery(t, db, "d3", "hook", deliveryPending, 300, "", 0)
+	insertTestDelivery(t, db, "d4", "other", deliveryDead, 400, "", 2)
+
+	type attempt struct {
+		Attempt    int `json:"attempt"`
+		StatusCode int `json:"status_code"`
+	}
+	type delivery struct {
+		ID       string    `json:"id"`
+		Status   string    `json:"status"`
+		Attempts int       `json:"attempts"`
+		History  []attempt `json:"history"`
+	}
+	history := func(n int) []attempt {
+		attempts := []attempt{}
+		for i := 1; i <= n; i++ {
+			attempts = append(attempts, attempt{Attempt: i, StatusCode: 500})
+		}
+		return attempts
+	}
+	d1 := delivery{ID: "d1", Status: deliveryDead, Attempts: 3, History: history(3)}
+	d2 := delivery{ID: "d2", Status: deliveryDelivered, Attempts: 1, History: history(1)}
+	d3 := delivery{ID: "d3", Status: deliveryPending, History: history(0)}
+
+	tests := []struct {
+		name       string
+		id         string
+		query      string
+		wantStatus int
+		want       []delivery
+	}{
+		{"all", "hook", "", http.StatusOK, []delivery{d3, d2, d1}},
+		{"dead", "hook", "?status=dead", http.StatusOK, []delivery{d1}},
+		{"no match", "hook", "?status=failed", http.StatusOK, []delivery{}},
+		{"limit", "hook", "?limit=2", http.StatusOK, []delivery{d3, d2}},
+		{"largest limit", "hook", "?limit=500&status=delivered", http.StatusOK, []delivery{d2}},
+		{"limit too small", "hook", "?limit=0", http.StatusBadRequest, nil},
+		{"limit too large", "hook", "?limit=501", http.StatusBadRequest, nil},
+		{"limit not a number", "hook", "?limit=ten", http.StatusBadRequest, nil},
+		{"unknown webhook", "missing", "", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		w := serveAsUser(s.ListWebhookDeliveries(), "GET", "/webhooks/"+tt.id+"/deliveries"+tt.query, "", map[string]string{"id": tt.id})
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, w.Code, tt.wantStatus, w.Body)
+			continue
+		}
+		if tt.want == nil {
+			continue
+		}
+		var got []delivery
+		responseData(t, w, &got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReplayWebhookDelivery(t *testing.T) {
+	db := newTestDB(t)
+	s := &server{db: db}
+	_, err := db.Exec(`INSERT INTO user_webhooks (id, user_id, url, events, ordered) VALUES
+        ('ordered', 'user', 'http://ordered.example.com', 'All', true), ('unordered', 'user', 'http://unordered.example.com', 'All', false)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := "5491155551234@s.whatsapp.net"
+	insertTestDelivery(t, db, "d1", "ordered", deliveryDead, 100, chat, 3)
+	// Stored while the webhook was still ordered
+	insertTestDelivery(t, db, "d2", "unordered", deliveryDead, 200, chat, 3)
+
+	replay := func(hookID, deliveryID string) *httptest.ResponseRecorder {
+		return serveAsUser(s.ReplayWebhookDelivery(), "POST", "/webhooks/"+hookID+"/deliveries/"+deliveryID+"/replay", "",
+			map[string]string{"id": hookID, "deliveryId": deliveryID})
+	}
+
+	if w := replay("ordered", "d1"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without a queue: got status %d, want 503", w.Code)
+	}
+	previous := webhookQueue
+	webhookQueue = newTestQueue(db)
+	t.Cleanup(func() { webhookQueue = previous })
+
+	tests := []struct {
+		name       string
+		hookID     string
+		deliveryID string
+		wantStatus int
+		wantURL    string
+		wantChat   string
+	}{
+		{"ordered webhook", "ordered", "d1", http.StatusOK, "http://ordered.example.com", chat},
+		{"unordered webhook", "unordered", "d2", http.StatusOK, "http://unordered.example.com", ""},
+		{"delivery of another webhook", "ordered", "d2", http.StatusNotFound, "", ""},
+		{"unknown delivery", "ordered", "missing", http.StatusNotFound, "", ""},
+		{"unknown webhook", "missing", "d1", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		w := replay(tt.hookID, tt.deliveryID)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, w.Code, tt.wantStatus, w.Body)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			ID       string `json:"id"`
+			ReplayOf string `json:"replay_of"`
+		}
+		responseData(t, w, &resp)
+		if resp.ReplayOf != tt.deliveryID {
+			t.Errorf("%s: got replay_of %s, want %s", tt.name, resp.ReplayOf, tt.deliveryID)
+		}
+		got := getTestDelivery(t, db, resp.ID)
+		if got.WebhookID != tt.hookID || got.URL != tt.wantURL || got.ChatJID != tt.wantChat || got.Status != deliveryPending ||
+			got.Attempts != 0 || got.Payload != `{"jsonData":"{}"}` {
+			t.Errorf("%s: got delivery %+v", tt.name, got)
+		}
+	}
+}
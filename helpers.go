@@ -1,13 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-resty/resty/v2"
 	"github.com/jmoiron/sqlx"
 	"github.com/rs/zerolog/log"
 )
@@ -28,8 +41,164 @@ func updateUserInfo(values interface{}, field string, value string) interface{}
 	return values
 }
 
+// Supported webhook payload formats, an empty format falls back to WEBHOOK_FORMAT
+const (
+	webhookFormatForm        = "form"
+	webhookFormatJSON        = "json"
+	webhookFormatCloudEvents = "cloudevents"
+)
+
+// Headers that are set by wuzapi itself and cannot be replaced by custom webhook headers
+var reservedWebhookHeaders = []string{"Content-Type", "Content-Length", "Host", "X-Wuzapi-Signature", "X-Wuzapi-Timestamp"}
+
+// webhookOptions carries the per-webhook settings applied when a delivery is sent
+type webhookOptions struct {
+	Secret  string
+	Format  string
+	Headers map[string]string
+	// DeliveryID identifies the event across retries, it is used as the CloudEvents id
+	DeliveryID string
+}
+
+// validateWebhookSettings checks the format and custom headers sent to CreateWebhook and UpdateWebhook
+func validateWebhookSettings(format string, headers map[string]string) error {
+	switch format {
+	case "", webhookFormatForm, webhookFormatJSON, webhookFormatCloudEvents:
+	default:
+		return fmt.Errorf("invalid format %q, use form, json or cloudevents", format)
+	}
+	for name := range headers {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		for _, reserved := range reservedWebhookHeaders {
+			if strings.EqualFold(name, reserved) {
+				return fmt.Errorf("header %s cannot be overridden", reserved)
+			}
+		}
+	}
+	return nil
+}
+
+// encodeWebhookHeaders stores custom headers as a JSON object, an empty map is stored as ""
+func encodeWebhookHeaders(headers map[string]string) (string, error) {
+	if len(headers) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// decodeWebhookHeaders parses custom headers stored by encodeWebhookHeaders
+func decodeWebhookHeaders(stored string) map[string]string {
+	headers := map[string]string{}
+	if stored == "" {
+		return headers
+	}
+	if err := json.Unmarshal([]byte(stored), &headers); err != nil {
+		log.Warn().Err(err).Msg("Could not decode webhook headers")
+	}
+	return headers
+}
+
+// maskWebhookHeaders hides header values in API responses, they often carry credentials
+func maskWebhookHeaders(stored string) map[string]string {
+	masked := map[string]string{}
+	for name, value := range decodeWebhookHeaders(stored) {
+		masked[name] = maskSecret(value)
+	}
+	return masked
+}
+
+// buildWebhookBody serializes the payload in the requested format and returns the body and its content type
+func buildWebhookBody(payload map[string]string, id string, opts webhookOptions) ([]byte, string, error) {
+	format := opts.Format
+	if format == "" {
+		format = os.Getenv("WEBHOOK_FORMAT")
+	}
+
+	if format != webhookFormatJSON && format != webhookFormatCloudEvents {
+		// Default: send as form-urlencoded
+		form := url.Values{}
+		for k, v := range payload {
+			form.Set(k, v)
+		}
+		return []byte(form.Encode()), "application/x-www-form-urlencoded", nil
+	}
+
+	// The original payload is a map[string]string, but we want to send the postmap (map[string]interface{})
+	// So we try to decode the jsonData field if it exists, otherwise we send the original payload
+	var jsonBody interface{} = payload
+	eventType := ""
+	if jsonStr, ok := payload["jsonData"]; ok {
+		var postmap map[string]interface{}
+		err := json.Unmarshal([]byte(jsonStr), &postmap)
+		if err == nil {
+			postmap["token"] = payload["token"]
+			if t, ok := postmap["type"].(string); ok {
+				eventType = t
+			}
+			jsonBody = postmap
+		}
+	}
+
+	contentType := "application/json"
+	if format == webhookFormatCloudEvents {
+		// CloudEvents 1.0 structured mode, the event goes in data
+		eventID := opts.DeliveryID
+		if eventID == "" {
+			eventID, _ = GenerateRandomID()
+		}
+		if eventType == "" {
+			eventType = "Unknown"
+		}
+		envelope := map[string]interface{}{
+			"specversion":     "1.0",
+			"id":              eventID,
+			"source":          "/wuzapi/users/" + id,
+			"type":            "wuzapi." + eventType,
+			"time":            time.Now().UTC().Format(time.RFC3339Nano),
+			"datacontenttype": "application/json",
+			"data":            jsonBody,
+		}
+		if name := payload["instanceName"]; name != "" {
+			envelope["instancename"] = name
+		}
+		jsonBody = envelope
+		contentType = "application/cloudevents+json"
+	}
+
+	data, err := json.Marshal(jsonBody)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode webhook body: %w", err)
+	}
+	return data, contentType, nil
+}
+
+// webhookResponse is what the receiver answered to a single webhook request
+type webhookResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Latency    time.Duration
+}
+
+// newWebhookResponse captures a resty response; resp is nil when the request never got an answer
+func newWebhookResponse(resp *resty.Response, started time.Time) *webhookResponse {
+	result := &webhookResponse{Latency: time.Since(started)}
+	if resp != nil {
+		result.StatusCode = resp.StatusCode()
+		result.Header = resp.Header()
+		result.Body = resp.Body()
+	}
+	return result
+}
+
 // webhook for regular messages
-func callHook(myurl string, payload map[string]string, id string) {
+func callHook(myurl string, payload map[string]string, id string, opts webhookOptions) (*webhookResponse, error) {
 	log.Info().Str("url", myurl).Msg("Sending POST to client " + id)
 
 	// Log the payload map
@@ -38,43 +207,40 @@ func callHook(myurl string, payload map[string]string, id string) {
 		log.Debug().Str(key, value).Msg("")
 	}
 
-	client := clientManager.GetHTTPClient(id)
-
-	format := os.Getenv("WEBHOOK_FORMAT")
-	if format == "json" {
-		// Send as pure JSON
-		// The original payload is a map[string]string, but we want to send the postmap (map[string]interface{})
-		// So we try to decode the jsonData field if it exists, otherwise we send the original payload
-		var body interface{} = payload
-		if jsonStr, ok := payload["jsonData"]; ok {
-			var postmap map[string]interface{}
-			err := json.Unmarshal([]byte(jsonStr), &postmap)
-			if err == nil {
-				postmap["token"] = payload["token"]
-				body = postmap
-			}
-		}
-		_, err := client.R().
-			SetHeader("Content-Type", "application/json").
-			SetBody(body).
-			Post(myurl)
-		if err != nil {
-			log.Debug().Str("error", err.Error())
-		}
-	} else {
-		// Default: send as form-urlencoded
-		_, err := client.R().SetFormData(payload).Post(myurl)
-		if err != nil {
-			log.Debug().Str("error", err.Error())
-		}
+	client := getWebhookHTTPClient(id)
+
+	// The body is serialized here so the signature covers the exact bytes that are sent
+	body, contentType, err := buildWebhookBody(payload, id, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	req := client.R().
+		SetHeaders(opts.Headers).
+		SetHeader("Content-Type", contentType).
+		SetBody(body)
+	if opts.Secret != "" {
+		req.SetHeaders(webhookSignatureHeaders(opts.Secret, body))
+	}
+
+	started := time.Now()
+	resp, err := req.Post(myurl)
+	result := newWebhookResponse(resp, started)
+	if err != nil {
+		log.Debug().Str("error", err.Error()).Msg("Webhook POST failed")
+		return result, err
 	}
+	if !resp.IsSuccess() {
+		return result, fmt.Errorf("%w: %d", errWebhookStatus, resp.StatusCode())
+	}
+	return result, nil
 }
 
 // webhook for messages with file attachments
-func callHookFile(myurl string, payload map[string]string, id string, file string) error {
+func callHookFile(myurl string, payload map[string]string, id string, file string, opts webhookOptions) (*webhookResponse, error) {
 	log.Info().Str("file", file).Str("url", myurl).Msg("Sending POST")
 
-	client := clientManager.GetHTTPClient(id)
+	client := getWebhookHTTPClient(id)
 
 	// Create final payload map
 	finalPayload := make(map[string]string)
@@ -86,34 +252,155 @@ func callHookFile(myurl string, payload map[string]string, id string, file strin
 
 	log.Debug().Interface("finalPayload", finalPayload).Msg("Final payload to be sent")
 
-	resp, err := client.R().
-		SetFiles(map[string]string{
-			"file": file,
-		}).
-		SetFormData(finalPayload).
-		Post(myurl)
+	// The multipart body is built here rather than by resty, so the signature covers the exact bytes sent
+	body, contentType, err := webhookMultipartBody(finalPayload, file)
+	if err != nil {
+		log.Error().Err(err).Str("file", file).Msg("Failed to build multipart body")
+		return newWebhookResponse(nil, time.Now()), fmt.Errorf("failed to build multipart body: %w", err)
+	}
+	req := client.R().
+		SetHeaders(opts.Headers).
+		SetHeader("Content-Type", contentType).
+		SetBody(body)
+	if opts.Secret != "" {
+		req.SetHeaders(webhookSignatureHeaders(opts.Secret, body))
+	}
+
+	started := time.Now()
+	resp, err := req.Post(myurl)
+	result := newWebhookResponse(resp, started)
 
 	if err != nil {
 		log.Error().Err(err).Str("url", myurl).Msg("Failed to send POST request")
-		return fmt.Errorf("failed to send POST request: %w", err)
+		return result, fmt.Errorf("failed to send POST request: %w", err)
 	}
 
 	log.Debug().Interface("payload", finalPayload).Msg("Payload sent to webhook")
 	log.Info().Int("status", resp.StatusCode()).Str("body", string(resp.Body())).Msg("POST request completed")
 
-	return nil
+	if !resp.IsSuccess() {
+		return result, fmt.Errorf("%w: %d", errWebhookStatus, resp.StatusCode())
+	}
+	return result, nil
 }
 
+// webhookMultipartBody encodes the form fields, in a stable order, and the file of a webhook request
+func webhookMultipartBody(fields map[string]string, file string) ([]byte, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := w.WriteField(k, fields[k]); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// The part's content type is sniffed from the start of the file
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, "", err
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(filepath.Base(file))))
+	header.Set("Content-Type", http.DetectContentType(head[:n]))
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := part.Write(head[:n]); err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), w.FormDataContentType(), nil
+}
+
+// webhookSignatureHeaders signs "<timestamp>.<body>" with HMAC-SHA256 so receivers can verify
+// the sender and reject requests with an old timestamp
+func webhookSignatureHeaders(secret string, body []byte) map[string]string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return map[string]string{
+		"X-Wuzapi-Timestamp": timestamp,
+		"X-Wuzapi-Signature": "sha256=" + hex.EncodeToString(mac.Sum(nil)),
+	}
+}
+
+// getWebhookOptions loads the delivery settings for a user webhook, or the global webhook when webhookID is empty
+func getWebhookOptions(db *sqlx.DB, webhookID string) (webhookOptions, error) {
+	if webhookID == "" {
+		return webhookOptions{Secret: *globalWebhookSecret}, nil
+	}
+	var hook UserWebhook
+	err := db.Get(&hook, "SELECT "+userWebhookColumns+" FROM user_webhooks WHERE id=$1", webhookID)
+	if err != nil {
+		return webhookOptions{}, err
+	}
+	return webhookOptions{Secret: hook.Secret, Format: hook.Format, Headers: decodeWebhookHeaders(hook.Headers)}, nil
+}
+
+var defaultWebhookClient = resty.New().SetTimeout(30 * time.Second)
+
+// getWebhookHTTPClient returns the user's HTTP client, or a shared one when the user has no active session
+func getWebhookHTTPClient(id string) *resty.Client {
+	if client := clientManager.GetHTTPClient(id); client != nil {
+		return client
+	}
+	return defaultWebhookClient
+}
+
+// Columns selected whenever a UserWebhook is loaded
+const userWebhookColumns = "id, user_id, url, events, secret, format, headers, filters, ordered, " +
+	"health, consecutive_failures, last_error, last_error_at, last_success_at, paused_until"
+
 type UserWebhook struct {
-	ID     string `db:"id"`
-	UserID string `db:"user_id"`
-	URL    string `db:"url"`
-	Events string `db:"events"`
+	ID      string `db:"id"`
+	UserID  string `db:"user_id"`
+	URL     string `db:"url"`
+	Events  string `db:"events"`
+	Secret  string `db:"secret"`
+	Format  string `db:"format"`
+	Headers string `db:"headers"`
+	Filters string `db:"filters"`
+	Ordered bool   `db:"ordered"`
+	// Delivery health maintained by the webhook queue
+	Health              string `db:"health"`
+	ConsecutiveFailures int    `db:"consecutive_failures"`
+	LastError           string `db:"last_error"`
+	LastErrorAt         int64  `db:"last_error_at"`
+	LastSuccessAt       int64  `db:"last_success_at"`
+	PausedUntil         int64  `db:"paused_until"`
+}
+
+// maskSecret hides a stored secret in API responses while showing whether one is set
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "***"
 }
 
 func getUserWebhooks(db *sqlx.DB, userID string) ([]UserWebhook, error) {
 	hooks := []UserWebhook{}
-	err := db.Select(&hooks, "SELECT id, user_id, url, events FROM user_webhooks WHERE user_id=$1", userID)
+	err := db.Select(&hooks, "SELECT "+userWebhookColumns+" FROM user_webhooks WHERE user_id=$1", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -144,7 +431,7 @@ func getUserSubscribedEvents(db *sqlx.DB, userID string) ([]string, error) {
 	return result, nil
 }
 
-func dispatchUserWebhooks(db *sqlx.DB, userID, token, eventType string, jsonData []byte, path string) {
+func dispatchUserWebhooks(db *sqlx.DB, userID, token, eventType string, jsonData []byte, path string, evtCtx webhookEventContext) {
 	hooks, err := getUserWebhooks(db, userID)
 	if err != nil {
 		log.Warn().Err(err).Str("userID", userID).Msg("Could not get user webhooks")
@@ -163,22 +450,25 @@ func dispatchUserWebhooks(db *sqlx.DB, userID, token, eventType string, jsonData
 				continue
 			}
 		}
-
-		data := map[string]string{
-			"jsonData":     string(jsonData),
-			"token":        token,
-			"instanceName": instanceName,
+		if !decodeWebhookFilters(h.Filters).Match(evtCtx) {
+			log.Debug().Str("webhookID", h.ID).Str("eventType", eventType).Msg("Event filtered out for webhook")
+			continue
 		}
 
-		if path == "" {
-			go callHook(h.URL, data, userID)
-		} else {
-			go func(url string) {
-				if err := callHookFile(url, data, userID, path); err != nil {
-					log.Error().Err(err).Str("url", url).Msg("Error calling hook file")
-				}
-			}(h.URL)
+		chatJID := ""
+		if h.Ordered && evtCtx.HasChat {
+			chatJID = evtCtx.Chat.ToNonAD().String()
 		}
+		enqueueWebhook(userID, h.ID, h.URL, eventType, userWebhookPayload(jsonData, token, instanceName), path, chatJID)
+	}
+}
+
+// userWebhookPayload builds the fields posted to user webhooks for an event
+func userWebhookPayload(jsonData []byte, token, instanceName string) map[string]string {
+	return map[string]string{
+		"jsonData":     string(jsonData),
+		"token":        token,
+		"instanceName": instanceName,
 	}
 }
 
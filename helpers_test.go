@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// checkWebhookSignature verifies the signature headers of a request against its raw body
+func checkWebhookSignature(t *testing.T, secret string, header http.Header, body []byte) {
+	t.Helper()
+	timestamp := header.Get("X-Wuzapi-Timestamp")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := header.Get("X-Wuzapi-Signature"); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+}
+
+func TestWebhookSignatureHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+	}{
+		{"json body", "secret", `{"type":"Message"}`},
+		{"form body", "secret", "jsonData=%7B%7D&token=abc"},
+		{"empty body", "secret", ""},
+		{"other secret", "another secret", `{"type":"Message"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := webhookSignatureHeaders(tt.secret, []byte(tt.body))
+			header := http.Header{}
+			for k, v := range headers {
+				header.Set(k, v)
+			}
+			checkWebhookSignature(t, tt.secret, header, []byte(tt.body))
+
+			ts, err := strconv.ParseInt(headers["X-Wuzapi-Timestamp"], 10, 64)
+			if err != nil || time.Since(time.Unix(ts, 0)) > time.Minute {
+				t.Errorf("timestamp = %q, want the current Unix time", headers["X-Wuzapi-Timestamp"])
+			}
+		})
+	}
+
+	// A different secret gives a different signature for the same body
+	a := webhookSignatureHeaders("a", []byte("{}"))["X-Wuzapi-Signature"]
+	b := webhookSignatureHeaders("b", []byte("{}"))["X-Wuzapi-Signature"]
+	if a == b {
+		t.Error("signatures with different secrets are equal")
+	}
+}
+
+func TestCallHookFileSignsMultipartBody(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(file, []byte("\xff\xd8\xff\xe0 not really a jpeg"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var header http.Header
+	var body []byte
+	var fields map[string][]string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err := r.ParseMultipartForm(1 << 20); err == nil {
+			fields = r.MultipartForm.Value
+		}
+	}))
+	defer receiver.Close()
+
+	payload := map[string]string{"jsonData": `{"type":"Message"}`, "token": "token"}
+	if _, err := callHookFile(receiver.URL, payload, "user", file, webhookOptions{Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	checkWebhookSignature(t, "secret", header, body)
+	if got := fields["jsonData"]; len(got) != 1 || got[0] != payload["jsonData"] {
+		t.Errorf("jsonData field = %v, want %q", got, payload["jsonData"])
+	}
+}
+
+func TestBuildWebhookBody(t *testing.T) {
+	event := map[string]string{"jsonData": `{"type":"Message","event":{"id":"1"}}`, "token": "token", "instanceName": "main"}
+	tests := []struct {
+		name            string
+		env             string // WEBHOOK_FORMAT
+		opts            webhookOptions
+		payload         map[string]string
+		wantContentType string
+		want            map[string]interface{} // top level fields of a JSON body
+		wantForm        map[string]string
+	}{
+		{
+			name:            "form by default",
+			payload:         event,
+			wantContentType: "application/x-www-form-urlencoded",
+			wantForm:        event,
+		},
+		{
+			name:            "json from the environment",
+			env:             webhookFormatJSON,
+			payload:         event,
+			wantContentType: "application/json",
+			want:            map[string]interface{}{"type": "Message", "token": "token"},
+		},
+		{
+			name:            "webhook format overrides the environment",
+			env:             webhookFormatJSON,
+			opts:            webhookOptions{Format: webhookFormatForm},
+			payload:         event,
+			wantContentType: "application/x-www-form-urlencoded",
+			wantForm:        event,
+		},
+		{
+			name:            "json without jsonData",
+			opts:            webhookOptions{Format: webhookFormatJSON},
+			payload:         map[string]string{"token": "token"},
+			wantContentType: "application/json",
+			want:            map[string]interface{}{"token": "token"},
+		},
+		{
+			name:            "json with undecodable jsonData",
+			opts:            webhookOptions{Format: webhookFormatJSON},
+			payload:         map[string]string{"jsonData": "{", "token": "token"},
+			wantContentType: "application/json",
+			want:            map[string]interface{}{"jsonData": "{", "token": "token"},
+		},
+		{
+			name:            "cloudevents",
+			opts:            webhookOptions{Format: webhookFormatCloudEvents, DeliveryID: "delivery"},
+			payload:         event,
+			wantContentType: "application/cloudevents+json",
+			want: map[string]interface{}{
+				"specversion":     "1.0",
+				"id":              "delivery",
+				"source":          "/wuzapi/users/user",
+				"type":            "wuzapi.Message",
+				"datacontenttype": "application/json",
+				"instancename":    "main",
+			},
+		},
+		{
+			name:            "cloudevents of an unknown type",
+			opts:            webhookOptions{Format: webhookFormatCloudEvents, DeliveryID: "delivery"},
+			payload:         map[string]string{"token": "token"},
+			wantContentType: "application/cloudevents+json",
+			want:            map[string]interface{}{"type": "wuzapi.Unknown"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WEBHOOK_FORMAT", tt.env)
+			body, contentType, err := buildWebhookBody(tt.payload, "user", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != tt.wantContentType {
+				t.Errorf("content type = %q, want %q", contentType, tt.wantContentType)
+			}
+			if tt.wantForm != nil {
+				form, err := url.ParseQuery(string(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k, v := range tt.wantForm {
+					if form.Get(k) != v {
+						t.Errorf("form field %s = %q, want %q", k, form.Get(k), v)
+					}
+				}
+				return
+			}
+			got := map[string]interface{}{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("body is not JSON: %s", body)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildWebhookBodyCloudEventsData(t *testing.T) {
+	payload := map[string]string{"jsonData": `{"type":"Message","event":{"id":"1"}}`, "token": "token"}
+	body, _, err := buildWebhookBody(payload, "user", webhookOptions{Format: webhookFormatCloudEvents})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope struct {
+		ID   string                 `json:"id"`
+		Time string                 `json:"time"`
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	// Without a delivery the event gets an id of its own
+	if envelope.ID == "" {
+		t.Error("event has no id")
+	}
+	if _, err := time.Parse(time.RFC3339Nano, envelope.Time); err != nil {
+		t.Errorf("time %q: %v", envelope.Time, err)
+	}
+	if envelope.Data["type"] != "Message" || envelope.Data["token"] != "token" {
+		t.Errorf("data = %v, want the event with its token", envelope.Data)
+	}
+}
+
+func TestValidateWebhookSettings(t *testing.T) {
+	tests := []struct {
+		format  string
+		headers map[string]string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{webhookFormatForm, nil, false},
+		{webhookFormatJSON, map[string]string{"Authorization": "Bearer x"}, false},
+		{webhookFormatCloudEvents, map[string]string{"X-Custom": "1"}, false},
+		{"xml", nil, true},
+		{"", map[string]string{"Bad Header": "1"}, true},
+		{"", map[string]string{"": "1"}, true},
+		{"", map[string]string{"content-type": "text/plain"}, true},
+		{"", map[string]string{"X-Wuzapi-Signature": "forged"}, true},
+	}
+	for _, tt := range tests {
+		if err := validateWebhookSettings(tt.format, tt.headers); (err != nil) != tt.wantErr {
+			t.Errorf("validateWebhookSettings(%q, %v) error = %v, want error %v", tt.format, tt.headers, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// historySyncTotals adds up the chunks of a history sync until it completes
+type historySyncTotals struct {
+	Chunks        int
+	Conversations int
+	Messages      int
+	Stored        int
+}
+
+var (
+	historySyncMu    sync.Mutex
+	historySyncState = make(map[string]*historySyncTotals)
+)
+
+// historyMessageStatus maps the delivery status kept by the phone to the status of stored messages
+func historyMessageStatus(webMsg *waWeb.WebMessageInfo, isFromMe bool) string {
+	if !isFromMe {
+		return messageStatusReceived
+	}
+	switch webMsg.GetStatus() {
+	case waWeb.WebMessageInfo_DELIVERY_ACK:
+		return messageStatusDelivered
+	case waWeb.WebMessageInfo_READ:
+		return messageStatusRead
+	case waWeb.WebMessageInfo_PLAYED:
+		return messageStatusPlayed
+	}
+	return messageStatusSent
+}
+
+// historySyncComplete reports whether a chunk is the last one of its sync. Recent and full syncs count up to 100%,
+// the other types (the initial bootstrap after pairing, on demand syncs, push names...) are complete with each chunk.
+func historySyncComplete(data *waHistorySync.HistorySync) bool {
+	switch data.GetSyncType() {
+	case waHistorySync.HistorySync_RECENT, waHistorySync.HistorySync_FULL:
+		return data.GetProgress() >= 100
+	}
+	return true
+}
+
+// Number of history sync messages written per transaction
+const historySyncBatchSize = 500
+
+// historySyncBatch writes history sync messages in transactions of historySyncBatchSize messages, so the
+// SQLite write lock is released regularly for the other writers (webhook queue, incoming messages)
+type historySyncBatch struct {
+	db      *sqlx.DB
+	tx      *sqlx.Tx
+	pending int
+}
+
+// begin returns the open transaction, starting one if needed
+func (b *historySyncBatch) begin() (*sqlx.Tx, error) {
+	if b.tx == nil {
+		tx, err := b.db.Beginx()
+		if err != nil {
+			return nil, err
+		}
+		b.tx = tx
+	}
+	return b.tx, nil
+}
+
+// added counts a message written in the open transaction and commits it once the batch is full.
+// It returns the number of messages lost if the commit fails.
+func (b *historySyncBatch) added() int {
+	b.pending++
+	if b.pending < historySyncBatchSize {
+		return 0
+	}
+	return b.flush()
+}
+
+// flush commits the open transaction, it returns the number of messages lost if the commit fails
+func (b *historySyncBatch) flush() int {
+	if b.tx == nil {
+		return 0
+	}
+	lost := 0
+	if err := b.tx.Commit(); err != nil {
+		log.Error().Err(err).Int("messages", b.pending).Msg("Failed to commit history sync messages")
+		lost = b.pending
+	}
+	b.tx, b.pending = nil, 0
+	return lost
+}
+
+// ingestHistorySync adds the conversations of a history sync chunk to the chat list, stores their messages
+// when the user keeps their messages, and reports the progress of the sync with HistorySyncProgress and HistorySyncComplete events
+func (mycli *MyClient) ingestHistorySync(evt *events.HistorySync) {
+	data := evt.Data
+	syncType := data.GetSyncType().String()
+	store := messageStoreEnabled(mycli.db, mycli.userID)
+
+	// A chunk can hold thousands of messages, they are written in batches
+	batch := &historySyncBatch{db: mycli.db}
+
+	conversations, messages, stored := 0, 0, 0
+	for _, conv := range data.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetID())
+		if err != nil {
+			log.Warn().Err(err).Str("chat", conv.GetID()).Msg("Skipping history sync conversation with invalid JID")
+			continue
+		}
+		conversations++
+		var last *storedMessage
+		for _, historyMsg := range conv.GetMessages() {
+			webMsg := historyMsg.GetMessage()
+			if webMsg == nil {
+				continue
+			}
+			msgEvt, err := mycli.WAClient.ParseWebMessage(chatJID, webMsg)
+			if err != nil {
+				log.Debug().Err(err).Str("chat", chatJID.String()).Msg("Skipping history sync message")
+				continue
+			}
+			messages++
+			if msgEvt.Message == nil {
+				continue
+			}
+			content := eventMessageContent(msgEvt)
+			m := newStoredMessage(msgEvt.Info, msgEvt.Message, content, historyMessageStatus(webMsg, msgEvt.Info.IsFromMe))
+			if isChatPreview(msgEvt.Message, content) && (last == nil || m.Timestamp > last.Timestamp) {
+				last = &m
+			}
+			if !store {
+				continue
+			}
+			tx, err := batch.begin()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to start history sync transaction")
+				continue
+			}
+			if err := saveMessage(tx, mycli.userID, m, content); err != nil {
+				log.Error().Err(err).Str("id", msgEvt.Info.ID).Msg("Failed to store history sync message")
+				continue
+			}
+			stored++
+			stored -= batch.added()
+		}
+		// Chats are written within the open transaction, SQLite would otherwise wait for it to finish
+		var exec sqlx.Execer = mycli.db
+		if batch.tx != nil {
+			exec = batch.tx
+		}
+		withState := data.GetSyncType() != waHistorySync.HistorySync_ON_DEMAND
+		if err := recordHistoryChat(exec, mycli.userID, chatJID, conv, last, withState, store); err != nil {
+			log.Error().Err(err).Str("chat", chatJID.String()).Msg("Failed to record history sync chat")
+		}
+	}
+	stored -= batch.flush()
+
+	historySyncMu.Lock()
+	key := mycli.userID + "|" + syncType
+	totals := historySyncState[key]
+	if totals == nil {
+		totals = &historySyncTotals{}
+		historySyncState[key] = totals
+	}
+	totals.Chunks++
+	totals.Conversations += conversations
+	totals.Messages += messages
+	totals.Stored += stored
+	summary := *totals
+	complete := historySyncComplete(data)
+	if complete {
+		delete(historySyncState, key)
+	}
+	historySyncMu.Unlock()
+
+	log.Info().Str("syncType", syncType).Uint32("chunk", data.GetChunkOrder()).Uint32("progress", data.GetProgress()).
+		Int("conversations", conversations).Int("messages", messages).Int("stored", stored).Msg("History sync chunk processed")
+
+	sendEventWithWebHook(mycli, map[string]interface{}{
+		"type": "HistorySyncProgress",
+		"event": map[string]interface{}{
+			"syncType":      syncType,
+			"chunkOrder":    data.GetChunkOrder(),
+			"progress":      data.GetProgress(),
+			"conversations": conversations,
+			"messages":      messages,
+			"stored":        stored,
+		},
+	}, "")
+	if complete {
+		sendEventWithWebHook(mycli, map[string]interface{}{
+			"type": "HistorySyncComplete",
+			"event": map[string]interface{}{
+				"syncType":      syncType,
+				"chunks":        summary.Chunks,
+				"conversations": summary.Conversations,
+				"messages":      summary.Messages,
+				"stored":        summary.Stored,
+			},
+		}, "")
+	}
+}
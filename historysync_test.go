@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHistorySyncComplete(t *testing.T) {
+	tests := []struct {
+		syncType waHistorySync.HistorySync_HistorySyncType
+		progress uint32
+		want     bool
+	}{
+		{waHistorySync.HistorySync_INITIAL_BOOTSTRAP, 0, true},
+		{waHistorySync.HistorySync_RECENT, 40, false},
+		{waHistorySync.HistorySync_RECENT, 100, true},
+		{waHistorySync.HistorySync_FULL, 99, false},
+		{waHistorySync.HistorySync_FULL, 100, true},
+		{waHistorySync.HistorySync_ON_DEMAND, 0, true},
+		{waHistorySync.HistorySync_PUSH_NAME, 0, true},
+	}
+	for _, tt := range tests {
+		data := &waHistorySync.HistorySync{SyncType: tt.syncType.Enum(), Progress: proto.Uint32(tt.progress)}
+		if got := historySyncComplete(data); got != tt.want {
+			t.Errorf("historySyncComplete(%s at %d%%) = %v, want %v", tt.syncType, tt.progress, got, tt.want)
+		}
+	}
+}
+
+func TestHistorySyncBatch(t *testing.T) {
+	db := newTestDB(t)
+	batch := &historySyncBatch{db: db}
+
+	total := historySyncBatchSize*2 + 1
+	for i := 0; i < total; i++ {
+		tx, err := batch.begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := storedMessage{ID: fmt.Sprintf("M%d", i), Chat: "123@s.whatsapp.net", Type: "text", Status: messageStatusReceived}
+		if err := saveMessage(tx, "user", m, messageContent{Kind: "text"}); err != nil {
+			t.Fatal(err)
+		}
+		if lost := batch.added(); lost != 0 {
+			t.Fatalf("lost %d messages", lost)
+		}
+		// Full batches are committed right away
+		if i+1 == historySyncBatchSize && batch.tx != nil {
+			t.Fatal("batch not committed once full")
+		}
+	}
+	if lost := batch.flush(); lost != 0 {
+		t.Fatalf("lost %d messages", lost)
+	}
+
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM messages WHERE user_id=$1", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if count != total {
+		t.Fatalf("stored %d messages, want %d", count, total)
+	}
+}
@@ -34,18 +34,19 @@ type server struct {
 
 // Replace the global variables
 var (
-	address       = flag.String("address", "0.0.0.0", "Bind IP Address")
-	port          = flag.String("port", "8080", "Listen Port")
-	waDebug       = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
-	logType       = flag.String("logtype", "console", "Type of log output (console or json)")
-	skipMedia     = flag.Bool("skipmedia", false, "Do not attempt to download media in messages")
-	osName        = flag.String("osname", "Mac OS 10", "Connection OSName in Whatsapp")
-	colorOutput   = flag.Bool("color", false, "Enable colored output for console logs")
-	sslcert       = flag.String("sslcertificate", "", "SSL Certificate File")
-	sslprivkey    = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
-	adminToken    = flag.String("admintoken", "", "Security Token to authorize admin actions (list/create/remove users)")
-	globalWebhook = flag.String("globalwebhook", "", "Global webhook URL to receive all events from all users")
-	versionFlag   = flag.Bool("version", false, "Display version information and exit")
+	address             = flag.String("address", "0.0.0.0", "Bind IP Address")
+	port                = flag.String("port", "8080", "Listen Port")
+	waDebug             = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
+	logType             = flag.String("logtype", "console", "Type of log output (console or json)")
+	skipMedia           = flag.Bool("skipmedia", false, "Do not attempt to download media in messages")
+	osName              = flag.String("osname", "Mac OS 10", "Connection OSName in Whatsapp")
+	colorOutput         = flag.Bool("color", false, "Enable colored output for console logs")
+	sslcert             = flag.String("sslcertificate", "", "SSL Certificate File")
+	sslprivkey          = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
+	adminToken          = flag.String("admintoken", "", "Security Token to authorize admin actions (list/create/remove users)")
+	globalWebhook       = flag.String("globalwebhook", "", "Global webhook URL to receive all events from all users")
+	globalWebhookSecret = flag.String("globalwebhooksecret", "", "Secret used to sign requests sent to the global webhook")
+	versionFlag         = flag.Bool("version", false, "Display version information and exit")
 
 	container        *sqlstore.Container
 	clientManager    = NewClientManager()
@@ -56,7 +57,9 @@ var (
 
 const version = "1.0.2"
 
-func init() {
+// loadConfig reads the environment and the command line flags and sets up logging. It runs first in main
+// rather than in init, so test binaries can parse their own flags.
+func loadConfig() {
 	err := godotenv.Load()
 	if err != nil {
 		log.Warn().Err(err).Msg("It was not possible to load the .env file (it may not exist).")
@@ -148,10 +151,18 @@ func init() {
 		log.Info().Str("global_webhook", *globalWebhook).Msg("Global webhook configured from command line")
 	}
 
+	if *globalWebhookSecret == "" {
+		if v := os.Getenv("WUZAPI_GLOBAL_WEBHOOK_SECRET"); v != "" {
+			*globalWebhookSecret = v
+		}
+	}
+
 	InitRabbitMQ()
 }
 
 func main() {
+	loadConfig()
+
 	ex, err := os.Executable()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to get executable path")
@@ -181,6 +192,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Start the persistent webhook delivery queue
+	InitWebhookQueue(db)
+
+	// Live event feed for the SSE stream
+	eventBroker = NewEventBroker(getEnvInt("EVENT_STREAM_BUFFER", 100))
+
+	// Webhooks, RabbitMQ, NATS and Redis
+	InitEventSinks(db)
+
 	var dbLog waLog.Logger
 	if *waDebug != "" {
 		dbLog = waLog.Stdout("Database", *waDebug, *colorOutput)
@@ -196,7 +216,7 @@ func main() {
 		)
 		container, err = sqlstore.New(context.Background(), "postgres", storeConnStr, dbLog)
 	} else {
-		storeConnStr = "file:" + filepath.Join(config.Path, "main.db") + "?_pragma=foreign_keys(1)&_busy_timeout=3000"
+		storeConnStr = "file:" + filepath.Join(config.Path, "main.db") + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(3000)"
 		container, err = sqlstore.New(context.Background(), "sqlite", storeConnStr, dbLog)
 	}
 
@@ -214,6 +234,15 @@ func main() {
 
 	s.connectOnStartup()
 
+	// Commands sent over RabbitMQ need the server to run the REST handlers
+	s.StartRabbitCommands()
+
+	// Broadcasts interrupted by a restart carry on where they stopped
+	s.StartBroadcasts()
+
+	// Scheduled messages that came due while the server was stopped are sent now
+	s.StartScheduler()
+
 	srv := &http.Server{
 		Addr:              *address + ":" + *port,
 		Handler:           s.router,
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// messageContent is the "content" of Message events: what the message says, without the protobuf layout.
+// Kind is one of the message_types filter values, or edit or revoke.
+type messageContent struct {
+	Kind      string           `json:"kind"`
+	Text      string           `json:"text,omitempty"`
+	Quoted    *messageTarget   `json:"quoted,omitempty"`
+	Mentions  []string         `json:"mentions,omitempty"`
+	Media     *mediaContent    `json:"media,omitempty"`
+	Location  *locationContent `json:"location,omitempty"`
+	Contacts  []contactContent `json:"contacts,omitempty"`
+	Poll      *pollContent     `json:"poll,omitempty"`
+	PollVote  *messageTarget   `json:"pollVote,omitempty"`
+	Reaction  *reactionContent `json:"reaction,omitempty"`
+	Edit      *messageTarget   `json:"edit,omitempty"`
+	Revoke    *messageTarget   `json:"revoke,omitempty"`
+	ViewOnce  bool             `json:"viewOnce"`
+	Ephemeral bool             `json:"ephemeral"`
+	Forwarded bool             `json:"forwarded"`
+}
+
+// messageTarget points at another message: the one quoted, reacted to, edited, revoked or voted on
+type messageTarget struct {
+	ID          string `json:"id"`
+	Chat        string `json:"chat,omitempty"`
+	Participant string `json:"participant,omitempty"`
+	FromMe      bool   `json:"fromMe"`
+}
+
+type mediaContent struct {
+	MimeType string `json:"mimeType"`
+	FileName string `json:"fileName,omitempty"`
+	Size     uint64 `json:"size,omitempty"`
+	Seconds  uint32 `json:"seconds,omitempty"`
+	Width    uint32 `json:"width,omitempty"`
+	Height   uint32 `json:"height,omitempty"`
+	PTT      bool   `json:"ptt,omitempty"`
+	Animated bool   `json:"animated,omitempty"`
+}
+
+type locationContent struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+	URL       string  `json:"url,omitempty"`
+	Live      bool    `json:"live"`
+}
+
+type contactContent struct {
+	DisplayName string `json:"displayName"`
+	VCard       string `json:"vcard"`
+}
+
+type pollContent struct {
+	Name            string   `json:"name"`
+	Options         []string `json:"options"`
+	SelectableCount uint32   `json:"selectableCount"`
+}
+
+type reactionContent struct {
+	Target  messageTarget `json:"target"`
+	Emoji   string        `json:"emoji,omitempty"`
+	Removed bool          `json:"removed"`
+}
+
+// eventMessageContent builds the content of a received message, flags included
+func eventMessageContent(evt *events.Message) messageContent {
+	content := buildMessageContent(evt.Message)
+	content.ViewOnce = evt.IsViewOnce
+	content.Ephemeral = evt.IsEphemeral
+	return content
+}
+
+func buildMessageContent(msg *waE2E.Message) messageContent {
+	if pm := msg.GetProtocolMessage(); pm != nil {
+		switch pm.GetType() {
+		case waE2E.ProtocolMessage_REVOKE:
+			return messageContent{Kind: "revoke", Revoke: keyTarget(pm.GetKey())}
+		case waE2E.ProtocolMessage_MESSAGE_EDIT:
+			// The edit carries the new version of the message, described like any other
+			content := buildMessageContent(pm.GetEditedMessage())
+			content.Kind = "edit"
+			content.Edit = keyTarget(pm.GetKey())
+			return content
+		}
+	}
+
+	content := messageContent{Kind: getMessageType(msg)}
+	switch {
+	case msg.GetConversation() != "":
+		content.Text = msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		content.Text = msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		img := msg.GetImageMessage()
+		content.Text = img.GetCaption()
+		content.Media = &mediaContent{MimeType: img.GetMimetype(), Size: img.GetFileLength(), Width: img.GetWidth(), Height: img.GetHeight()}
+	case msg.GetVideoMessage() != nil || msg.GetPtvMessage() != nil:
+		video := msg.GetVideoMessage()
+		if video == nil {
+			video = msg.GetPtvMessage()
+		}
+		content.Text = video.GetCaption()
+		content.Media = &mediaContent{MimeType: video.GetMimetype(), Size: video.GetFileLength(), Seconds: video.GetSeconds(), Width: video.GetWidth(), Height: video.GetHeight(), Animated: video.GetGifPlayback()}
+	case msg.GetAudioMessage() != nil:
+		audio := msg.GetAudioMessage()
+		content.Media = &mediaContent{MimeType: audio.GetMimetype(), Size: audio.GetFileLength(), Seconds: audio.GetSeconds(), PTT: audio.GetPTT()}
+	case msg.GetDocumentMessage() != nil:
+		doc := msg.GetDocumentMessage()
+		content.Text = doc.GetCaption()
+		content.Media = &mediaContent{MimeType: doc.GetMimetype(), FileName: doc.GetFileName(), Size: doc.GetFileLength()}
+	case msg.GetStickerMessage() != nil:
+		sticker := msg.GetStickerMessage()
+		content.Media = &mediaContent{MimeType: sticker.GetMimetype(), Size: sticker.GetFileLength(), Width: sticker.GetWidth(), Height: sticker.GetHeight(), Animated: sticker.GetIsAnimated()}
+	case msg.GetLocationMessage() != nil:
+		loc := msg.GetLocationMessage()
+		content.Location = &locationContent{
+			Latitude:  loc.GetDegreesLatitude(),
+			Longitude: loc.GetDegreesLongitude(),
+			Name:      loc.GetName(),
+			Address:   loc.GetAddress(),
+			URL:       loc.GetURL(),
+			Live:      loc.GetIsLive(),
+		}
+	case msg.GetLiveLocationMessage() != nil:
+		loc := msg.GetLiveLocationMessage()
+		content.Text = loc.GetCaption()
+		content.Location = &locationContent{Latitude: loc.GetDegreesLatitude(), Longitude: loc.GetDegreesLongitude(), Live: true}
+	case msg.GetContactMessage() != nil:
+		contact := msg.GetContactMessage()
+		content.Contacts = []contactContent{{DisplayName: contact.GetDisplayName(), VCard: contact.GetVcard()}}
+	case msg.GetContactsArrayMessage() != nil:
+		for _, contact := range msg.GetContactsArrayMessage().GetContacts() {
+			content.Contacts = append(content.Contacts, contactContent{DisplayName: contact.GetDisplayName(), VCard: contact.GetVcard()})
+		}
+	case msg.GetReactionMessage() != nil:
+		reaction := msg.GetReactionMessage()
+		content.Reaction = &reactionContent{Emoji: reaction.GetText(), Removed: reaction.GetText() == ""}
+		if target := keyTarget(reaction.GetKey()); target != nil {
+			content.Reaction.Target = *target
+		}
+	case msg.GetEncReactionMessage() != nil:
+		// Reactions to community announcements are encrypted, only the target is known
+		content.Reaction = &reactionContent{}
+		if target := keyTarget(msg.GetEncReactionMessage().GetTargetMessageKey()); target != nil {
+			content.Reaction.Target = *target
+		}
+	case content.Kind == "poll":
+		poll := msg.GetPollCreationMessage()
+		if poll == nil {
+			poll = msg.GetPollCreationMessageV2()
+		}
+		if poll == nil {
+			poll = msg.GetPollCreationMessageV3()
+		}
+		content.Poll = &pollContent{Name: poll.GetName(), SelectableCount: poll.GetSelectableOptionsCount(), Options: []string{}}
+		for _, option := range poll.GetOptions() {
+			content.Poll.Options = append(content.Poll.Options, option.GetOptionName())
+		}
+	case msg.GetPollUpdateMessage() != nil:
+		content.PollVote = keyTarget(msg.GetPollUpdateMessage().GetPollCreationMessageKey())
+	}
+
+	if ctxInfo := messageContextInfo(msg); ctxInfo != nil {
+		if ctxInfo.GetStanzaID() != "" {
+			content.Quoted = &messageTarget{
+				ID:          ctxInfo.GetStanzaID(),
+				Chat:        ctxInfo.GetRemoteJID(),
+				Participant: ctxInfo.GetParticipant(),
+			}
+		}
+		content.Mentions = ctxInfo.GetMentionedJID()
+		content.Forwarded = ctxInfo.GetIsForwarded()
+	}
+	return content
+}
+
+// messageContextInfo returns the context info (quote, mentions, forwarding) of the part of the message that carries it
+func messageContextInfo(msg *waE2E.Message) *waE2E.ContextInfo {
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetContextInfo()
+	case msg.GetPtvMessage() != nil:
+		return msg.GetPtvMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetContextInfo()
+	case msg.GetLocationMessage() != nil:
+		return msg.GetLocationMessage().GetContextInfo()
+	case msg.GetLiveLocationMessage() != nil:
+		return msg.GetLiveLocationMessage().GetContextInfo()
+	case msg.GetContactMessage() != nil:
+		return msg.GetContactMessage().GetContextInfo()
+	case msg.GetContactsArrayMessage() != nil:
+		return msg.GetContactsArrayMessage().GetContextInfo()
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage().GetContextInfo()
+	}
+	return nil
+}
+
+func keyTarget(key *waCommon.MessageKey) *messageTarget {
+	if key == nil {
+		return nil
+	}
+	return &messageTarget{
+		ID:          key.GetID(),
+		Chat:        key.GetRemoteJID(),
+		Participant: key.GetParticipant(),
+		FromMe:      key.GetFromMe(),
+	}
+}
+
+// includeRawMessage reports whether Message payloads keep the raw whatsmeow event, set with WEBHOOK_RAW_MESSAGE=true
+func includeRawMessage() bool {
+	v, _ := strconv.ParseBool(os.Getenv("WEBHOOK_RAW_MESSAGE"))
+	return v
+}
+
+// deliveryPayload is the postmap as sent to receivers: Message events go without the raw event
+// unless it was asked for, "info" and "content" describe them instead
+func deliveryPayload(postmap map[string]interface{}) map[string]interface{} {
+	if postmap["type"] != "Message" || includeRawMessage() {
+		return postmap
+	}
+	if _, ok := postmap["content"]; !ok {
+		return postmap
+	}
+	payload := make(map[string]interface{}, len(postmap))
+	for key, value := range postmap {
+		if key != "event" {
+			payload[key] = value
+		}
+	}
+	return payload
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBuildMessageContent(t *testing.T) {
+	key := &waCommon.MessageKey{ID: proto.String("3EB0A1"), RemoteJID: proto.String("5491155551234@s.whatsapp.net"), FromMe: proto.Bool(true)}
+	target := &messageTarget{ID: "3EB0A1", Chat: "5491155551234@s.whatsapp.net", FromMe: true}
+
+	tests := []struct {
+		name string
+		msg  *waE2E.Message
+		want messageContent
+	}{
+		{"nil", nil, messageContent{Kind: "other"}},
+		{"conversation", &waE2E.Message{Conversation: proto.String("hello")}, messageContent{Kind: "text", Text: "hello"}},
+		{
+			"reply with mentions",
+			&waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+				Text: proto.String("@1 look"),
+				ContextInfo: &waE2E.ContextInfo{
+					StanzaID:     proto.String("3EB0A1"),
+					Participant:  proto.String("1@s.whatsapp.net"),
+					MentionedJID: []string{"1@s.whatsapp.net"},
+					IsForwarded:  proto.Bool(true),
+				},
+			}},
+			messageContent{
+				Kind:      "text",
+				Text:      "@1 look",
+				Quoted:    &messageTarget{ID: "3EB0A1", Participant: "1@s.whatsapp.net"},
+				Mentions:  []string{"1@s.whatsapp.net"},
+				Forwarded: true,
+			},
+		},
+		{
+			"image",
+			&waE2E.Message{ImageMessage: &waE2E.ImageMessage{Caption: proto.String("cat"), Mimetype: proto.String("image/jpeg"), FileLength: proto.Uint64(100), Width: proto.Uint32(640), Height: proto.Uint32(480)}},
+			messageContent{Kind: "image", Text: "cat", Media: &mediaContent{MimeType: "image/jpeg", Size: 100, Width: 640, Height: 480}},
+		},
+		{
+			"round video",
+			&waE2E.Message{PtvMessage: &waE2E.VideoMessage{Mimetype: proto.String("video/mp4"), Seconds: proto.Uint32(7)}},
+			messageContent{Kind: "video", Media: &mediaContent{MimeType: "video/mp4", Seconds: 7}},
+		},
+		{
+			"voice note",
+			&waE2E.Message{AudioMessage: &waE2E.AudioMessage{Mimetype: proto.String("audio/ogg"), Seconds: proto.Uint32(3), PTT: proto.Bool(true)}},
+			messageContent{Kind: "audio", Media: &mediaContent{MimeType: "audio/ogg", Seconds: 3, PTT: true}},
+		},
+		{
+			"document",
+			&waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{Mimetype: proto.String("application/pdf"), FileName: proto.String("a.pdf"), FileLength: proto.Uint64(9)}},
+			messageContent{Kind: "document", Media: &mediaContent{MimeType: "application/pdf", FileName: "a.pdf", Size: 9}},
+		},
+		{
+			"animated sticker",
+			&waE2E.Message{StickerMessage: &waE2E.StickerMessage{Mimetype: proto.String("image/webp"), IsAnimated: proto.Bool(true)}},
+			messageContent{Kind: "sticker", Media: &mediaContent{MimeType: "image/webp", Animated: true}},
+		},
+		{
+			"location",
+			&waE2E.Message{LocationMessage: &waE2E.LocationMessage{DegreesLatitude: proto.Float64(-34.6), DegreesLongitude: proto.Float64(-58.4), Name: proto.String("Obelisco")}},
+			messageContent{Kind: "location", Location: &locationContent{Latitude: -34.6, Longitude: -58.4, Name: "Obelisco"}},
+		},
+		{
+			"live location",
+			&waE2E.Message{LiveLocationMessage: &waE2E.LiveLocationMessage{DegreesLatitude: proto.Float64(1), DegreesLongitude: proto.Float64(2), Caption: proto.String("here")}},
+			messageContent{Kind: "location", Text: "here", Location: &locationContent{Latitude: 1, Longitude: 2, Live: true}},
+		},
+		{
+			"contacts",
+			&waE2E.Message{ContactsArrayMessage: &waE2E.ContactsArrayMessage{Contacts: []*waE2E.ContactMessage{
+				{DisplayName: proto.String("Ana"), Vcard: proto.String("BEGIN:VCARD")},
+				{DisplayName: proto.String("Bob"), Vcard: proto.String("BEGIN:VCARD")},
+			}}},
+			messageContent{Kind: "contact", Contacts: []contactContent{{"Ana", "BEGIN:VCARD"}, {"Bob", "BEGIN:VCARD"}}},
+		},
+		{
+			"reaction",
+			&waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{Key: key, Text: proto.String("👍")}},
+			messageContent{Kind: "reaction", Reaction: &reactionContent{Target: *target, Emoji: "👍"}},
+		},
+		{
+			"reaction removed",
+			&waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{Key: key, Text: proto.String("")}},
+			messageContent{Kind: "reaction", Reaction: &reactionContent{Target: *target, Removed: true}},
+		},
+		{
+			"poll",
+			&waE2E.Message{PollCreationMessageV3: &waE2E.PollCreationMessage{
+				Name:                   proto.String("Lunch?"),
+				Options:                []*waE2E.PollCreationMessage_Option{{OptionName: proto.String("Yes")}, {OptionName: proto.String("No")}},
+				SelectableOptionsCount: proto.Uint32(1),
+			}},
+			messageContent{Kind: "poll", Poll: &pollContent{Name: "Lunch?", Options: []string{"Yes", "No"}, SelectableCount: 1}},
+		},
+		{
+			"poll vote",
+			&waE2E.Message{PollUpdateMessage: &waE2E.PollUpdateMessage{PollCreationMessageKey: key}},
+			messageContent{Kind: "poll_vote", PollVote: target},
+		},
+		{
+			"revoke",
+			&waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{Type: waE2E.ProtocolMessage_REVOKE.Enum(), Key: key}},
+			messageContent{Kind: "revoke", Revoke: target},
+		},
+		{
+			"edit",
+			&waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+				Type:          waE2E.ProtocolMessage_MESSAGE_EDIT.Enum(),
+				Key:           key,
+				EditedMessage: &waE2E.Message{Conversation: proto.String("fixed")},
+			}},
+			messageContent{Kind: "edit", Text: "fixed", Edit: target},
+		},
+		{
+			"other protocol message",
+			&waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{Type: waE2E.ProtocolMessage_EPHEMERAL_SETTING.Enum()}},
+			messageContent{Kind: "other"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildMessageContent(tt.msg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliveryPayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string // WEBHOOK_RAW_MESSAGE
+		postmap  map[string]interface{}
+		wantKeep bool // whether "event" is kept
+	}{
+		{"message", "", map[string]interface{}{"type": "Message", "event": 1, "content": 2}, false},
+		{"message with the raw event", "true", map[string]interface{}{"type": "Message", "event": 1, "content": 2}, true},
+		{"message without content", "", map[string]interface{}{"type": "Message", "event": 1}, true},
+		{"other event", "", map[string]interface{}{"type": "Receipt", "event": 1}, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("WEBHOOK_RAW_MESSAGE", tt.raw)
+		_, kept := deliveryPayload(tt.postmap)["event"]
+		if kept != tt.wantKeep {
+			t.Errorf("%s: event kept = %v, want %v", tt.name, kept, tt.wantKeep)
+		}
+		if _, ok := tt.postmap["event"]; !ok {
+			t.Errorf("%s: the postmap itself was changed", tt.name)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ftsMatchQuery turns free text into an FTS5 query matching all of its words. Each word is quoted,
+// so codes like AB-123 or words with quotes are searched as is instead of being read as FTS5 syntax.
+func ftsMatchQuery(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// searchMessages returns a page of stored messages whose text contains all the words of text, newest first,
+// along with the cursor of the next page. SQLite searches the messages_fts table, Postgres the tsvector index.
+func searchMessages(db *sqlx.DB, userID, text string, q messageQuery) ([]storedMessage, string, error) {
+	var from, match string
+	var term string
+	switch db.DriverName() {
+	case "postgres":
+		from = "messages m"
+		match = "to_tsvector('simple', m.text) @@ plainto_tsquery('simple', $1)"
+		term = text
+	default:
+		from = "messages_fts JOIN messages m ON m.rowid = messages_fts.rowid"
+		match = "messages_fts MATCH $1"
+		term = ftsMatchQuery(text)
+	}
+	where, args := q.where(userID, "m", []interface{}{term})
+	query := "SELECT " + prefixColumns("m", storedMessageColumns) + " FROM " + from + " WHERE " + match + " AND " + where
+
+	messages := []storedMessage{}
+	if err := db.Select(&messages, query+q.orderBy("m"), args...); err != nil {
+		return nil, "", err
+	}
+	return pageMessages(messages, q.Limit)
+}
+
+// prefixColumns qualifies a comma separated list of columns with a table name
+func prefixColumns(table, columns string) string {
+	names := strings.Split(columns, ", ")
+	for i, name := range names {
+		names[i] = table + "." + name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFtsMatchQuery(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"", ""},
+		{"hello", `"hello"`},
+		{"  hello   world ", `"hello" "world"`},
+		{"AB-123", `"AB-123"`},
+		{`say "hi"`, `"say" """hi"""`},
+		{"a OR b", `"a" "OR" "b"`},
+		{"prefix*", `"prefix*"`},
+	}
+	for _, tt := range tests {
+		if got := ftsMatchQuery(tt.text); got != tt.want {
+			t.Errorf("ftsMatchQuery(%q) = %s, want %s", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	db := newTestDB(t)
+	a, b := "1@s.whatsapp.net", "2@s.whatsapp.net"
+	storeTestMessage(t, db, "m1", a, 100, "Invoice AB-123 is ready")
+	storeTestMessage(t, db, "m2", b, 200, "the invoice was paid")
+	storeTestMessage(t, db, "m3", a, 300, "lunch tomorrow?")
+	storeTestMessage(t, db, "m4", a, 400, `she said "ready" OR not`)
+	storeTestMessage(t, db, "m5", b, 500, "Ready for lunch")
+
+	tests := []struct {
+		name  string
+		text  string
+		query messageQuery
+		want  []string
+	}{
+		{"one word, any case", "invoice", messageQuery{Limit: 50}, []string{"m2", "m1"}},
+		{"all words", "invoice ready", messageQuery{Limit: 50}, []string{"m1"}},
+		{"code with a dash", "AB-123", messageQuery{Limit: 50}, []string{"m1"}},
+		{"operators are words", "ready OR", messageQuery{Limit: 50}, []string{"m4"}},
+		{"quotes", `"ready"`, messageQuery{Limit: 50}, []string{"m5", "m4", "m1"}},
+		{"chat filter", "lunch", messageQuery{Chat: a, Limit: 50}, []string{"m3"}},
+		{"range filter", "ready", messageQuery{From: 200, To: 450, Limit: 50}, []string{"m4"}},
+		{"no match", "dinner", messageQuery{Limit: 50}, []string{}},
+	}
+	for _, tt := range tests {
+		messages, _, err := searchMessages(db, "user", tt.text, tt.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := messageIDs(messages); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: searching %q gave %v, want %v", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearchMessagesPages(t *testing.T) {
+	db := newTestDB(t)
+	chat := "1@s.whatsapp.net"
+	storeTestMessage(t, db, "m1", chat, 100, "status update one")
+	storeTestMessage(t, db, "m2", chat, 200, "status update two")
+	storeTestMessage(t, db, "m3", chat, 200, "something else")
+	storeTestMessage(t, db, "m4", chat, 300, "status update three")
+
+	q := messageQuery{Limit: 2}
+	first, next, err := searchMessages(db, "user", "status", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageIDs(first); !reflect.DeepEqual(got, []string{"m4", "m2"}) || next == "" {
+		t.Fatalf("first page %v, next %q", got, next)
+	}
+	cursor, err := parseMessageCursor(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Cursor = &cursor
+	second, next, err := searchMessages(db, "user", "status", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageIDs(second); !reflect.DeepEqual(got, []string{"m1"}) || next != "" {
+		t.Errorf("second page %v, next %q", got, next)
+	}
+}
+
+func TestSearchMessagesEdited(t *testing.T) {
+	db := newTestDB(t)
+	chat := "1@s.whatsapp.net"
+	storeTestMessage(t, db, "m1", chat, 100, "meet at noon")
+
+	// Edits and revokes keep the search index in step with the messages
+	edit := storedMessage{Chat: chat, Text: "meet at five"}
+	if err := saveMessage(db, "user", edit, messageContent{Kind: "edit", Text: "meet at five", Edit: &messageTarget{ID: "m1"}}); err != nil {
+		t.Fatal(err)
+	}
+	for text, want := range map[string]int{"noon": 0, "five": 1} {
+		messages, _, err := searchMessages(db, "user", text, messageQuery{Limit: 50})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != want {
+			t.Errorf("after the edit, %q found %d messages, want %d", text, len(messages), want)
+		}
+	}
+
+	if err := saveMessage(db, "user", storedMessage{Chat: chat}, messageContent{Kind: "revoke", Revoke: &messageTarget{ID: "m1"}}); err != nil {
+		t.Fatal(err)
+	}
+	messages, _, err := searchMessages(db, "user", "five", messageQuery{Limit: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("revoked message still found: %v", messageIDs(messages))
+	}
+}
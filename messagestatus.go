@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// messageStatusRank orders the statuses of sent messages, a message never goes back to a lower status
+var messageStatusRank = map[string]int{
+	messageStatusFailed:    0,
+	messageStatusSent:      1,
+	messageStatusDelivered: 2,
+	messageStatusRead:      3,
+	messageStatusPlayed:    4,
+}
+
+// outgoingMessage is a message sent through the API whose status is tracked. In groups, the status is the
+// furthest one reached by any participant, receipts give the status of each of them.
+type outgoingMessage struct {
+	ID        string           `db:"id" json:"id"`
+	Chat      string           `db:"chat" json:"chat"`
+	Status    string           `db:"status" json:"status"`
+	Error     string           `db:"error" json:"error,omitempty"`
+	SentAt    int64            `db:"sent_at" json:"sent_at"`
+	UpdatedAt int64            `db:"updated_at" json:"updated_at"`
+	Receipts  []messageReceipt `db:"-" json:"receipts"`
+}
+
+// messageReceipt holds when a recipient got, read and played a message, 0 until they did
+type messageReceipt struct {
+	Participant string `db:"participant" json:"participant"`
+	Status      string `db:"-" json:"status"`
+	DeliveredAt int64  `db:"delivered_at" json:"delivered_at"`
+	ReadAt      int64  `db:"read_at" json:"read_at"`
+	PlayedAt    int64  `db:"played_at" json:"played_at"`
+}
+
+// recordOutgoingMessage starts tracking a message acknowledged by the server. Sending again with the Id
+// of a failed attempt starts over, a message already tracked is left as it is.
+func recordOutgoingMessage(db sqlx.Execer, userID, id string, chat types.JID, sentAt time.Time) error {
+	_, err := db.Exec(`INSERT INTO outgoing_messages (user_id, id, chat, status, error, sent_at, updated_at)
+        VALUES ($1, $2, $3, $4, '', $5, $6)
+        ON CONFLICT (user_id, id) DO UPDATE SET status = excluded.status, error = '', sent_at = excluded.sent_at, updated_at = excluded.updated_at
+        WHERE outgoing_messages.status = $7`,
+		userID, id, chat.ToNonAD().String(), messageStatusSent, unixTime(sentAt), time.Now().Unix(), messageStatusFailed)
+	return err
+}
+
+// storeFailedMessage records a message the API could not send
+func storeFailedMessage(db *sqlx.DB, userID string, chat types.JID, id string, sendErr error) {
+	now := time.Now().Unix()
+	_, err := db.Exec(`INSERT INTO outgoing_messages (user_id, id, chat, status, error, sent_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, 0, $6)
+        ON CONFLICT (user_id, id) DO UPDATE SET error = excluded.error, updated_at = excluded.updated_at
+        WHERE outgoing_messages.status = excluded.status`,
+		userID, id, chat.ToNonAD().String(), messageStatusFailed, sendErr.Error(), now)
+	if err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Failed to record failed message")
+	}
+}
+
+// recordReceipt updates the status of sent messages from the delivery, read and played receipts of their recipients
+func (mycli *MyClient) recordReceipt(evt *events.Receipt) {
+	var status string
+	switch evt.Type {
+	case types.ReceiptTypeDelivered:
+		status = messageStatusDelivered
+	case types.ReceiptTypeRead:
+		status = messageStatusRead
+	case types.ReceiptTypePlayed:
+		status = messageStatusPlayed
+	default:
+		return
+	}
+	// Receipts sent by the other devices of the account are about incoming messages
+	if evt.IsFromMe {
+		return
+	}
+	participant := evt.Sender.ToNonAD().String()
+	chat := evt.Chat.ToNonAD().String()
+	ts := unixTime(evt.Timestamp)
+
+	for _, id := range evt.MessageIDs {
+		if err := updateMessageStatus(mycli.db, mycli.userID, chat, id, participant, status, ts); err != nil {
+			log.Error().Err(err).Str("id", id).Str("status", status).Msg("Failed to update message status")
+		}
+	}
+}
+
+// updateMessageStatus applies a receipt to a tracked message and to its copy in the message store
+func updateMessageStatus(db *sqlx.DB, userID, chat, id, participant, status string, ts int64) error {
+	var current string
+	err := db.Get(&current, "SELECT status FROM outgoing_messages WHERE user_id=$1 AND id=$2", userID, id)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		// Reading implies delivery and playing implies reading, the earlier steps keep their first time
+		var deliveredAt, readAt, playedAt int64 = ts, 0, 0
+		if status == messageStatusRead || status == messageStatusPlayed {
+			readAt = ts
+		}
+		if status == messageStatusPlayed {
+			playedAt = ts
+		}
+		_, err = db.Exec(`INSERT INTO message_receipts (user_id, message_id, participant, delivered_at, read_at, played_at)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (user_id, message_id, participant) DO UPDATE SET
+                delivered_at = CASE WHEN message_receipts.delivered_at = 0 THEN excluded.delivered_at ELSE message_receipts.delivered_at END,
+                read_at = CASE WHEN message_receipts.read_at = 0 THEN excluded.read_at ELSE message_receipts.read_at END,
+                played_at = CASE WHEN message_receipts.played_at = 0 THEN excluded.played_at ELSE message_receipts.played_at END`,
+			userID, id, participant, deliveredAt, readAt, playedAt)
+		if err != nil {
+			return err
+		}
+		// A receipt for a message whose send reported an error proves it went out after all
+		if messageStatusRank[status] > messageStatusRank[current] {
+			_, err = db.Exec("UPDATE outgoing_messages SET status=$1, error='', updated_at=$2 WHERE user_id=$3 AND id=$4", status, ts, userID, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Messages sent from the phone are only in the message store
+	lower := []string{}
+	for s, rank := range messageStatusRank {
+		if rank > 0 && rank < messageStatusRank[status] {
+			lower = append(lower, s)
+		}
+	}
+	query, args, err := sqlx.In("UPDATE messages SET status=? WHERE user_id=? AND chat=? AND id=? AND is_from_me=? AND status IN (?)",
+		status, userID, chat, id, true, lower)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(db.Rebind(query), args...)
+	return err
+}
+
+// messageAcknowledged reports whether the server acknowledged a message sent by the API, and when.
+// It tells apart the sends interrupted by a restart that went out from the ones to try again.
+func messageAcknowledged(db *sqlx.DB, userID, id string) (bool, int64, error) {
+	var m outgoingMessage
+	err := db.Get(&m, "SELECT status, sent_at FROM outgoing_messages WHERE user_id=$1 AND id=$2", userID, id)
+	if err == sql.ErrNoRows {
+		return false, 0, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+	return m.Status != messageStatusFailed, m.SentAt, nil
+}
+
+// getOutgoingMessage returns the status of a sent message with the receipts of its recipients,
+// sql.ErrNoRows means the message is not tracked
+func getOutgoingMessage(db *sqlx.DB, userID, id string) (*outgoingMessage, error) {
+	var m outgoingMessage
+	err := db.Get(&m, "SELECT id, chat, status, error, sent_at, updated_at FROM outgoing_messages WHERE user_id=$1 AND id=$2", userID, id)
+	if err != nil {
+		return nil, err
+	}
+	m.Receipts = []messageReceipt{}
+	err = db.Select(&m.Receipts, `SELECT participant, delivered_at, read_at, played_at FROM message_receipts
+        WHERE user_id=$1 AND message_id=$2 ORDER BY participant`, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range m.Receipts {
+		receipt := &m.Receipts[i]
+		switch {
+		case receipt.PlayedAt > 0:
+			receipt.Status = messageStatusPlayed
+		case receipt.ReadAt > 0:
+			receipt.Status = messageStatusRead
+		default:
+			receipt.Status = messageStatusDelivered
+		}
+	}
+	return &m, nil
+}
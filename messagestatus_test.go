@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// receipt builds a receipt of chat for message 3EB0AA, sent by sender at the given unix time
+func receipt(chat, sender types.JID, receiptType types.ReceiptType, ts int64) *events.Receipt {
+	return &events.Receipt{
+		MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsGroup: chat.Server == types.GroupServer},
+		MessageIDs:    []types.MessageID{"3EB0AA"},
+		Timestamp:     time.Unix(ts, 0),
+		Type:          receiptType,
+	}
+}
+
+// storedStatus returns the status of message 3EB0AA in the message store
+func storedStatus(t *testing.T, db *sqlx.DB) string {
+	t.Helper()
+	var status string
+	if err := db.Get(&status, "SELECT status FROM messages WHERE user_id='user' AND id='3EB0AA'"); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestRecordReceipt(t *testing.T) {
+	chat := types.NewJID("5491155551234", types.DefaultUserServer)
+	mine := types.NewJID("5491100000000", types.DefaultUserServer)
+
+	// Each receipt is recorded on top of the previous ones
+	tests := []struct {
+		name       string
+		evt        *events.Receipt
+		wantStatus string
+		wantStored string
+		wantTimes  [3]int64 // delivered, read, played
+	}{
+		{"delivered", receipt(chat, chat, types.ReceiptTypeDelivered, 100), messageStatusDelivered, messageStatusDelivered, [3]int64{100, 0, 0}},
+		{"delivered again", receipt(chat, chat, types.ReceiptTypeDelivered, 110), messageStatusDelivered, messageStatusDelivered, [3]int64{100, 0, 0}},
+		{"read", receipt(chat, chat, types.ReceiptTypeRead, 120), messageStatusRead, messageStatusRead, [3]int64{100, 120, 0}},
+		{"late delivery does not downgrade", receipt(chat, chat, types.ReceiptTypeDelivered, 130), messageStatusRead, messageStatusRead, [3]int64{100, 120, 0}},
+		{"from another device of the account", func() *events.Receipt {
+			evt := receipt(chat, mine, types.ReceiptTypePlayed, 135)
+			evt.IsFromMe = true
+			return evt
+		}(), messageStatusRead, messageStatusRead, [3]int64{100, 120, 0}},
+		{"retry receipts are ignored", receipt(chat, chat, types.ReceiptTypeRetry, 138), messageStatusRead, messageStatusRead, [3]int64{100, 120, 0}},
+		{"played", receipt(chat, chat, types.ReceiptTypePlayed, 140), messageStatusPlayed, messageStatusPlayed, [3]int64{100, 120, 140}},
+	}
+	db := newTestDB(t)
+	mycli := &MyClient{db: db, userID: "user"}
+	if err := recordOutgoingMessage(db, "user", "3EB0AA", chat, time.Unix(90, 0)); err != nil {
+		t.Fatal(err)
+	}
+	m := storedMessage{ID: "3EB0AA", Chat: chat.String(), Sender: mine.String(), IsFromMe: true, Timestamp: 90, Type: "audio", Status: messageStatusSent}
+	if err := saveMessage(db, "user", m, messageContent{Kind: "audio"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		mycli.recordReceipt(tt.evt)
+		got, err := getOutgoingMessage(db, "user", "3EB0AA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.wantStatus {
+			t.Errorf("%s: got status %s, want %s", tt.name, got.Status, tt.wantStatus)
+		}
+		if stored := storedStatus(t, db); stored != tt.wantStored {
+			t.Errorf("%s: got stored status %s, want %s", tt.name, stored, tt.wantStored)
+		}
+		if len(got.Receipts) != 1 {
+			t.Fatalf("%s: got %d receipts, want 1", tt.name, len(got.Receipts))
+		}
+		r := got.Receipts[0]
+		if times := [3]int64{r.DeliveredAt, r.ReadAt, r.PlayedAt}; times != tt.wantTimes || r.Status != tt.wantStatus {
+			t.Errorf("%s: got receipt %+v, want times %v", tt.name, r, tt.wantTimes)
+		}
+	}
+}
+
+func TestRecordReceiptGroup(t *testing.T) {
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	ana := types.NewJID("5491155551234", types.DefaultUserServer)
+	bob := types.NewJID("5491155554321", types.DefaultUserServer)
+	db := newTestDB(t)
+	mycli := &MyClient{db: db, userID: "user"}
+	if err := recordOutgoingMessage(db, "user", "3EB0AA", group, time.Unix(90, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	mycli.recordReceipt(receipt(group, ana, types.ReceiptTypeDelivered, 100))
+	mycli.recordReceipt(receipt(group, bob, types.ReceiptTypeRead, 110))
+	mycli.recordReceipt(receipt(group, ana, types.ReceiptTypeDelivered, 120))
+
+	got, err := getOutgoingMessage(db, "user", "3EB0AA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The message is as far as the furthest participant, each one keeps their own receipt
+	if got.Status != messageStatusRead {
+		t.Errorf("got status %s, want read", got.Status)
+	}
+	want := []messageReceipt{
+		{Participant: ana.String(), Status: messageStatusDelivered, DeliveredAt: 100},
+		{Participant: bob.String(), Status: messageStatusRead, DeliveredAt: 110, ReadAt: 110},
+	}
+	if !reflect.DeepEqual(got.Receipts, want) {
+		t.Errorf("got receipts %+v, want %+v", got.Receipts, want)
+	}
+}
+
+func TestOutgoingMessageConflicts(t *testing.T) {
+	chat := types.NewJID("5491155551234", types.DefaultUserServer)
+	sendErr := errors.New("timed out")
+	tests := []struct {
+		name      string
+		steps     []string
+		wantState string
+		wantError string
+	}{
+		{name: "failed", steps: []string{"fail"}, wantState: messageStatusFailed, wantError: "timed out"},
+		{name: "failed twice", steps: []string{"fail", "fail2"}, wantState: messageStatusFailed, wantError: "no session"},
+		{name: "sent again after failing", steps: []string{"fail", "send"}, wantState: messageStatusSent},
+		{name: "failure after the send", steps: []string{"send", "fail"}, wantState: messageStatusSent},
+		{name: "failure after a receipt", steps: []string{"send", "receipt", "fail"}, wantState: messageStatusDelivered},
+		{name: "receipt for a failed send", steps: []string{"fail", "receipt"}, wantState: messageStatusDelivered},
+		{name: "sent twice", steps: []string{"send", "receipt", "send"}, wantState: messageStatusDelivered},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		for _, step := range tt.steps {
+			var err error
+			switch step {
+			case "send":
+				err = recordOutgoingMessage(db, "user", "3EB0AA", chat, time.Unix(100, 0))
+			case "fail":
+				storeFailedMessage(db, "user", chat, "3EB0AA", sendErr)
+			case "fail2":
+				storeFailedMessage(db, "user", chat, "3EB0AA", errors.New("no session"))
+			case "receipt":
+				err = updateMessageStatus(db, "user", chat.String(), "3EB0AA", chat.String(), messageStatusDelivered, 110)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := getOutgoingMessage(db, "user", "3EB0AA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.wantState || got.Error != tt.wantError {
+			t.Errorf("%s: got %s %q, want %s %q", tt.name, got.Status, got.Error, tt.wantState, tt.wantError)
+		}
+		acknowledged, _, err := messageAcknowledged(db, "user", "3EB0AA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acknowledged != (tt.wantState != messageStatusFailed) {
+			t.Errorf("%s: got acknowledged %t", tt.name, acknowledged)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Statuses of stored messages. Incoming messages are received, the ones sent by the account start as sent
+// (acknowledged by the server) and move on with the receipts of their recipients.
+const (
+	messageStatusReceived  = "received"
+	messageStatusFailed    = "failed"
+	messageStatusSent      = "sent"
+	messageStatusDelivered = "delivered"
+	messageStatusRead      = "read"
+	messageStatusPlayed    = "played"
+)
+
+const storedMessageColumns = "id, chat, sender, push_name, is_from_me, is_group, timestamp, type, text, media, content, status, edited, revoked, media_download, s3_key"
+
+// storedMessage is a row of the messages table, kept when the user turned on store_messages
+type storedMessage struct {
+	ID        string   `db:"id" json:"id"`
+	Chat      string   `db:"chat" json:"chat"`
+	Sender    string   `db:"sender" json:"sender"`
+	PushName  string   `db:"push_name" json:"push_name"`
+	IsFromMe  bool     `db:"is_from_me" json:"is_from_me"`
+	IsGroup   bool     `db:"is_group" json:"is_group"`
+	Timestamp int64    `db:"timestamp" json:"timestamp"`
+	Type      string   `db:"type" json:"type"`
+	Text      string   `db:"text" json:"text"`
+	Media     jsonText `db:"media" json:"media"`
+	Content   jsonText `db:"content" json:"content"`
+	Status    string   `db:"status" json:"status"`
+	Edited    bool     `db:"edited" json:"edited"`
+	Revoked   bool     `db:"revoked" json:"revoked"`
+
+	// Where the media can be fetched from again, for exports
+	MediaDownload jsonText `db:"media_download" json:"-"`
+	S3Key         string   `db:"s3_key" json:"-"`
+}
+
+// jsonText is a JSON document stored as text, returned as is by the API
+type jsonText string
+
+func (t jsonText) MarshalJSON() ([]byte, error) {
+	if t == "" {
+		return []byte("null"), nil
+	}
+	return []byte(t), nil
+}
+
+func newJSONText(v interface{}) jsonText {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return ""
+	}
+	return jsonText(data)
+}
+
+// messageStoreEnabled reports whether the user keeps a local copy of their messages
+func messageStoreEnabled(db *sqlx.DB, userID string) bool {
+	var enabled bool
+	if err := db.Get(&enabled, "SELECT store_messages FROM users WHERE id=$1", userID); err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Could not load message store setting")
+		return false
+	}
+	return enabled
+}
+
+// newStoredMessage describes a message for the store, from its metadata and normalized content
+func newStoredMessage(info types.MessageInfo, msg *waE2E.Message, content messageContent, status string) storedMessage {
+	m := storedMessage{
+		ID:        info.ID,
+		Chat:      info.Chat.ToNonAD().String(),
+		Sender:    info.Sender.ToNonAD().String(),
+		PushName:  info.PushName,
+		IsFromMe:  info.IsFromMe,
+		IsGroup:   info.IsGroup,
+		Timestamp: unixTime(info.Timestamp),
+		Type:      content.Kind,
+		Text:      content.Text,
+		Content:   newJSONText(content),
+		Status:    status,
+	}
+	if content.Media != nil {
+		m.Media = newJSONText(content.Media)
+		m.MediaDownload = newMediaDownload(msg)
+	}
+	return m
+}
+
+// mediaDownload holds what is needed to download the media of a message again from WhatsApp
+type mediaDownload struct {
+	DirectPath    string `json:"directPath"`
+	MediaKey      []byte `json:"mediaKey"`
+	FileSHA256    []byte `json:"fileSha256"`
+	FileEncSHA256 []byte `json:"fileEncSha256"`
+	FileLength    uint64 `json:"fileLength"`
+	MediaType     string `json:"mediaType"`
+}
+
+// downloadableMedia returns the part of a message carrying media, if any
+func downloadableMedia(msg *waE2E.Message) whatsmeow.DownloadableMessage {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage()
+	case msg.GetPtvMessage() != nil:
+		return msg.GetPtvMessage()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage()
+	}
+	return nil
+}
+
+func newMediaDownload(msg *waE2E.Message) jsonText {
+	media := downloadableMedia(msg)
+	if media == nil || media.GetDirectPath() == "" {
+		return ""
+	}
+	d := mediaDownload{
+		DirectPath:    media.GetDirectPath(),
+		MediaKey:      media.GetMediaKey(),
+		FileSHA256:    media.GetFileSHA256(),
+		FileEncSHA256: media.GetFileEncSHA256(),
+		MediaType:     string(whatsmeow.GetMediaType(media)),
+	}
+	if sized, ok := media.(interface{ GetFileLength() uint64 }); ok {
+		d.FileLength = sized.GetFileLength()
+	}
+	return newJSONText(d)
+}
+
+// setStoredMessageS3Key remembers where the media of a stored message was uploaded, S3 keys depend on the upload date
+func (mycli *MyClient) setStoredMessageS3Key(info types.MessageInfo, key string) {
+	_, err := mycli.db.Exec("UPDATE messages SET s3_key=$1 WHERE user_id=$2 AND chat=$3 AND id=$4", key, mycli.userID, info.Chat.ToNonAD().String(), info.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", info.ID).Msg("Failed to save S3 key of stored message")
+	}
+}
+
+// saveMessage records a message. Edits and revokes are applied to the message they target instead of being stored.
+// Messages already stored are left as they are.
+func saveMessage(db sqlx.Ext, userID string, m storedMessage, content messageContent) error {
+	switch {
+	case content.Kind == "edit" && content.Edit != nil:
+		// Only text and captions can be edited, the message keeps its kind
+		var kind string
+		err := sqlx.Get(db, &kind, "SELECT type FROM messages WHERE user_id=$1 AND chat=$2 AND id=$3", userID, m.Chat, content.Edit.ID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		edited := content
+		edited.Kind = kind
+		edited.Edit = nil
+		_, err = db.Exec("UPDATE messages SET text=$1, content=$2, edited=$3 WHERE user_id=$4 AND chat=$5 AND id=$6",
+			m.Text, newJSONText(edited), true, userID, m.Chat, content.Edit.ID)
+		return err
+	case content.Kind == "revoke" && content.Revoke != nil:
+		_, err := db.Exec("UPDATE messages SET text='', media='', content='', media_download='', s3_key='', revoked=$1 WHERE user_id=$2 AND chat=$3 AND id=$4",
+			true, userID, m.Chat, content.Revoke.ID)
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO messages (user_id, `+storedMessageColumns+`)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+        ON CONFLICT (user_id, chat, id) DO NOTHING`,
+		userID, m.ID, m.Chat, m.Sender, m.PushName, m.IsFromMe, m.IsGroup, m.Timestamp, m.Type, m.Text, m.Media, m.Content, m.Status, m.Edited, m.Revoked,
+		m.MediaDownload, m.S3Key)
+	return err
+}
+
+// storeReceivedMessage records a message event, when the user keeps their messages
+func (mycli *MyClient) storeReceivedMessage(evt *events.Message) {
+	if !messageStoreEnabled(mycli.db, mycli.userID) {
+		return
+	}
+	status := messageStatusReceived
+	if evt.Info.IsFromMe {
+		status = messageStatusSent
+	}
+	content := eventMessageContent(evt)
+	if err := saveMessage(mycli.db, mycli.userID, newStoredMessage(evt.Info, evt.Message, content, status), content); err != nil {
+		log.Error().Err(err).Str("id", evt.Info.ID).Msg("Failed to store message")
+	}
+}
+
+// storeSentMessage records a message sent through the API in the chat list and tracks its status,
+// it is also added to the message store when the user keeps their messages
+func storeSentMessage(db *sqlx.DB, userID string, chat types.JID, msg *waE2E.Message, resp whatsmeow.SendResponse) {
+	info := types.MessageInfo{
+		MessageSource: types.MessageSource{
+			Chat:     chat,
+			Sender:   resp.Sender,
+			IsFromMe: true,
+			IsGroup:  chat.Server == types.GroupServer,
+		},
+		ID:        resp.ID,
+		Timestamp: resp.Timestamp,
+	}
+	if info.Sender.IsEmpty() {
+		if mycli := clientManager.GetMyClient(userID); mycli != nil && mycli.WAClient != nil && mycli.WAClient.Store.ID != nil {
+			info.Sender = *mycli.WAClient.Store.ID
+		}
+	}
+	content := buildMessageContent(msg)
+	store := messageStoreEnabled(db, userID)
+	if err := recordChatMessage(db, userID, info, msg, content, store); err != nil {
+		log.Error().Err(err).Str("id", resp.ID).Msg("Failed to update chat")
+	}
+	// Edits, revokes and reactions change other messages, they have no status of their own
+	if isChatPreview(msg, content) {
+		if err := recordOutgoingMessage(db, userID, resp.ID, chat, resp.Timestamp); err != nil {
+			log.Error().Err(err).Str("id", resp.ID).Msg("Failed to track sent message")
+		}
+	}
+	if !store {
+		return
+	}
+	if err := saveMessage(db, userID, newStoredMessage(info, msg, content, messageStatusSent), content); err != nil {
+		log.Error().Err(err).Str("id", resp.ID).Msg("Failed to store sent message")
+	}
+}
+
+// messageCursor points after the last message of a page, messages are listed newest first
+type messageCursor struct {
+	Timestamp int64
+	Chat      string
+	ID        string
+}
+
+func (c messageCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d|%s|%s", c.Timestamp, c.Chat, c.ID)))
+}
+
+func parseMessageCursor(s string) (messageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return messageCursor{}, errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(data), "|", 3)
+	if len(parts) != 3 {
+		return messageCursor{}, errors.New("invalid cursor")
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return messageCursor{}, errors.New("invalid cursor")
+	}
+	return messageCursor{Timestamp: ts, Chat: parts[1], ID: parts[2]}, nil
+}
+
+// messageQuery selects stored messages of a user, newest first
+type messageQuery struct {
+	Chat   string
+	Sender string
+	From   int64
+	To     int64
+	Cursor *messageCursor
+	Limit  int
+}
+
+// where builds the conditions shared by listing and searching, placeholders start after the given arguments
+func (q messageQuery) where(userID, table string, args []interface{}) (string, []interface{}) {
+	col := func(name string) string {
+		if table == "" {
+			return name
+		}
+		return table + "." + name
+	}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conds := []string{col("user_id") + "=" + arg(userID)}
+	if q.Chat != "" {
+		conds = append(conds, col("chat")+"="+arg(q.Chat))
+	}
+	if q.Sender != "" {
+		conds = append(conds, col("sender")+"="+arg(q.Sender))
+	}
+	if q.From > 0 {
+		conds = append(conds, col("timestamp")+">="+arg(q.From))
+	}
+	if q.To > 0 {
+		conds = append(conds, col("timestamp")+"<="+arg(q.To))
+	}
+	if c := q.Cursor; c != nil {
+		ts, chat, id := arg(c.Timestamp), arg(c.Chat), arg(c.ID)
+		conds = append(conds, fmt.Sprintf("(%[1]s < %[4]s OR (%[1]s = %[4]s AND (%[2]s < %[5]s OR (%[2]s = %[5]s AND %[3]s < %[6]s))))",
+			col("timestamp"), col("chat"), col("id"), ts, chat, id))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (q messageQuery) orderBy(table string) string {
+	if table != "" {
+		table += "."
+	}
+	return fmt.Sprintf(" ORDER BY %[1]stimestamp DESC, %[1]schat DESC, %[1]sid DESC LIMIT %[2]d", table, q.Limit+1)
+}
+
+// listMessages returns a page of messages and the cursor of the next page, empty when there is none
+func listMessages(db *sqlx.DB, userID string, q messageQuery) ([]storedMessage, string, error) {
+	where, args := q.where(userID, "", nil)
+
+	messages := []storedMessage{}
+	err := db.Select(&messages, "SELECT "+storedMessageColumns+" FROM messages WHERE "+where+q.orderBy(""), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	return pageMessages(messages, q.Limit)
+}
+
+// pageMessages trims the extra row fetched to know whether another page exists
+func pageMessages(messages []storedMessage, limit int) ([]storedMessage, string, error) {
+	if len(messages) <= limit {
+		return messages, "", nil
+	}
+	messages = messages[:limit]
+	last := messages[limit-1]
+	return messages, messageCursor{Timestamp: last.Timestamp, Chat: last.Chat, ID: last.ID}.String(), nil
+}
+
+// messageQueryFromRequest reads the chat, sender, from, to, cursor and limit query parameters
+func messageQueryFromRequest(r *http.Request) (messageQuery, error) {
+	params := r.URL.Query()
+	q := messageQuery{Limit: 50}
+
+	for name, dest := range map[string]*string{"chat": &q.Chat, "sender": &q.Sender} {
+		if v := params.Get(name); v != "" {
+			jid, ok := parseJID(v)
+			if !ok {
+				return q, fmt.Errorf("invalid %s", name)
+			}
+			*dest = jid.ToNonAD().String()
+		}
+	}
+	for name, dest := range map[string]*int64{"from": &q.From, "to": &q.To} {
+		if v := params.Get(name); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || ts < 0 {
+				return q, fmt.Errorf("%s must be a unix timestamp", name)
+			}
+			*dest = ts
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 500 {
+			return q, errors.New("limit must be between 1 and 500")
+		}
+		q.Limit = limit
+	}
+	if v := params.Get("cursor"); v != "" {
+		cursor, err := parseMessageCursor(v)
+		if err != nil {
+			return q, err
+		}
+		q.Cursor = &cursor
+	}
+	return q, nil
+}
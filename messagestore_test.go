@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// storeTestMessage adds a text message of user "user" to the message store
+func storeTestMessage(t *testing.T, db *sqlx.DB, id, chat string, timestamp int64, text string) {
+	t.Helper()
+	m := storedMessage{ID: id, Chat: chat, Sender: chat, Timestamp: timestamp, Type: "text", Text: text, Status: messageStatusReceived}
+	if err := saveMessage(db, "user", m, messageContent{Kind: "text", Text: text}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func messageIDs(messages []storedMessage) []string {
+	ids := []string{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestMessageCursor(t *testing.T) {
+	for _, c := range []messageCursor{
+		{Timestamp: 1718000000, Chat: "5491155551234@s.whatsapp.net", ID: "3EB0C4"},
+		{Timestamp: 0, Chat: "", ID: ""},
+		{Timestamp: 1, Chat: "120363000000000000@g.us", ID: "id|with|bars"},
+	} {
+		got, err := parseMessageCursor(c.String())
+		if err != nil || got != c {
+			t.Errorf("parseMessageCursor(%v) = %v, %v", c, got, err)
+		}
+	}
+
+	for _, s := range []string{"", "not base64!", "MTIz", "YWJjfGNoYXR8aWQ"} {
+		if _, err := parseMessageCursor(s); err == nil {
+			t.Errorf("parseMessageCursor(%q) accepted an invalid cursor", s)
+		}
+	}
+}
+
+func TestMessageQueryFromRequest(t *testing.T) {
+	cursor := messageCursor{Timestamp: 10, Chat: "1@s.whatsapp.net", ID: "a"}
+	tests := []struct {
+		query   string
+		want    messageQuery
+		wantErr bool
+	}{
+		{"", messageQuery{Limit: 50}, false},
+		{"chat=5491155551234&sender=%2B5491100000000", messageQuery{Chat: "5491155551234@s.whatsapp.net", Sender: "5491100000000@s.whatsapp.net", Limit: 50}, false},
+		{"chat=120363000000000000@g.us", messageQuery{Chat: "120363000000000000@g.us", Limit: 50}, false},
+		{"from=100&to=200&limit=500", messageQuery{From: 100, To: 200, Limit: 500}, false},
+		{"cursor=" + cursor.String(), messageQuery{Limit: 50, Cursor: &cursor}, false},
+		{"chat=@g.us", messageQuery{}, true},
+		{"from=yesterday", messageQuery{}, true},
+		{"to=-1", messageQuery{}, true},
+		{"limit=0", messageQuery{}, true},
+		{"limit=501", messageQuery{}, true},
+		{"cursor=bad", messageQuery{}, true},
+	}
+	for _, tt := range tests {
+		got, err := messageQueryFromRequest(httptest.NewRequest("GET", "/chat/messages?"+tt.query, nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestListMessages(t *testing.T) {
+	db := newTestDB(t)
+	a, b := "1@s.whatsapp.net", "2@s.whatsapp.net"
+	// Messages sharing a timestamp are ordered by chat, then id, newest first
+	storeTestMessage(t, db, "m1", a, 100, "one")
+	storeTestMessage(t, db, "m2", b, 200, "two")
+	storeTestMessage(t, db, "m3", a, 200, "three")
+	storeTestMessage(t, db, "m4", a, 200, "four")
+	storeTestMessage(t, db, "m5", b, 300, "five")
+	storeTestMessage(t, db, "m6", a, 400, "six")
+
+	tests := []struct {
+		name  string
+		query messageQuery
+		want  []string
+	}{
+		{"all", messageQuery{Limit: 50}, []string{"m6", "m5", "m2", "m4", "m3", "m1"}},
+		{"chat", messageQuery{Chat: a, Limit: 50}, []string{"m6", "m4", "m3", "m1"}},
+		{"sender", messageQuery{Sender: b, Limit: 50}, []string{"m5", "m2"}},
+		{"range", messageQuery{From: 200, To: 300, Limit: 50}, []string{"m5", "m2", "m4", "m3"}},
+		{"other user", messageQuery{Chat: "3@s.whatsapp.net", Limit: 50}, []string{}},
+	}
+	for _, tt := range tests {
+		messages, next, err := listMessages(db, "user", tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := messageIDs(messages); !reflect.DeepEqual(got, tt.want) || next != "" {
+			t.Errorf("%s: got %v (next %q), want %v", tt.name, got, next, tt.want)
+		}
+	}
+}
+
+func TestListMessagesPages(t *testing.T) {
+	db := newTestDB(t)
+	a, b := "1@s.whatsapp.net", "2@s.whatsapp.net"
+	storeTestMessage(t, db, "m1", a, 100, "one")
+	storeTestMessage(t, db, "m2", b, 200, "two")
+	storeTestMessage(t, db, "m3", a, 200, "three")
+	storeTestMessage(t, db, "m4", a, 200, "four")
+	storeTestMessage(t, db, "m5", b, 300, "five")
+
+	for _, limit := range []int{1, 2, 3, 5} {
+		got := []string{}
+		q := messageQuery{Limit: limit}
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("limit %d: paging does not end", limit)
+			}
+			messages, next, err := listMessages(db, "user", q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) > limit {
+				t.Fatalf("limit %d: page of %d messages", limit, len(messages))
+			}
+			got = append(got, messageIDs(messages)...)
+			if next == "" {
+				break
+			}
+			cursor, err := parseMessageCursor(next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.Cursor = &cursor
+		}
+		if want := []string{"m5", "m2", "m4", "m3", "m1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("limit %d: pages gave %v, want %v", limit, got, want)
+		}
+	}
+}
@@ -55,6 +55,91 @@ var migrations = []Migration{
 		Name:  "user_webhooks",
 		UpSQL: addUserWebhooksSQL,
 	},
+	{
+		ID:    6,
+		Name:  "webhook_deliveries",
+		UpSQL: addWebhookDeliveriesSQL,
+	},
+	{
+		ID:    7,
+		Name:  "add_webhook_secret",
+		UpSQL: addWebhookSecretSQL,
+	},
+	{
+		ID:    8,
+		Name:  "webhook_attempts",
+		UpSQL: addWebhookAttemptsSQL,
+	},
+	{
+		ID:    9,
+		Name:  "add_webhook_format_headers",
+		UpSQL: addWebhookFormatHeadersSQL,
+	},
+	{
+		ID:    10,
+		Name:  "add_webhook_filters",
+		UpSQL: addWebhookFiltersSQL,
+	},
+	{
+		ID:    11,
+		Name:  "add_webhook_health",
+		UpSQL: addWebhookHealthSQL,
+	},
+	{
+		ID:    12,
+		Name:  "add_webhook_ordering",
+		UpSQL: addWebhookOrderingSQL,
+	},
+	{
+		ID:    13,
+		Name:  "add_event_sinks",
+		UpSQL: addEventSinksSQL,
+	},
+	{
+		ID:    14,
+		Name:  "add_call_settings",
+		UpSQL: addCallSettingsSQL,
+	},
+	{
+		ID:    15,
+		Name:  "add_polls",
+		UpSQL: addPollsSQL,
+	},
+	{
+		ID:    16,
+		Name:  "add_message_store",
+		UpSQL: addMessageStoreSQL,
+	},
+	{
+		ID:    17,
+		Name:  "add_message_search",
+		UpSQL: addMessageSearchSQL,
+	},
+	{
+		ID:    18,
+		Name:  "add_chats",
+		UpSQL: addChatsSQL,
+	},
+	{
+		ID:    19,
+		Name:  "add_message_status",
+		UpSQL: addMessageStatusSQL,
+	},
+	{
+		ID:    20,
+		Name:  "add_message_media",
+		UpSQL: addMessageMediaSQL,
+	},
+	{
+		ID:    21,
+		Name:  "add_broadcasts",
+		UpSQL: addBroadcastsSQL,
+	},
+	{
+		ID:    22,
+		Name:  "add_scheduled_messages",
+		UpSQL: addScheduledMessagesSQL,
+	},
 }
 
 const changeIDToStringSQL = `
@@ -167,6 +252,316 @@ BEGIN
 END $$;
 `
 
+const addWebhookDeliveriesSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'webhook_deliveries') THEN
+        CREATE TABLE webhook_deliveries (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            webhook_id TEXT NOT NULL DEFAULT '',
+            url TEXT NOT NULL,
+            event_type TEXT NOT NULL DEFAULT '',
+            payload TEXT NOT NULL,
+            file_path TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL DEFAULT 'pending',
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt_at BIGINT NOT NULL DEFAULT 0,
+            last_error TEXT NOT NULL DEFAULT '',
+            created_at BIGINT NOT NULL DEFAULT 0,
+            updated_at BIGINT NOT NULL DEFAULT 0
+        );
+        CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
+        CREATE INDEX idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id, created_at);
+    END IF;
+END $$;
+`
+
+const addWebhookSecretSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'user_webhooks' AND column_name = 'secret') THEN
+        ALTER TABLE user_webhooks ADD COLUMN secret TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+`
+
+const addWebhookAttemptsSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'webhook_attempts') THEN
+        CREATE TABLE webhook_attempts (
+            id TEXT PRIMARY KEY,
+            delivery_id TEXT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+            webhook_id TEXT NOT NULL DEFAULT '',
+            attempt INTEGER NOT NULL DEFAULT 0,
+            status_code INTEGER NOT NULL DEFAULT 0,
+            latency_ms BIGINT NOT NULL DEFAULT 0,
+            response_body TEXT NOT NULL DEFAULT '',
+            error TEXT NOT NULL DEFAULT '',
+            created_at BIGINT NOT NULL DEFAULT 0
+        );
+        CREATE INDEX idx_webhook_attempts_delivery ON webhook_attempts (delivery_id);
+    END IF;
+END $$;
+`
+
+const addWebhookFormatHeadersSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'user_webhooks' AND column_name = 'format') THEN
+        ALTER TABLE user_webhooks ADD COLUMN format TEXT NOT NULL DEFAULT '';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'user_webhooks' AND column_name = 'headers') THEN
+        ALTER TABLE user_webhooks ADD COLUMN headers TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+`
+
+const addWebhookFiltersSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'user_webhooks' AND column_name = 'filters') THEN
+        ALTER TABLE user_webhooks ADD COLUMN filters TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+`
+
+const addWebhookHealthSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'user_webhooks' AND column_name = 'health') THEN
+        ALTER TABLE user_webhooks ADD COLUMN health TEXT NOT NULL DEFAULT 'healthy';
+        ALTER TABLE user_webhooks ADD COLUMN consecutive_failures INTEGER NOT NULL DEFAULT 0;
+        ALTER TABLE user_webhooks ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+        ALTER TABLE user_webhooks ADD COLUMN last_error_at BIGINT NOT NULL DEFAULT 0;
+        ALTER TABLE user_webhooks ADD COLUMN last_success_at BIGINT NOT NULL DEFAULT 0;
+        ALTER TABLE user_webhooks ADD COLUMN paused_until BIGINT NOT NULL DEFAULT 0;
+    END IF;
+END $$;
+`
+
+const addWebhookOrderingSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'user_webhooks' AND column_name = 'ordered') THEN
+        ALTER TABLE user_webhooks ADD COLUMN ordered BOOLEAN NOT NULL DEFAULT FALSE;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_deliveries' AND column_name = 'chat_jid') THEN
+        ALTER TABLE webhook_deliveries ADD COLUMN chat_jid TEXT NOT NULL DEFAULT '';
+        ALTER TABLE webhook_deliveries ADD COLUMN seq BIGINT NOT NULL DEFAULT 0;
+        CREATE INDEX idx_webhook_deliveries_chat ON webhook_deliveries (webhook_id, chat_jid, seq);
+    END IF;
+END $$;
+`
+
+const addEventSinksSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'event_sinks') THEN
+        ALTER TABLE users ADD COLUMN event_sinks TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+`
+
+const addCallSettingsSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'reject_calls') THEN
+        ALTER TABLE users ADD COLUMN reject_calls BOOLEAN NOT NULL DEFAULT FALSE;
+        ALTER TABLE users ADD COLUMN reject_calls_message TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+`
+
+const addPollsSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'polls') THEN
+        CREATE TABLE polls (
+            user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            id TEXT NOT NULL,
+            chat TEXT NOT NULL DEFAULT '',
+            sender TEXT NOT NULL DEFAULT '',
+            name TEXT NOT NULL DEFAULT '',
+            options TEXT NOT NULL DEFAULT '[]',
+            selectable_count INTEGER NOT NULL DEFAULT 0,
+            created_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, id)
+        );
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'poll_votes') THEN
+        CREATE TABLE poll_votes (
+            user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            poll_id TEXT NOT NULL,
+            voter TEXT NOT NULL,
+            options TEXT NOT NULL DEFAULT '[]',
+            updated_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, poll_id, voter)
+        );
+    END IF;
+END $$;
+`
+
+const addMessageStoreSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'store_messages') THEN
+        ALTER TABLE users ADD COLUMN store_messages BOOLEAN NOT NULL DEFAULT FALSE;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'messages') THEN
+        CREATE TABLE messages (
+            user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            chat TEXT NOT NULL,
+            id TEXT NOT NULL,
+            sender TEXT NOT NULL DEFAULT '',
+            push_name TEXT NOT NULL DEFAULT '',
+            is_from_me BOOLEAN NOT NULL DEFAULT FALSE,
+            is_group BOOLEAN NOT NULL DEFAULT FALSE,
+            timestamp BIGINT NOT NULL DEFAULT 0,
+            type TEXT NOT NULL DEFAULT '',
+            text TEXT NOT NULL DEFAULT '',
+            media TEXT NOT NULL DEFAULT '',
+            content TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL DEFAULT '',
+            edited BOOLEAN NOT NULL DEFAULT FALSE,
+            revoked BOOLEAN NOT NULL DEFAULT FALSE,
+            PRIMARY KEY (user_id, chat, id)
+        );
+        CREATE INDEX idx_messages_chat_time ON messages (user_id, chat, timestamp);
+        CREATE INDEX idx_messages_time ON messages (user_id, timestamp);
+    END IF;
+END $$;
+`
+
+// Full-text search on Postgres uses an expression index, the simple configuration does not depend on the language
+const addMessageSearchSQL = `
+CREATE INDEX IF NOT EXISTS idx_messages_text_search ON messages USING GIN (to_tsvector('simple', text));
+`
+
+const addChatsSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'chats') THEN
+        CREATE TABLE chats (
+            user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            jid TEXT NOT NULL,
+            name TEXT NOT NULL DEFAULT '',
+            last_message_id TEXT NOT NULL DEFAULT '',
+            last_message_sender TEXT NOT NULL DEFAULT '',
+            last_message_from_me BOOLEAN NOT NULL DEFAULT FALSE,
+            last_message_type TEXT NOT NULL DEFAULT '',
+            last_message_text TEXT NOT NULL DEFAULT '',
+            last_message_at BIGINT NOT NULL DEFAULT 0,
+            unread_count INTEGER NOT NULL DEFAULT 0,
+            muted_until BIGINT NOT NULL DEFAULT 0,
+            archived BOOLEAN NOT NULL DEFAULT FALSE,
+            pinned_at BIGINT NOT NULL DEFAULT 0,
+            ephemeral_timer INTEGER NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, jid)
+        );
+    END IF;
+END $$;
+`
+
+const addMessageStatusSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'outgoing_messages') THEN
+        CREATE TABLE outgoing_messages (
+            user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            id TEXT NOT NULL,
+            chat TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL DEFAULT '',
+            error TEXT NOT NULL DEFAULT '',
+            sent_at BIGINT NOT NULL DEFAULT 0,
+            updated_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, id)
+        );
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'message_receipts') THEN
+        CREATE TABLE message_receipts (
+            user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            message_id TEXT NOT NULL,
+            participant TEXT NOT NULL,
+            delivered_at BIGINT NOT NULL DEFAULT 0,
+            read_at BIGINT NOT NULL DEFAULT 0,
+            played_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, message_id, participant)
+        );
+    END IF;
+END $$;
+`
+
+const addMessageMediaSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'messages' AND column_name = 'media_download') THEN
+        ALTER TABLE messages ADD COLUMN media_download TEXT NOT NULL DEFAULT '';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'messages' AND column_name = 's3_key') THEN
+        ALTER TABLE messages ADD COLUMN s3_key TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+`
+
+const addBroadcastsSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'broadcasts') THEN
+        CREATE TABLE broadcasts (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            type TEXT NOT NULL,
+            message TEXT NOT NULL,
+            per_minute INTEGER NOT NULL,
+            status TEXT NOT NULL,
+            created_at BIGINT NOT NULL DEFAULT 0,
+            finished_at BIGINT NOT NULL DEFAULT 0
+        );
+        CREATE INDEX idx_broadcasts_user ON broadcasts (user_id, created_at);
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'broadcast_recipients') THEN
+        CREATE TABLE broadcast_recipients (
+            broadcast_id TEXT NOT NULL REFERENCES broadcasts(id) ON DELETE CASCADE,
+            position INTEGER NOT NULL,
+            phone TEXT NOT NULL,
+            variables TEXT NOT NULL DEFAULT '{}',
+            status TEXT NOT NULL,
+            message_id TEXT NOT NULL DEFAULT '',
+            error TEXT NOT NULL DEFAULT '',
+            sent_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (broadcast_id, position)
+        );
+    END IF;
+END $$;
+`
+
+const addScheduledMessagesSQL = `
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'scheduled_messages') THEN
+        CREATE TABLE scheduled_messages (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            action TEXT NOT NULL,
+            chat TEXT NOT NULL DEFAULT '',
+            payload TEXT NOT NULL,
+            send_at BIGINT NOT NULL,
+            next_attempt_at BIGINT NOT NULL,
+            status TEXT NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            message_id TEXT NOT NULL DEFAULT '',
+            error TEXT NOT NULL DEFAULT '',
+            created_at BIGINT NOT NULL DEFAULT 0,
+            finished_at BIGINT NOT NULL DEFAULT 0
+        );
+        CREATE INDEX idx_scheduled_messages_due ON scheduled_messages (status, next_attempt_at);
+        CREATE INDEX idx_scheduled_messages_user ON scheduled_messages (user_id, send_at);
+    END IF;
+END $$;
+`
+
 // GenerateRandomID creates a random string ID
 func GenerateRandomID() (string, error) {
 	bytes := make([]byte, 16) // 128 bits
@@ -348,6 +743,331 @@ func applyMigration(db *sqlx.DB, migration Migration) error {
 		} else {
 			_, err = tx.Exec(migration.UpSQL)
 		}
+	} else if migration.ID == 6 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "webhook_deliveries", `
+                CREATE TABLE webhook_deliveries (
+                    id TEXT PRIMARY KEY,
+                    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                    webhook_id TEXT NOT NULL DEFAULT '',
+                    url TEXT NOT NULL,
+                    event_type TEXT NOT NULL DEFAULT '',
+                    payload TEXT NOT NULL,
+                    file_path TEXT NOT NULL DEFAULT '',
+                    status TEXT NOT NULL DEFAULT 'pending',
+                    attempts INTEGER NOT NULL DEFAULT 0,
+                    next_attempt_at INTEGER NOT NULL DEFAULT 0,
+                    last_error TEXT NOT NULL DEFAULT '',
+                    created_at INTEGER NOT NULL DEFAULT 0,
+                    updated_at INTEGER NOT NULL DEFAULT 0
+                )`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)")
+			}
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id, created_at)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 7 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "user_webhooks", "secret", "TEXT NOT NULL DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 8 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "webhook_attempts", `
+                CREATE TABLE webhook_attempts (
+                    id TEXT PRIMARY KEY,
+                    delivery_id TEXT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+                    webhook_id TEXT NOT NULL DEFAULT '',
+                    attempt INTEGER NOT NULL DEFAULT 0,
+                    status_code INTEGER NOT NULL DEFAULT 0,
+                    latency_ms INTEGER NOT NULL DEFAULT 0,
+                    response_body TEXT NOT NULL DEFAULT '',
+                    error TEXT NOT NULL DEFAULT '',
+                    created_at INTEGER NOT NULL DEFAULT 0
+                )`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery ON webhook_attempts (delivery_id)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 9 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "user_webhooks", "format", "TEXT NOT NULL DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "user_webhooks", "headers", "TEXT NOT NULL DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 10 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "user_webhooks", "filters", "TEXT NOT NULL DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 11 {
+		if db.DriverName() == "sqlite" {
+			columns := []struct{ name, def string }{
+				{"health", "TEXT NOT NULL DEFAULT 'healthy'"},
+				{"consecutive_failures", "INTEGER NOT NULL DEFAULT 0"},
+				{"last_error", "TEXT NOT NULL DEFAULT ''"},
+				{"last_error_at", "INTEGER NOT NULL DEFAULT 0"},
+				{"last_success_at", "INTEGER NOT NULL DEFAULT 0"},
+				{"paused_until", "INTEGER NOT NULL DEFAULT 0"},
+			}
+			for _, col := range columns {
+				if err = addColumnIfNotExistsSQLite(tx, "user_webhooks", col.name, col.def); err != nil {
+					break
+				}
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 12 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "user_webhooks", "ordered", "BOOLEAN NOT NULL DEFAULT 0")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhook_deliveries", "chat_jid", "TEXT NOT NULL DEFAULT ''")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhook_deliveries", "seq", "INTEGER NOT NULL DEFAULT 0")
+			}
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_chat ON webhook_deliveries (webhook_id, chat_jid, seq)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 13 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "event_sinks", "TEXT NOT NULL DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 14 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "reject_calls", "BOOLEAN NOT NULL DEFAULT 0")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "reject_calls_message", "TEXT NOT NULL DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 15 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "polls", `
+                CREATE TABLE polls (
+                    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                    id TEXT NOT NULL,
+                    chat TEXT NOT NULL DEFAULT '',
+                    sender TEXT NOT NULL DEFAULT '',
+                    name TEXT NOT NULL DEFAULT '',
+                    options TEXT NOT NULL DEFAULT '[]',
+                    selectable_count INTEGER NOT NULL DEFAULT 0,
+                    created_at INTEGER NOT NULL DEFAULT 0,
+                    PRIMARY KEY (user_id, id)
+                )`)
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "poll_votes", `
+                CREATE TABLE poll_votes (
+                    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                    poll_id TEXT NOT NULL,
+                    voter TEXT NOT NULL,
+                    options TEXT NOT NULL DEFAULT '[]',
+                    updated_at INTEGER NOT NULL DEFAULT 0,
+                    PRIMARY KEY (user_id, poll_id, voter)
+                )`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 16 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "store_messages", "BOOLEAN NOT NULL DEFAULT 0")
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "messages", `
+                CREATE TABLE messages (
+                    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                    chat TEXT NOT NULL,
+                    id TEXT NOT NULL,
+                    sender TEXT NOT NULL DEFAULT '',
+                    push_name TEXT NOT NULL DEFAULT '',
+                    is_from_me BOOLEAN NOT NULL DEFAULT 0,
+                    is_group BOOLEAN NOT NULL DEFAULT 0,
+                    timestamp INTEGER NOT NULL DEFAULT 0,
+                    type TEXT NOT NULL DEFAULT '',
+                    text TEXT NOT NULL DEFAULT '',
+                    media TEXT NOT NULL DEFAULT '',
+                    content TEXT NOT NULL DEFAULT '',
+                    status TEXT NOT NULL DEFAULT '',
+                    edited BOOLEAN NOT NULL DEFAULT 0,
+                    revoked BOOLEAN NOT NULL DEFAULT 0,
+                    PRIMARY KEY (user_id, chat, id)
+                )`)
+			}
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_messages_chat_time ON messages (user_id, chat, timestamp)")
+			}
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_messages_time ON messages (user_id, timestamp)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 17 {
+		if db.DriverName() == "sqlite" {
+			// External content FTS5 table over messages.text, kept in sync by triggers
+			err = createTableIfNotExistsSQLite(tx, "messages_fts", `
+                CREATE VIRTUAL TABLE messages_fts USING fts5(text, content='messages', content_rowid='rowid')`)
+			statements := []string{
+				`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+                    INSERT INTO messages_fts (rowid, text) VALUES (new.rowid, new.text);
+                END`,
+				`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+                    INSERT INTO messages_fts (messages_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+                END`,
+				`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF text ON messages BEGIN
+                    INSERT INTO messages_fts (messages_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+                    INSERT INTO messages_fts (rowid, text) VALUES (new.rowid, new.text);
+                END`,
+				// Index the messages stored before search existed
+				`INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')`,
+			}
+			for _, stmt := range statements {
+				if err != nil {
+					break
+				}
+				_, err = tx.Exec(stmt)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 18 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "chats", `
+                CREATE TABLE chats (
+                    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                    jid TEXT NOT NULL,
+                    name TEXT NOT NULL DEFAULT '',
+                    last_message_id TEXT NOT NULL DEFAULT '',
+                    last_message_sender TEXT NOT NULL DEFAULT '',
+                    last_message_from_me BOOLEAN NOT NULL DEFAULT 0,
+                    last_message_type TEXT NOT NULL DEFAULT '',
+                    last_message_text TEXT NOT NULL DEFAULT '',
+                    last_message_at INTEGER NOT NULL DEFAULT 0,
+                    unread_count INTEGER NOT NULL DEFAULT 0,
+                    muted_until INTEGER NOT NULL DEFAULT 0,
+                    archived BOOLEAN NOT NULL DEFAULT 0,
+                    pinned_at INTEGER NOT NULL DEFAULT 0,
+                    ephemeral_timer INTEGER NOT NULL DEFAULT 0,
+                    PRIMARY KEY (user_id, jid)
+                )`)
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 19 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "outgoing_messages", `
+                CREATE TABLE outgoing_messages (
+                    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                    id TEXT NOT NULL,
+                    chat TEXT NOT NULL DEFAULT '',
+                    status TEXT NOT NULL DEFAULT '',
+                    error TEXT NOT NULL DEFAULT '',
+                    sent_at INTEGER NOT NULL DEFAULT 0,
+                    updated_at INTEGER NOT NULL DEFAULT 0,
+                    PRIMARY KEY (user_id, id)
+                )`)
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "message_receipts", `
+                CREATE TABLE message_receipts (
+                    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                    message_id TEXT NOT NULL,
+                    participant TEXT NOT NULL,
+                    delivered_at INTEGER NOT NULL DEFAULT 0,
+                    read_at INTEGER NOT NULL DEFAULT 0,
+                    played_at INTEGER NOT NULL DEFAULT 0,
+                    PRIMARY KEY (user_id, message_id, participant)
+                )`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 20 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "messages", "media_download", "TEXT NOT NULL DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "messages", "s3_key", "TEXT NOT NULL DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 21 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "broadcasts", `
+                CREATE TABLE broadcasts (
+                    id TEXT PRIMARY KEY,
+                    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                    type TEXT NOT NULL,
+                    message TEXT NOT NULL,
+                    per_minute INTEGER NOT NULL,
+                    status TEXT NOT NULL,
+                    created_at INTEGER NOT NULL DEFAULT 0,
+                    finished_at INTEGER NOT NULL DEFAULT 0
+                )`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_broadcasts_user ON broadcasts (user_id, created_at)")
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "broadcast_recipients", `
+                CREATE TABLE broadcast_recipients (
+                    broadcast_id TEXT NOT NULL REFERENCES broadcasts(id) ON DELETE CASCADE,
+                    position INTEGER NOT NULL,
+                    phone TEXT NOT NULL,
+                    variables TEXT NOT NULL DEFAULT '{}',
+                    status TEXT NOT NULL,
+                    message_id TEXT NOT NULL DEFAULT '',
+                    error TEXT NOT NULL DEFAULT '',
+                    sent_at INTEGER NOT NULL DEFAULT 0,
+                    PRIMARY KEY (broadcast_id, position)
+                )`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 22 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "scheduled_messages", `
+                CREATE TABLE scheduled_messages (
+                    id TEXT PRIMARY KEY,
+                    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                    action TEXT NOT NULL,
+                    chat TEXT NOT NULL DEFAULT '',
+                    payload TEXT NOT NULL,
+                    send_at INTEGER NOT NULL,
+                    next_attempt_at INTEGER NOT NULL,
+                    status TEXT NOT NULL,
+                    attempts INTEGER NOT NULL DEFAULT 0,
+                    message_id TEXT NOT NULL DEFAULT '',
+                    error TEXT NOT NULL DEFAULT '',
+                    created_at INTEGER NOT NULL DEFAULT 0,
+                    finished_at INTEGER NOT NULL DEFAULT 0
+                )`)
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due ON scheduled_messages (status, next_attempt_at)")
+			}
+			if err == nil {
+				_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_scheduled_messages_user ON scheduled_messages (user_id, send_at)")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
 	} else {
 		_, err = tx.Exec(migration.UpSQL)
 	}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// natsSink publishes events to a JetStream stream on the subject <NATS_SUBJECT>.<userID>.<eventType>
+type natsSink struct {
+	*asyncSink
+	conn    *nats.Conn
+	js      jetstream.JetStream
+	stream  string
+	subject string
+
+	mu          sync.Mutex
+	streamReady bool
+}
+
+func NewNATSSink(url string) (*natsSink, error) {
+	s := &natsSink{
+		stream:  os.Getenv("NATS_STREAM"),
+		subject: os.Getenv("NATS_SUBJECT"),
+	}
+	if s.stream == "" {
+		s.stream = "WUZAPI_EVENTS"
+	}
+	if s.subject == "" {
+		s.subject = "wuzapi.events"
+	}
+
+	// The client reconnects on its own, including when the server is down at startup
+	conn, err := nats.Connect(url,
+		nats.Name("wuzapi"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warn().Err(err).Msg("NATS disconnected")
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Info().Str("url", c.ConnectedUrlRedacted()).Msg("NATS reconnected")
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.conn = conn
+	s.js = js
+	s.asyncSink = newAsyncSink("nats", s.publish)
+
+	log.Info().Str("stream", s.stream).Str("subject", s.subject).Msg("NATS event sink configured")
+	return s, nil
+}
+
+// ensureStream creates the stream when it does not exist yet. An existing stream is left as it is,
+// so its retention and limits can be managed outside of wuzapi.
+func (s *natsSink) ensureStream(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streamReady {
+		return nil
+	}
+	_, err := s.js.Stream(ctx, s.stream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		_, err = s.js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     s.stream,
+			Subjects: []string{s.subject + ".>"},
+			Storage:  jetstream.FileStorage,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	s.streamReady = true
+	return nil
+}
+
+func (s *natsSink) publish(evt SinkEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.ensureStream(ctx); err != nil {
+		return err
+	}
+	msg := nats.NewMsg(s.subject + "." + sinkSubjectToken(evt.UserID) + "." + sinkSubjectToken(evt.Type))
+	msg.Header.Set("Content-Type", "application/json")
+	msg.Header.Set("User-Id", evt.UserID)
+	msg.Header.Set("Event-Type", evt.Type)
+	msg.Data = evt.Data
+	_, err := s.js.PublishMsg(ctx, msg)
+	return err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// runNATSServer starts an in-process NATS server with JetStream on a random port
+func runNATSServer(t *testing.T) *natsserver.Server {
+	t.Helper()
+	ns, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func newTestNATSSink(t *testing.T, url string) *natsSink {
+	t.Helper()
+	s, err := NewNATSSink(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.conn.Close)
+	return s
+}
+
+func TestNATSSinkPublish(t *testing.T) {
+	tests := []struct {
+		name        string
+		stream      string
+		subject     string
+		userID      string
+		eventType   string
+		wantStream  string
+		wantSubject string
+	}{
+		{"defaults", "", "", "user", "Message", "WUZAPI_EVENTS", "wuzapi.events.user.Message"},
+		{"configured", "EVENTS", "acme.wa", "user", "ReadReceipt", "EVENTS", "acme.wa.user.ReadReceipt"},
+		{"escaped tokens", "", "", "a.b*", "Chat Presence", "WUZAPI_EVENTS", "wuzapi.events.a_b_.ChatPresence"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := runNATSServer(t)
+			t.Setenv("NATS_STREAM", tt.stream)
+			t.Setenv("NATS_SUBJECT", tt.subject)
+			s := newTestNATSSink(t, ns.ClientURL())
+
+			data := []byte(`{"type":"` + tt.eventType + `"}`)
+			if err := s.publish(SinkEvent{UserID: tt.userID, Type: tt.eventType, Data: data}); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			stream, err := s.js.Stream(ctx, tt.wantStream)
+			if err != nil {
+				t.Fatalf("stream %s: %v", tt.wantStream, err)
+			}
+			msg, err := stream.GetLastMsgForSubject(ctx, tt.wantSubject)
+			if err != nil {
+				t.Fatalf("no message on %s: %v", tt.wantSubject, err)
+			}
+			if string(msg.Data) != string(data) {
+				t.Errorf("data = %s, want %s", msg.Data, data)
+			}
+			if got := msg.Header.Get("User-Id"); got != tt.userID {
+				t.Errorf("User-Id header = %q, want %q", got, tt.userID)
+			}
+			if got := msg.Header.Get("Event-Type"); got != tt.eventType {
+				t.Errorf("Event-Type header = %q, want %q", got, tt.eventType)
+			}
+		})
+	}
+}
+
+func TestNATSSinkKeepsExistingStream(t *testing.T) {
+	ns := runNATSServer(t)
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := jetstream.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// A stream managed outside of wuzapi, with its own subjects and limits
+	_, err = js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:     "WUZAPI_EVENTS",
+		Subjects: []string{"wuzapi.>"},
+		MaxMsgs:  10,
+		Storage:  jetstream.MemoryStorage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestNATSSink(t, ns.ClientURL())
+	if err := s.publish(SinkEvent{UserID: "user", Type: "Message", Data: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := js.Stream(ctx, "WUZAPI_EVENTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Config.MaxMsgs != 10 || info.Config.Storage != jetstream.MemoryStorage || len(info.Config.Subjects) != 1 || info.Config.Subjects[0] != "wuzapi.>" {
+		t.Errorf("existing stream config changed: %+v", info.Config)
+	}
+	if info.State.Msgs != 1 {
+		t.Errorf("stream has %d messages, want 1", info.State.Msgs)
+	}
+}
+
+func TestNATSSinkSend(t *testing.T) {
+	ns := runNATSServer(t)
+	s := newTestNATSSink(t, ns.ClientURL())
+
+	// Send queues the event, the background worker publishes it
+	for i := 0; i < 3; i++ {
+		if err := s.Send(SinkEvent{UserID: "user", Type: "Message", Data: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		stream, err := s.js.Stream(ctx, "WUZAPI_EVENTS")
+		if err == nil && stream.CachedInfo().State.Msgs == 3 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("events were not published")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// pollVoteEvent is the "event" of PollVote webhooks. A vote replaces the previous vote of the same voter,
+// an empty Options means the vote was withdrawn.
+type pollVoteEvent struct {
+	PollID    string   `json:"pollId"`
+	PollName  string   `json:"pollName"`
+	MessageID string   `json:"messageId"`
+	Chat      string   `json:"chat"`
+	Voter     string   `json:"voter"`
+	IsFromMe  bool     `json:"isFromMe"`
+	IsGroup   bool     `json:"isGroup"`
+	Options   []string `json:"options"`
+	// Hashes of selected options that are not in the poll as we know it, for polls created before tracking started
+	UnknownOptions []string `json:"unknownOptions,omitempty"`
+	Timestamp      int64    `json:"timestamp"`
+
+	source types.MessageSource
+}
+
+type storedPoll struct {
+	ID              string `db:"id"`
+	Chat            string `db:"chat"`
+	Sender          string `db:"sender"`
+	Name            string `db:"name"`
+	Options         string `db:"options"`
+	SelectableCount int    `db:"selectable_count"`
+	CreatedAt       int64  `db:"created_at"`
+}
+
+// pollCreation returns the poll carried by a message, whatever version of the poll message it uses
+func pollCreation(msg *waE2E.Message) *waE2E.PollCreationMessage {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage()
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2()
+	case msg.GetPollCreationMessageV3() != nil:
+		return msg.GetPollCreationMessageV3()
+	}
+	return nil
+}
+
+// recordPoll keeps the options of a poll, votes only carry hashes of the option names
+func recordPoll(db *sqlx.DB, userID, pollID string, chat, sender types.JID, poll *waE2E.PollCreationMessage, created time.Time) error {
+	names := make([]string, 0, len(poll.GetOptions()))
+	for _, option := range poll.GetOptions() {
+		names = append(names, option.GetOptionName())
+	}
+	options, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO polls (user_id, id, chat, sender, name, options, selectable_count, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (user_id, id) DO NOTHING`,
+		userID, pollID, chat.ToNonAD().String(), sender.ToNonAD().String(), poll.GetName(), string(options), poll.GetSelectableOptionsCount(), unixTime(created))
+	return err
+}
+
+func getStoredPoll(db *sqlx.DB, userID, pollID string) (*storedPoll, []string, error) {
+	var poll storedPoll
+	err := db.Get(&poll, "SELECT id, chat, sender, name, options, selectable_count, created_at FROM polls WHERE user_id=$1 AND id=$2", userID, pollID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var options []string
+	if err := json.Unmarshal([]byte(poll.Options), &options); err != nil {
+		return nil, nil, err
+	}
+	return &poll, options, nil
+}
+
+func pollOptionHash(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(hash[:])
+}
+
+// handlePollVote decrypts a poll update, records the vote and emits a PollVote event naming the selected options
+func (mycli *MyClient) handlePollVote(evt *events.Message) {
+	vote, err := mycli.WAClient.DecryptPollVote(context.Background(), evt)
+	if err != nil {
+		log.Error().Err(err).Str("id", evt.Info.ID).Msg("Failed to decrypt poll vote")
+		return
+	}
+	pollID := evt.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetID()
+
+	hashes := make([]string, 0, len(vote.GetSelectedOptions()))
+	for _, hash := range vote.GetSelectedOptions() {
+		hashes = append(hashes, hex.EncodeToString(hash))
+	}
+
+	voteEvt := &pollVoteEvent{
+		PollID:    pollID,
+		MessageID: evt.Info.ID,
+		Chat:      evt.Info.Chat.String(),
+		Voter:     evt.Info.Sender.ToNonAD().String(),
+		IsFromMe:  evt.Info.IsFromMe,
+		IsGroup:   evt.Info.IsGroup,
+		Options:   []string{},
+		Timestamp: unixTime(evt.Info.Timestamp),
+		source:    evt.Info.MessageSource,
+	}
+
+	recordPollVote(mycli.db, mycli.userID, voteEvt, hashes)
+
+	log.Info().Str("pollID", pollID).Str("voter", voteEvt.Voter).Strs("options", voteEvt.Options).Msg("Poll vote received")
+	sendEventWithWebHook(mycli, map[string]interface{}{
+		"type":  "PollVote",
+		"event": voteEvt,
+	}, "")
+}
+
+// recordPollVote stores the selected option hashes of a vote and names them in voteEvt. A vote older than the
+// stored one of the same voter does not replace it.
+func recordPollVote(db *sqlx.DB, userID string, voteEvt *pollVoteEvent, hashes []string) {
+	pollID := voteEvt.PollID
+
+	// Votes are kept as hashes, so they can be counted even when the poll is only learned about later
+	stored, err := json.Marshal(hashes)
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO poll_votes (user_id, poll_id, voter, options, updated_at)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (user_id, poll_id, voter) DO UPDATE SET options = excluded.options, updated_at = excluded.updated_at
+            WHERE poll_votes.updated_at <= excluded.updated_at`,
+			userID, pollID, voteEvt.Voter, string(stored), voteEvt.Timestamp)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("pollID", pollID).Msg("Failed to store poll vote")
+	}
+
+	poll, options, err := getStoredPoll(db, userID, pollID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error().Err(err).Str("pollID", pollID).Msg("Failed to load poll")
+	}
+	names := map[string]string{}
+	if poll != nil {
+		voteEvt.PollName = poll.Name
+		for _, option := range options {
+			names[pollOptionHash(option)] = option
+		}
+	}
+	for _, hash := range hashes {
+		if name, ok := names[hash]; ok {
+			voteEvt.Options = append(voteEvt.Options, name)
+		} else {
+			voteEvt.UnknownOptions = append(voteEvt.UnknownOptions, hash)
+		}
+	}
+}
+
+// pollResults tallies the current votes of a poll, sql.ErrNoRows means the poll is not known
+func pollResults(db *sqlx.DB, userID, pollID string) (map[string]interface{}, error) {
+	poll, options, err := getStoredPoll(db, userID, pollID)
+	if err != nil {
+		return nil, err
+	}
+
+	var votes []struct {
+		Voter     string `db:"voter"`
+		Options   string `db:"options"`
+		UpdatedAt int64  `db:"updated_at"`
+	}
+	err = db.Select(&votes, "SELECT voter, options, updated_at FROM poll_votes WHERE user_id=$1 AND poll_id=$2 ORDER BY updated_at", userID, pollID)
+	if err != nil {
+		return nil, err
+	}
+
+	voters := make(map[string][]string, len(options))
+	totalVoters := 0
+	for _, vote := range votes {
+		var hashes []string
+		if err := json.Unmarshal([]byte(vote.Options), &hashes); err != nil || len(hashes) == 0 {
+			continue
+		}
+		totalVoters++
+		for _, hash := range hashes {
+			voters[hash] = append(voters[hash], vote.Voter)
+		}
+	}
+
+	results := make([]map[string]interface{}, 0, len(options))
+	for _, option := range options {
+		optionVoters := voters[pollOptionHash(option)]
+		if optionVoters == nil {
+			optionVoters = []string{}
+		}
+		results = append(results, map[string]interface{}{
+			"name":   option,
+			"votes":  len(optionVoters),
+			"voters": optionVoters,
+		})
+	}
+
+	return map[string]interface{}{
+		"id":               poll.ID,
+		"chat":             poll.Chat,
+		"sender":           poll.Sender,
+		"name":             poll.Name,
+		"selectable_count": poll.SelectableCount,
+		"created_at":       poll.CreatedAt,
+		"total_voters":     totalVoters,
+		"options":          results,
+	}, nil
+}
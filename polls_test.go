@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	pollChat = types.NewJID("120363000000000000", types.GroupServer)
+	pollAna  = types.NewJID("5491155551234", types.DefaultUserServer)
+	pollBob  = types.NewJID("5491155554321", types.DefaultUserServer)
+)
+
+// recordTestPoll stores poll 3EB0POLL asking for lunch, sent by Ana
+func recordTestPoll(t *testing.T, db *sqlx.DB) {
+	t.Helper()
+	poll := &waE2E.PollCreationMessage{
+		Name:                   proto.String("Lunch?"),
+		Options:                []*waE2E.PollCreationMessage_Option{{OptionName: proto.String("Pizza")}, {OptionName: proto.String("Sushi")}, {OptionName: proto.String("Tacos")}},
+		SelectableOptionsCount: proto.Uint32(2),
+	}
+	if err := recordPoll(db, "user", "3EB0POLL", pollChat, pollAna, poll, time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// vote records a vote of voter at the given unix time and returns the resulting PollVote event
+func vote(db *sqlx.DB, voter types.JID, ts int64, hashes ...string) *pollVoteEvent {
+	voteEvt := &pollVoteEvent{PollID: "3EB0POLL", Voter: voter.String(), Options: []string{}, Timestamp: ts}
+	if hashes == nil {
+		hashes = []string{}
+	}
+	recordPollVote(db, "user", voteEvt, hashes)
+	return voteEvt
+}
+
+func TestRecordPollVote(t *testing.T) {
+	db := newTestDB(t)
+	unknown := pollOptionHash("Burgers")
+
+	// Votes that arrive before the poll is known keep their hashes
+	got := vote(db, pollBob, 110, pollOptionHash("Sushi"))
+	if got.PollName != "" || len(got.Options) != 0 || !reflect.DeepEqual(got.UnknownOptions, []string{pollOptionHash("Sushi")}) {
+		t.Errorf("vote before the poll: got %+v", got)
+	}
+
+	recordTestPoll(t, db)
+	got = vote(db, pollAna, 120, pollOptionHash("Tacos"), unknown, pollOptionHash("Pizza"))
+	if got.PollName != "Lunch?" || !reflect.DeepEqual(got.Options, []string{"Tacos", "Pizza"}) || !reflect.DeepEqual(got.UnknownOptions, []string{unknown}) {
+		t.Errorf("vote with an unknown option: got %+v", got)
+	}
+
+	got = vote(db, pollAna, 130)
+	if len(got.Options) != 0 || got.UnknownOptions != nil {
+		t.Errorf("withdrawn vote: got %+v", got)
+	}
+}
+
+func TestPollResults(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := pollResults(db, "user", "3EB0POLL"); err != sql.ErrNoRows {
+		t.Fatalf("unknown poll: got %v, want sql.ErrNoRows", err)
+	}
+	recordTestPoll(t, db)
+
+	vote(db, pollAna, 110, pollOptionHash("Pizza"), pollOptionHash("Sushi"))
+	vote(db, pollBob, 120, pollOptionHash("Tacos"))
+	// Bob changes the vote, then an older vote from Bob arrives late and is ignored
+	vote(db, pollBob, 140, pollOptionHash("Pizza"))
+	vote(db, pollBob, 130, pollOptionHash("Sushi"))
+	// A voter who withdrew is not counted
+	carla := types.NewJID("5491155550000", types.DefaultUserServer)
+	vote(db, carla, 115, pollOptionHash("Tacos"))
+	vote(db, carla, 125)
+
+	results, err := pollResults(db, "user", "3EB0POLL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id":               "3EB0POLL",
+		"chat":             pollChat.String(),
+		"sender":           pollAna.String(),
+		"name":             "Lunch?",
+		"selectable_count": 2,
+		"created_at":       int64(100),
+		"total_voters":     2,
+		"options": []map[string]interface{}{
+			{"name": "Pizza", "votes": 2, "voters": []string{pollAna.String(), pollBob.String()}},
+			{"name": "Sushi", "votes": 1, "voters": []string{pollAna.String()}},
+			{"name": "Tacos", "votes": 0, "voters": []string{}},
+		},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got %v, want %v", results, want)
+	}
+}
@@ -1,64 +1,380 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
 	"os"
-	"sync"
+	"sort"
+	"time"
 
 	"github.com/rabbitmq/amqp091-go"
 	"github.com/rs/zerolog/log"
 )
 
 var (
-	rabbitConn    *amqp091.Connection
-	rabbitChannel *amqp091.Channel
-	rabbitEnabled bool
-	rabbitOnce    sync.Once
-	rabbitQueue   string
+	rabbitURL             string
+	rabbitEnabled         bool
+	rabbitQueue           string
+	rabbitExchange        string
+	rabbitUnroutableQueue string
+	rabbitConfirmWindow   int
+	rabbitOutbox          chan rabbitMessage
+	rabbitCommandQueue    string
 )
 
+const (
+	rabbitConfirmTimeout = 10 * time.Second
+	rabbitMaxBackoff     = 30 * time.Second
+)
+
+// rabbitMessage is an event waiting to be published. Unroutable messages were returned by the broker
+// and go to the unroutable queue instead.
+type rabbitMessage struct {
+	routingKey string
+	userID     string
+	eventType  string
+	body       []byte
+	unroutable bool
+}
+
 // Call this in main() or initialization
 func InitRabbitMQ() {
-	rabbitURL := os.Getenv("RABBITMQ_URL")
+	rabbitURL = os.Getenv("RABBITMQ_URL")
+	rabbitCommandQueue = os.Getenv("RABBITMQ_COMMAND_QUEUE")
 	rabbitQueue = os.Getenv("RABBITMQ_QUEUE")
-	if rabbitQueue == "" {
+	rabbitExchange = os.Getenv("RABBITMQ_EXCHANGE")
+	if rabbitQueue == "" && rabbitExchange == "" {
 		rabbitQueue = "whatsapp_events" // default queue
 	}
+	rabbitUnroutableQueue = os.Getenv("RABBITMQ_UNROUTABLE_QUEUE")
+	if rabbitUnroutableQueue == "" && rabbitExchange != "" {
+		rabbitUnroutableQueue = rabbitExchange + ".unroutable"
+	}
 	if rabbitURL == "" {
 		rabbitEnabled = false
 		log.Info().Msg("RABBITMQ_URL is not set. RabbitMQ publishing disabled.")
 		return
 	}
-	var err error
-	rabbitConn, err = amqp091.Dial(rabbitURL)
+
+	// Events are buffered while the broker is unreachable, so publishing never blocks event handling
+	rabbitOutbox = make(chan rabbitMessage, getEnvInt("RABBITMQ_BUFFER", 10000))
+	rabbitConfirmWindow = getEnvInt("RABBITMQ_CONFIRM_WINDOW", 100)
+	rabbitEnabled = true
+
+	// The messages not confirmed when the connection drops are kept to be sent again
+	var pending []rabbitMessage
+	go rabbitRun("publisher", func(conn *amqp091.Connection) error {
+		var err error
+		pending, err = rabbitPublishLoop(conn, pending)
+		return err
+	})
+}
+
+// rabbitRun keeps a connection open for session, reconnecting with backoff whenever it is lost.
+// session runs until the connection or its channel fails.
+func rabbitRun(name string, session func(conn *amqp091.Connection) error) {
+	backoff := time.Second
+	for {
+		conn, err := amqp091.Dial(rabbitURL)
+		if err != nil {
+			log.Error().Err(err).Str("worker", name).Dur("retry_in", backoff).Msg("Could not connect to RabbitMQ")
+			time.Sleep(backoff)
+			backoff = min(backoff*2, rabbitMaxBackoff)
+			continue
+		}
+		backoff = time.Second
+		log.Info().
+			Str("worker", name).
+			Str("queue", rabbitQueue).
+			Str("exchange", rabbitExchange).
+			Msg("RabbitMQ connection established.")
+
+		err = session(conn)
+		conn.Close()
+		log.Warn().Err(err).Str("worker", name).Int("buffered", len(rabbitOutbox)).Msg("RabbitMQ connection lost, reconnecting")
+		time.Sleep(backoff)
+	}
+}
+
+// rabbitDeclarer is the part of an AMQP channel that declares the topology events are published to
+type rabbitDeclarer interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp091.Table) (amqp091.Queue, error)
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp091.Table) error
+	QueueBind(name, key, exchange string, noWait bool, args amqp091.Table) error
+}
+
+// rabbitDeclare creates the exchange and queue events are published to. With an exchange,
+// RABBITMQ_QUEUE (when set) is bound to every routing key so existing consumers keep working,
+// and the unroutable queue is declared to keep the events no queue is bound to.
+func rabbitDeclare(ch rabbitDeclarer) error {
+	for _, queue := range []string{rabbitQueue, rabbitUnroutableQueue} {
+		if queue == "" {
+			continue
+		}
+		_, err := ch.QueueDeclare(
+			queue,
+			true,  // durable
+			false, // auto-delete
+			false, // exclusive
+			false, // no-wait
+			nil,   // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if rabbitExchange == "" {
+		return nil
+	}
+	err := ch.ExchangeDeclare(
+		rabbitExchange,
+		"topic",
+		true,  // durable
+		false, // auto-delete
+		false, // internal
+		false, // no-wait
+		nil,   // arguments
+	)
 	if err != nil {
-		rabbitEnabled = false
-		log.Error().Err(err).Msg("Could not connect to RabbitMQ")
-		return
+		return err
+	}
+	if rabbitQueue != "" {
+		return ch.QueueBind(rabbitQueue, "#", rabbitExchange, false, nil)
 	}
-	rabbitChannel, err = rabbitConn.Channel()
+	return nil
+}
+
+// rabbitPublishLoop publishes buffered events on conn until it fails. Up to rabbitConfirmWindow messages
+// wait for their broker confirm at a time, a message the broker refuses is sent again. The messages not
+// confirmed when the connection drops are returned to be sent again.
+func rabbitPublishLoop(conn *amqp091.Connection, pending []rabbitMessage) ([]rabbitMessage, error) {
+	ch, err := conn.Channel()
 	if err != nil {
-		rabbitEnabled = false
-		log.Error().Err(err).Msg("Could not open RabbitMQ channel")
-		return
+		return pending, err
 	}
-	rabbitEnabled = true
-	log.Info().
-		Str("queue", rabbitQueue).
-		Msg("RabbitMQ connection established.")
+	defer ch.Close()
+
+	if err := ch.Confirm(false); err != nil {
+		return pending, err
+	}
+	if err := rabbitDeclare(ch); err != nil {
+		return pending, err
+	}
+
+	closed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+	confirms := ch.NotifyPublish(make(chan amqp091.Confirmation, rabbitConfirmWindow))
+	returns := ch.NotifyReturn(make(chan amqp091.Return, rabbitConfirmWindow))
+
+	// Messages published and not confirmed yet, by delivery tag
+	inflight := map[uint64]rabbitMessage{}
+	unconfirmed := func() []rabbitMessage {
+		tags := make([]uint64, 0, len(inflight))
+		for tag := range inflight {
+			tags = append(tags, tag)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+		messages := make([]rabbitMessage, 0, len(inflight)+len(pending))
+		for _, tag := range tags {
+			messages = append(messages, inflight[tag])
+		}
+		return append(messages, pending...)
+	}
+	// Mandatory messages that no queue is bound to come back before their confirm, they go to the
+	// unroutable queue. Without an exchange the queue itself is gone: the channel is given up on so
+	// that reconnecting declares it again, and the message is sent again as it is not confirmed yet.
+	returned := func(ret amqp091.Return) error {
+		log.Warn().
+			Str("exchange", ret.Exchange).
+			Str("routing_key", ret.RoutingKey).
+			Str("reason", ret.ReplyText).
+			Str("unroutable_queue", rabbitUnroutableQueue).
+			Msg("RabbitMQ returned unroutable message")
+		if rabbitUnroutableQueue == "" {
+			return errors.New("queue " + rabbitQueue + " not found")
+		}
+		pending = append(pending, rabbitReturned(ret))
+		return nil
+	}
+	drainReturns := func() error {
+		for {
+			select {
+			case ret, ok := <-returns:
+				if !ok {
+					return nil
+				}
+				if err := returned(ret); err != nil {
+					return err
+				}
+			default:
+				return nil
+			}
+		}
+	}
+
+	for {
+		if len(pending) > 0 && len(inflight) < rabbitConfirmWindow {
+			tag := ch.GetNextPublishSeqNo()
+			if err := rabbitPublish(ch, pending[0]); err != nil {
+				return unconfirmed(), err
+			}
+			inflight[tag] = pending[0]
+			pending = pending[1:]
+			continue
+		}
+
+		// New events are taken while there is room in the window, a broker that stops confirming
+		// is given up on so the messages are sent again on a new connection
+		var outbox <-chan rabbitMessage
+		var stalled <-chan time.Time
+		if len(inflight) < rabbitConfirmWindow {
+			outbox = rabbitOutbox
+		}
+		if len(inflight) > 0 {
+			stalled = time.After(rabbitConfirmTimeout)
+		}
+		select {
+		case msg := <-outbox:
+			pending = append(pending, msg)
+		case c, ok := <-confirms:
+			if !ok {
+				return unconfirmed(), errors.New("channel closed")
+			}
+			// The return of a message is queued before its confirm, it is handled first
+			if err := drainReturns(); err != nil {
+				return unconfirmed(), err
+			}
+			msg, ok := inflight[c.DeliveryTag]
+			delete(inflight, c.DeliveryTag)
+			if !ok {
+				continue
+			}
+			if !c.Ack {
+				log.Warn().Str("routing_key", msg.routingKey).Msg("RabbitMQ did not confirm message, retrying")
+				pending = append(pending, msg)
+				continue
+			}
+			log.Debug().Str("routing_key", msg.routingKey).Msg("Published message to RabbitMQ")
+		case ret, ok := <-returns:
+			if !ok {
+				return unconfirmed(), errors.New("channel closed")
+			}
+			if err := returned(ret); err != nil {
+				return unconfirmed(), err
+			}
+		case <-stalled:
+			return unconfirmed(), errors.New("timed out waiting for publisher confirms")
+		case amqpErr := <-closed:
+			if amqpErr == nil {
+				return unconfirmed(), errors.New("channel closed")
+			}
+			return unconfirmed(), amqpErr
+		}
+	}
+}
+
+// rabbitReturned rebuilds a message returned by the broker so it can be sent to the unroutable queue
+func rabbitReturned(ret amqp091.Return) rabbitMessage {
+	userID, _ := ret.Headers["user_id"].(string)
+	return rabbitMessage{
+		routingKey: ret.RoutingKey,
+		userID:     userID,
+		eventType:  ret.Type,
+		body:       ret.Body,
+		unroutable: true,
+	}
+}
+
+// rabbitDestination returns the exchange and routing key a message is published with
+func rabbitDestination(msg rabbitMessage) (string, string) {
+	switch {
+	case msg.unroutable:
+		// The default exchange routes to the queue named by the routing key
+		return "", rabbitUnroutableQueue
+	case rabbitExchange == "":
+		return "", rabbitQueue
+	}
+	return rabbitExchange, msg.routingKey
 }
 
-// Optionally, allow overriding the queue per message
-func PublishToRabbit(data []byte, queueOverride ...string) error {
+func rabbitPublish(ch *amqp091.Channel, msg rabbitMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rabbitConfirmTimeout)
+	defer cancel()
+
+	exchange, routingKey := rabbitDestination(msg)
+	return ch.PublishWithContext(
+		ctx,
+		exchange,
+		routingKey,
+		!msg.unroutable, // mandatory
+		false,           // immediate
+		amqp091.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp091.Persistent,
+			Timestamp:    time.Now(),
+			Type:         msg.eventType,
+			Headers: amqp091.Table{
+				"user_id":     msg.userID,
+				"event_type":  msg.eventType,
+				"routing_key": msg.routingKey,
+			},
+			Body: msg.body,
+		},
+	)
+}
+
+// rabbitRoutingKey builds "<userID>.<eventType>"
+func rabbitRoutingKey(userID, eventType string) string {
+	return sinkSubjectToken(userID) + "." + sinkSubjectToken(eventType)
+}
+
+// PublishToRabbit buffers an event for publishing, it returns an error when the buffer is full
+func PublishToRabbit(userID, eventType string, data []byte) error {
 	if !rabbitEnabled {
 		return nil
 	}
-	queueName := rabbitQueue
-	if len(queueOverride) > 0 && queueOverride[0] != "" {
-		queueName = queueOverride[0]
+	msg := rabbitMessage{
+		routingKey: rabbitRoutingKey(userID, eventType),
+		userID:     userID,
+		eventType:  eventType,
+		body:       data,
 	}
-	// Declare queue (idempotent)
-	_, err := rabbitChannel.QueueDeclare(
-		queueName,
+	select {
+	case rabbitOutbox <- msg:
+		return nil
+	default:
+		return errors.New("rabbitmq buffer is full, event dropped")
+	}
+}
+
+// rabbitCommand is a request read from RABBITMQ_COMMAND_QUEUE, data is the body of the matching REST endpoint
+type rabbitCommand struct {
+	Token  string          `json:"token"`
+	Action string          `json:"action"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// StartRabbitCommands consumes RABBITMQ_COMMAND_QUEUE and runs its commands, if configured
+func (s *server) StartRabbitCommands() {
+	if rabbitURL == "" || rabbitCommandQueue == "" {
+		return
+	}
+	prefetch := getEnvInt("RABBITMQ_COMMAND_PREFETCH", 10)
+	go rabbitRun("commands", func(conn *amqp091.Connection) error {
+		return s.rabbitConsumeCommands(conn, prefetch)
+	})
+}
+
+func (s *server) rabbitConsumeCommands(conn *amqp091.Connection, prefetch int) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	_, err = ch.QueueDeclare(
+		rabbitCommandQueue,
 		true,  // durable
 		false, // auto-delete
 		false, // exclusive
@@ -66,35 +382,92 @@ func PublishToRabbit(data []byte, queueOverride ...string) error {
 		nil,   // arguments
 	)
 	if err != nil {
-		log.Error().Err(err).Str("queue", queueName).Msg("Could not declare RabbitMQ queue")
 		return err
 	}
-	err = rabbitChannel.Publish(
-		"",        // exchange (default)
-		queueName, // routing key = queue
+	// Bounds how many commands run at the same time
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(
+		rabbitCommandQueue,
+		"",    // consumer tag
+		false, // auto-ack
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("queue", rabbitCommandQueue).Msg("Consuming RabbitMQ commands")
+
+	for d := range deliveries {
+		go s.rabbitHandleCommand(ch, d)
+	}
+	return errors.New("command consumer closed")
+}
+
+// rabbitHandleCommand runs one command and publishes the result to its reply-to queue with the same correlation id
+func (s *server) rabbitHandleCommand(ch *amqp091.Channel, d amqp091.Delivery) {
+	status, envelope := s.rabbitReply(d.Body)
+
+	// Commands are acknowledged once run, failed ones are answered rather than redelivered
+	defer d.Ack(false)
+
+	if d.ReplyTo == "" {
+		log.Info().Int("status", status).Str("correlation_id", d.CorrelationId).Msg("RabbitMQ command without reply-to processed")
+		return
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not encode RabbitMQ command reply")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rabbitConfirmTimeout)
+	defer cancel()
+	err = ch.PublishWithContext(ctx,
+		"",        // default exchange routes to the queue named by the routing key
+		d.ReplyTo, // routing key
 		false,     // mandatory
 		false,     // immediate
 		amqp091.Publishing{
-			ContentType: "application/json",
-			Body:        data,
+			ContentType:   "application/json",
+			CorrelationId: d.CorrelationId,
+			Timestamp:     time.Now(),
+			Body:          body,
 		},
 	)
 	if err != nil {
-		log.Error().Err(err).Str("queue", queueName).Msg("Could not publish to RabbitMQ")
-	} else {
-		log.Debug().Str("queue", queueName).Msg("Published message to RabbitMQ")
+		log.Error().Err(err).Str("reply_to", d.ReplyTo).Str("correlation_id", d.CorrelationId).Msg("Could not publish RabbitMQ command reply")
 	}
-	return err
 }
 
-// Usage - like sendToGlobalWebhook
-func sendToGlobalRabbit(jsonData []byte, queueName ...string) {
-	if !rabbitEnabled {
-		log.Debug().Msg("RabbitMQ publishing is disabled, not sending message")
-		return
+// rabbitReply runs the command of a message and returns its status and reply, the REST response with the action added
+func (s *server) rabbitReply(body []byte) (int, map[string]interface{}) {
+	var cmd rabbitCommand
+	status, envelope := commandError(http.StatusBadRequest, "could not decode command")
+	if err := json.Unmarshal(body, &cmd); err == nil {
+		status, envelope = s.rabbitExecute(cmd)
+	}
+	envelope["action"] = cmd.Action
+	return status, envelope
+}
+
+func (s *server) rabbitExecute(cmd rabbitCommand) (int, map[string]interface{}) {
+	if cmd.Token == "" {
+		return commandError(http.StatusUnauthorized, "missing token")
 	}
-	err := PublishToRabbit(jsonData, queueName...)
+	userinfo, found, err := s.lookupUserInfo(cmd.Token)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to publish to RabbitMQ")
+		log.Error().Err(err).Msg("Could not look up RabbitMQ command user")
+		return commandError(http.StatusInternalServerError, "could not look up user")
+	}
+	if !found {
+		return commandError(http.StatusUnauthorized, "unauthorized")
 	}
+	// A command that hangs would hold one of the RABBITMQ_COMMAND_PREFETCH slots for good
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(getEnvInt("RABBITMQ_COMMAND_TIMEOUT_SECONDS", 60))*time.Second)
+	defer cancel()
+	return s.executeCommand(ctx, userinfo, cmd.Action, cmd.Data)
 }
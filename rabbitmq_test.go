@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// withRabbitConfig sets where events are published to for the duration of a test
+func withRabbitConfig(t *testing.T, queue, exchange, unroutable string) {
+	t.Helper()
+	oldQueue, oldExchange, oldUnroutable := rabbitQueue, rabbitExchange, rabbitUnroutableQueue
+	rabbitQueue, rabbitExchange, rabbitUnroutableQueue = queue, exchange, unroutable
+	t.Cleanup(func() {
+		rabbitQueue, rabbitExchange, rabbitUnroutableQueue = oldQueue, oldExchange, oldUnroutable
+	})
+}
+
+// recordingDeclarer records the topology declared on it
+type recordingDeclarer struct {
+	calls []string
+}
+
+func (d *recordingDeclarer) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp091.Table) (amqp091.Queue, error) {
+	d.calls = append(d.calls, fmt.Sprintf("queue %s durable=%t", name, durable))
+	return amqp091.Queue{Name: name}, nil
+}
+
+func (d *recordingDeclarer) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp091.Table) error {
+	d.calls = append(d.calls, fmt.Sprintf("exchange %s %s durable=%t", name, kind, durable))
+	return nil
+}
+
+func (d *recordingDeclarer) QueueBind(name, key, exchange string, noWait bool, args amqp091.Table) error {
+	d.calls = append(d.calls, fmt.Sprintf("bind %s %s %s", name, exchange, key))
+	return nil
+}
+
+func TestRabbitRoutingKey(t *testing.T) {
+	tests := []struct {
+		userID    string
+		eventType string
+		want      string
+	}{
+		{"1", "Message", "1.Message"},
+		{"a1b2c3", "ReadReceipt", "a1b2c3.ReadReceipt"},
+		{"user.with.dots", "Message", "user_with_dots.Message"},
+		{"user*", "Chat Presence", "user_.ChatPresence"},
+		{"#", "Message", "_.Message"},
+	}
+	for _, tt := range tests {
+		if got := rabbitRoutingKey(tt.userID, tt.eventType); got != tt.want {
+			t.Errorf("rabbitRoutingKey(%q, %q) = %q, want %q", tt.userID, tt.eventType, got, tt.want)
+		}
+	}
+}
+
+func TestPublishToRabbit(t *testing.T) {
+	oldEnabled, oldOutbox := rabbitEnabled, rabbitOutbox
+	t.Cleanup(func() { rabbitEnabled, rabbitOutbox = oldEnabled, oldOutbox })
+
+	rabbitEnabled, rabbitOutbox = false, make(chan rabbitMessage, 2)
+	if err := PublishToRabbit("1", "Message", []byte("{}")); err != nil || len(rabbitOutbox) != 0 {
+		t.Fatalf("disabled: got %v with %d buffered, want nothing buffered", err, len(rabbitOutbox))
+	}
+
+	rabbitEnabled = true
+	for i := 0; i < 2; i++ {
+		if err := PublishToRabbit("1", "Message", []byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+	}
+	// A full buffer drops the event instead of blocking event handling
+	if err := PublishToRabbit("1", "Message", []byte(`{"n":2}`)); err == nil {
+		t.Error("full buffer: got no error")
+	}
+	want := rabbitMessage{routingKey: "1.Message", userID: "1", eventType: "Message", body: []byte(`{"n":0}`)}
+	if got := <-rabbitOutbox; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRabbitDeclare(t *testing.T) {
+	tests := []struct {
+		name       string
+		queue      string
+		exchange   string
+		unroutable string
+		want       []string
+	}{
+		{
+			name:  "queue",
+			queue: "whatsapp_events",
+			want:  []string{"queue whatsapp_events durable=true"},
+		},
+		{
+			name:       "exchange",
+			exchange:   "wuzapi",
+			unroutable: "wuzapi.unroutable",
+			want:       []string{"queue wuzapi.unroutable durable=true", "exchange wuzapi topic durable=true"},
+		},
+		{
+			name:       "exchange and queue",
+			queue:      "whatsapp",
+			exchange:   "wuzapi",
+			unroutable: "wuzapi.unroutable",
+			want: []string{
+				"queue whatsapp durable=true",
+				"queue wuzapi.unroutable durable=true",
+				"exchange wuzapi topic durable=true",
+				"bind whatsapp wuzapi #",
+			},
+		},
+	}
+	for _, tt := range tests {
+		withRabbitConfig(t, tt.queue, tt.exchange, tt.unroutable)
+		d := &recordingDeclarer{}
+		if err := rabbitDeclare(d); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(d.calls, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, d.calls, tt.want)
+		}
+	}
+}
+
+func TestRabbitDestination(t *testing.T) {
+	tests := []struct {
+		name         string
+		queue        string
+		exchange     string
+		unroutable   bool
+		wantExchange string
+		wantKey      string
+	}{
+		{name: "queue", queue: "whatsapp_events", wantExchange: "", wantKey: "whatsapp_events"},
+		{name: "exchange", queue: "whatsapp", exchange: "wuzapi", wantExchange: "wuzapi", wantKey: "1.Message"},
+		{name: "returned", exchange: "wuzapi", unroutable: true, wantExchange: "", wantKey: "wuzapi.unroutable"},
+	}
+	for _, tt := range tests {
+		withRabbitConfig(t, tt.queue, tt.exchange, "wuzapi.unroutable")
+		msg := rabbitMessage{routingKey: "1.Message", unroutable: tt.unroutable}
+		exchange, key := rabbitDestination(msg)
+		if exchange != tt.wantExchange || key != tt.wantKey {
+			t.Errorf("%s: got %q %q, want %q %q", tt.name, exchange, key, tt.wantExchange, tt.wantKey)
+		}
+	}
+}
+
+func TestRabbitReturned(t *testing.T) {
+	ret := amqp091.Return{
+		ReplyText:  "NO_ROUTE",
+		Exchange:   "wuzapi",
+		RoutingKey: "1.Message",
+		Type:       "Message",
+		Headers:    amqp091.Table{"user_id": "1", "event_type": "Message"},
+		Body:       []byte(`{"type":"Message"}`),
+	}
+	want := rabbitMessage{routingKey: "1.Message", userID: "1", eventType: "Message", body: ret.Body, unroutable: true}
+	if got := rabbitReturned(ret); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRabbitReply(t *testing.T) {
+	s := &server{db: newTestDB(t)}
+	future := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantAction string
+		wantError  string
+	}{
+		{name: "bad JSON", body: `{"token":`, wantStatus: http.StatusBadRequest, wantError: "could not decode command"},
+		{name: "missing token", body: `{"action":"send.text"}`, wantStatus: http.StatusUnauthorized, wantAction: "send.text", wantError: "missing token"},
+		{name: "unknown token", body: `{"token":"nope","action":"send.text"}`, wantStatus: http.StatusUnauthorized, wantAction: "send.text", wantError: "unauthorized"},
+		{
+			name:       "unknown action",
+			body:       `{"token":"token","action":"send.fax"}`,
+			wantStatus: http.StatusBadRequest,
+			wantAction: "send.fax",
+			wantError:  "unknown action, supported actions: " + strings.Join(commandNames(), ", "),
+		},
+		{
+			name:       "scheduled send",
+			body:       fmt.Sprintf(`{"token":"token","action":"send.text","data":{"Phone":"5491155551234","Body":"hi","SendAt":%d}}`, future),
+			wantStatus: http.StatusOK,
+			wantAction: "send.text",
+		},
+	}
+	for _, tt := range tests {
+		status, envelope := s.rabbitReply([]byte(tt.body))
+		// The code is a number decoded from JSON when the endpoint answered
+		if status != tt.wantStatus || fmt.Sprint(envelope["code"]) != fmt.Sprint(tt.wantStatus) || envelope["action"] != tt.wantAction {
+			t.Errorf("%s: got status %d with %v, want %d for action %q", tt.name, status, envelope, tt.wantStatus, tt.wantAction)
+			continue
+		}
+		if tt.wantError != "" {
+			if envelope["error"] != tt.wantError || envelope["success"] != false {
+				t.Errorf("%s: got %v, want error %q", tt.name, envelope, tt.wantError)
+			}
+			continue
+		}
+		data, _ := envelope["data"].(map[string]interface{})
+		if envelope["success"] != true || data["Details"] != "Scheduled" || data["ScheduledId"] == "" {
+			t.Errorf("%s: got %v", tt.name, envelope)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// redisSink appends events to a Redis stream. REDIS_STREAM may contain {userID} to get one stream per user.
+type redisSink struct {
+	*asyncSink
+	client *redis.Client
+	stream string
+	maxLen int64
+}
+
+func NewRedisSink(url string) (*redisSink, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	s := &redisSink{
+		client: redis.NewClient(opts),
+		stream: os.Getenv("REDIS_STREAM"),
+		maxLen: int64(getEnvInt("REDIS_STREAM_MAXLEN", 100000)),
+	}
+	if s.stream == "" {
+		s.stream = "wuzapi:events"
+	}
+	s.asyncSink = newAsyncSink("redis", s.publish)
+
+	log.Info().Str("stream", s.stream).Int64("maxlen", s.maxLen).Msg("Redis event sink configured")
+	return s, nil
+}
+
+func (s *redisSink) publish(evt SinkEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	args := &redis.XAddArgs{
+		Stream: strings.ReplaceAll(s.stream, "{userID}", evt.UserID),
+		Values: map[string]interface{}{
+			"user_id":    evt.UserID,
+			"event_type": evt.Type,
+			"data":       evt.Data,
+		},
+	}
+	// Trimming is approximate, which is much cheaper for Redis than an exact length
+	if s.maxLen > 0 {
+		args.MaxLen = s.maxLen
+		args.Approx = true
+	}
+	return s.client.XAdd(ctx, args).Err()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisSinkPublish(t *testing.T) {
+	tests := []struct {
+		name       string
+		stream     string
+		userID     string
+		wantStream string
+	}{
+		{"default stream", "", "user", "wuzapi:events"},
+		{"configured stream", "events", "user", "events"},
+		{"stream per user", "wuzapi:{userID}:events", "user", "wuzapi:user:events"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			t.Setenv("REDIS_STREAM", tt.stream)
+			s, err := NewRedisSink("redis://" + mr.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.client.Close()
+
+			if err := s.publish(SinkEvent{UserID: tt.userID, Type: "Message", Data: []byte(`{"type":"Message"}`)}); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := mr.Stream(tt.wantStream)
+			if err != nil {
+				t.Fatalf("stream %s: %v", tt.wantStream, err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("stream %s has %d entries, want 1", tt.wantStream, len(entries))
+			}
+			values := map[string]string{}
+			for i := 0; i+1 < len(entries[0].Values); i += 2 {
+				values[entries[0].Values[i]] = entries[0].Values[i+1]
+			}
+			want := map[string]string{"user_id": tt.userID, "event_type": "Message", "data": `{"type":"Message"}`}
+			for k, v := range want {
+				if values[k] != v {
+					t.Errorf("%s = %q, want %q", k, values[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisSinkMaxLen(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_STREAM_MAXLEN", "2")
+	s, err := NewRedisSink("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.client.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := s.publish(SinkEvent{UserID: "user", Type: "Message", Data: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := mr.Stream("wuzapi:events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Redis may keep more than the limit with approximate trimming, never fewer than it
+	if len(entries) < 2 || len(entries) > 5 {
+		t.Errorf("stream has %d entries with a max length of 2", len(entries))
+	}
+}
+
+func TestRedisSinkInvalidURL(t *testing.T) {
+	if _, err := NewRedisSink("not a url"); err == nil {
+		t.Error("NewRedisSink accepted an invalid URL")
+	}
+}
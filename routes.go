@@ -79,10 +79,16 @@ func (s *server) routes() {
 	s.router.Handle("/session/pairphone", c.Then(s.PairPhone())).Methods("POST")
 	s.router.Handle("/session/history", c.Then(s.RequestHistorySync())).Methods("GET")
 
+	s.router.Handle("/events/stream", c.Then(s.StreamEvents())).Methods("GET")
+	s.router.Handle("/ws", c.Then(s.WebSocket())).Methods("GET")
+
 	s.router.Handle("/webhook", c.Then(s.CreateWebhook())).Methods("POST")
 	s.router.Handle("/webhook", c.Then(s.ListWebhooks())).Methods("GET")
 	s.router.Handle("/webhook/{id}", c.Then(s.DeleteWebhook())).Methods("DELETE")
 	s.router.Handle("/webhook/{id}", c.Then(s.UpdateWebhook())).Methods("PUT")
+	s.router.Handle("/webhook/{id}/test", c.Then(s.TestWebhook())).Methods("POST")
+	s.router.Handle("/webhook/{id}/deliveries", c.Then(s.ListWebhookDeliveries())).Methods("GET")
+	s.router.Handle("/webhook/{id}/deliveries/{deliveryId}/replay", c.Then(s.ReplayWebhookDelivery())).Methods("POST")
 
 	s.router.Handle("/session/proxy", c.Then(s.SetProxy())).Methods("POST")
 
@@ -91,21 +97,41 @@ func (s *server) routes() {
 	s.router.Handle("/session/s3/config", c.Then(s.DeleteS3Config())).Methods("DELETE")
 	s.router.Handle("/session/s3/test", c.Then(s.TestS3Connection())).Methods("POST")
 
-	s.router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
+	s.router.Handle("/session/sinks", c.Then(s.GetEventSinks())).Methods("GET")
+	s.router.Handle("/session/sinks", c.Then(s.SetEventSinks())).Methods("POST")
+
+	s.router.Handle("/session/calls/config", c.Then(s.GetCallConfig())).Methods("GET")
+	s.router.Handle("/session/calls/config", c.Then(s.SetCallConfig())).Methods("POST")
+
+	s.router.Handle("/session/store/config", c.Then(s.GetStoreConfig())).Methods("GET")
+	s.router.Handle("/session/store/config", c.Then(s.SetStoreConfig())).Methods("POST")
+
+	s.router.Handle("/chat/send/text", c.Then(s.schedulable("send.text", s.SendMessage()))).Methods("POST")
 	s.router.Handle("/chat/delete", c.Then(s.DeleteMessage())).Methods("POST")
-	s.router.Handle("/chat/send/image", c.Then(s.SendImage())).Methods("POST")
-	s.router.Handle("/chat/send/audio", c.Then(s.SendAudio())).Methods("POST")
-	s.router.Handle("/chat/send/document", c.Then(s.SendDocument())).Methods("POST")
+	s.router.Handle("/chat/send/image", c.Then(s.schedulable("send.image", s.SendImage()))).Methods("POST")
+	s.router.Handle("/chat/send/audio", c.Then(s.schedulable("send.audio", s.SendAudio()))).Methods("POST")
+	s.router.Handle("/chat/send/document", c.Then(s.schedulable("send.document", s.SendDocument()))).Methods("POST")
 	//	s.router.Handle("/chat/send/template", c.Then(s.SendTemplate())).Methods("POST")
-	s.router.Handle("/chat/send/video", c.Then(s.SendVideo())).Methods("POST")
-	s.router.Handle("/chat/send/sticker", c.Then(s.SendSticker())).Methods("POST")
-	s.router.Handle("/chat/send/location", c.Then(s.SendLocation())).Methods("POST")
-	s.router.Handle("/chat/send/contact", c.Then(s.SendContact())).Methods("POST")
+	s.router.Handle("/chat/send/video", c.Then(s.schedulable("send.video", s.SendVideo()))).Methods("POST")
+	s.router.Handle("/chat/send/sticker", c.Then(s.schedulable("send.sticker", s.SendSticker()))).Methods("POST")
+	s.router.Handle("/chat/send/location", c.Then(s.schedulable("send.location", s.SendLocation()))).Methods("POST")
+	s.router.Handle("/chat/send/contact", c.Then(s.schedulable("send.contact", s.SendContact()))).Methods("POST")
 	s.router.Handle("/chat/react", c.Then(s.React())).Methods("POST")
-	s.router.Handle("/chat/send/buttons", c.Then(s.SendButtons())).Methods("POST")
-	s.router.Handle("/chat/send/list", c.Then(s.SendList())).Methods("POST")
-	s.router.Handle("/chat/send/poll", c.Then(s.SendPoll())).Methods("POST")
-	s.router.Handle("/chat/send/edit", c.Then(s.SendEditMessage())).Methods("POST")
+	s.router.Handle("/chat/send/buttons", c.Then(s.schedulable("send.buttons", s.SendButtons()))).Methods("POST")
+	s.router.Handle("/chat/send/list", c.Then(s.schedulable("send.list", s.SendList()))).Methods("POST")
+	s.router.Handle("/chat/send/poll", c.Then(s.schedulable("send.poll", s.SendPoll()))).Methods("POST")
+	s.router.Handle("/chat/poll/{id}/results", c.Then(s.GetPollResults())).Methods("GET")
+	s.router.Handle("/chat/messages", c.Then(s.ListMessages())).Methods("GET")
+	s.router.Handle("/chat/search", c.Then(s.SearchMessages())).Methods("GET")
+	s.router.Handle("/chat/list", c.Then(s.ListChats())).Methods("GET")
+	s.router.Handle("/chat/message/{id}/status", c.Then(s.GetMessageStatus())).Methods("GET")
+	s.router.Handle("/chat/export", c.Then(s.ExportChat())).Methods("POST")
+	s.router.Handle("/chat/broadcast", c.Then(s.CreateBroadcast())).Methods("POST")
+	s.router.Handle("/chat/broadcast/{id}", c.Then(s.GetBroadcast())).Methods("GET")
+	s.router.Handle("/chat/broadcast/{id}", c.Then(s.CancelBroadcast())).Methods("DELETE")
+	s.router.Handle("/chat/scheduled", c.Then(s.ListScheduledMessages())).Methods("GET")
+	s.router.Handle("/chat/scheduled/{id}", c.Then(s.CancelScheduledMessage())).Methods("DELETE")
+	s.router.Handle("/chat/send/edit", c.Then(s.schedulable("send.edit", s.SendEditMessage()))).Methods("POST")
 
 	s.router.Handle("/user/presence", c.Then(s.SendPresence())).Methods("POST")
 	s.router.Handle("/user/info", c.Then(s.GetUser())).Methods("POST")
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -234,6 +235,23 @@ func (m *S3Manager) UploadToS3(ctx context.Context, userID string, key string, d
 	return nil
 }
 
+// DownloadFromS3 opens a file uploaded with UploadToS3, the caller reads it as it arrives and closes it
+func (m *S3Manager) DownloadFromS3(ctx context.Context, userID string, key string) (io.ReadCloser, error) {
+	client, config, ok := m.GetClient(userID)
+	if !ok {
+		return nil, fmt.Errorf("S3 client not initialized for user %s", userID)
+	}
+
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from S3: %w", err)
+	}
+	return output.Body, nil
+}
+
 // GetPublicURL generates public URL for S3 object
 func (m *S3Manager) GetPublicURL(userID, key string) string {
 	_, config, ok := m.GetClient(userID)
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// Scheduled message states. A message is sending from the moment its Id is reserved until the send returns,
+// it is skipped when the session stays disconnected past the allowed delay.
+const (
+	scheduledPending   = "pending"
+	scheduledSending   = "sending"
+	scheduledSent      = "sent"
+	scheduledFailed    = "failed"
+	scheduledSkipped   = "skipped"
+	scheduledCancelled = "cancelled"
+)
+
+// How long a due message waits before checking again for a disconnected session
+const scheduledSessionWait = 10 * time.Second
+
+// scheduledMessage is a request to a send endpoint kept until its SendAt time
+type scheduledMessage struct {
+	ID            string   `db:"id" json:"id"`
+	UserID        string   `db:"user_id" json:"-"`
+	Action        string   `db:"action" json:"action"`
+	Chat          string   `db:"chat" json:"chat"`
+	Payload       jsonText `db:"payload" json:"payload"`
+	SendAt        int64    `db:"send_at" json:"send_at"`
+	NextAttemptAt int64    `db:"next_attempt_at" json:"-"`
+	Status        string   `db:"status" json:"status"`
+	Attempts      int      `db:"attempts" json:"attempts"`
+	MessageID     string   `db:"message_id" json:"message_id"`
+	Error         string   `db:"error" json:"error,omitempty"`
+	CreatedAt     int64    `db:"created_at" json:"created_at"`
+	FinishedAt    int64    `db:"finished_at" json:"finished_at"`
+}
+
+// Columns selected whenever a scheduled message is loaded
+const scheduledMessageColumns = "id, user_id, action, chat, payload, send_at, next_attempt_at, status, attempts, message_id, error, created_at, finished_at"
+
+// messageScheduler sends the scheduled messages when they are due
+type messageScheduler struct {
+	s           *server
+	maxAttempts int
+	maxDelay    int64
+	sendTimeout time.Duration
+	// Users are served by at most len(workers) goroutines at a time, one per user so their messages stay in order
+	workers chan struct{}
+	mu      sync.Mutex
+	busy    map[string]bool
+}
+
+// schedulable lets a send endpoint take a SendAt unix timestamp. A message with a SendAt in the future is
+// stored and sent by the scheduler when it is due, other requests go straight to the endpoint.
+func (s *server) schedulable(action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not read Payload"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Payloads the endpoint cannot decode are left for it to reject
+		payload := map[string]interface{}{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		value, scheduled := payload["SendAt"]
+		sendAt, ok := value.(float64)
+		if scheduled && value != nil && !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid SendAt, it must be a unix timestamp in seconds"))
+			return
+		}
+		if int64(sendAt) <= time.Now().Unix() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		delete(payload, "SendAt")
+		m, err := scheduleMessage(s.db, txtid, action, payload, int64(sendAt))
+		if err != nil {
+			var invalid scheduleError
+			if errors.As(err, &invalid) {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			log.Error().Err(err).Str("action", action).Msg("Failed to schedule message")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to schedule message"))
+			return
+		}
+		log.Info().Str("id", m.ID).Str("action", action).Int64("sendAt", m.SendAt).Msg("Message scheduled")
+
+		response := map[string]interface{}{"Details": "Scheduled", "ScheduledId": m.ID, "SendAt": m.SendAt}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	})
+}
+
+// scheduleError is a scheduled message refused because of its payload
+type scheduleError string
+
+func (e scheduleError) Error() string {
+	return string(e)
+}
+
+// scheduleMessage stores the payload of a send endpoint to be sent at sendAt. The recipient is checked now,
+// the rest of the payload is checked by the endpoint when the message is sent.
+func scheduleMessage(db *sqlx.DB, userID, action string, payload map[string]interface{}, sendAt int64) (*scheduledMessage, error) {
+	// Polls take their recipient in group, the other endpoints in Phone
+	field := "Phone"
+	if action == "send.poll" {
+		field = "group"
+	}
+	phone, _ := payload[field].(string)
+	if phone == "" {
+		return nil, scheduleError("missing " + field + " in Payload")
+	}
+	chat, ok := parseJID(phone)
+	if !ok {
+		return nil, scheduleError("could not parse " + field)
+	}
+
+	id, err := GenerateRandomID()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	m := &scheduledMessage{
+		ID:            id,
+		UserID:        userID,
+		Action:        action,
+		Chat:          chat.ToNonAD().String(),
+		Payload:       jsonText(data),
+		SendAt:        sendAt,
+		NextAttemptAt: sendAt,
+		Status:        scheduledPending,
+		CreatedAt:     time.Now().Unix(),
+	}
+	_, err = db.Exec(`INSERT INTO scheduled_messages (id, user_id, action, chat, payload, send_at, next_attempt_at, status, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		m.ID, m.UserID, m.Action, m.Chat, string(m.Payload), m.SendAt, m.NextAttemptAt, m.Status, m.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// listScheduledMessages returns the scheduled messages of a user in a state, by send time. Pending
+// includes the messages being sent.
+func listScheduledMessages(db *sqlx.DB, userID, state string) ([]scheduledMessage, error) {
+	states := []string{state}
+	if state == scheduledPending {
+		states = append(states, scheduledSending)
+	}
+	query, args, err := sqlx.In("SELECT "+scheduledMessageColumns+" FROM scheduled_messages WHERE user_id=? AND status IN (?) ORDER BY send_at, created_at",
+		userID, states)
+	if err != nil {
+		return nil, err
+	}
+	messages := []scheduledMessage{}
+	err = db.Select(&messages, db.Rebind(query), args...)
+	return messages, err
+}
+
+// getScheduledMessage returns a scheduled message of a user, sql.ErrNoRows means it does not exist
+func getScheduledMessage(db *sqlx.DB, userID, id string) (*scheduledMessage, error) {
+	var m scheduledMessage
+	err := db.Get(&m, "SELECT "+scheduledMessageColumns+" FROM scheduled_messages WHERE id=$1 AND user_id=$2", id, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// cancelScheduledMessage cancels a message that was not sent yet. It returns false if the message
+// is not pending anymore.
+func cancelScheduledMessage(db *sqlx.DB, userID, id string) (bool, error) {
+	res, err := db.Exec("UPDATE scheduled_messages SET status=$1, finished_at=$2 WHERE id=$3 AND user_id=$4 AND status=$5",
+		scheduledCancelled, time.Now().Unix(), id, userID, scheduledPending)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// StartScheduler sends the scheduled messages when they are due, including the ones that came due
+// while the server was stopped
+func (s *server) StartScheduler() {
+	sched := &messageScheduler{
+		s:           s,
+		maxAttempts: getEnvInt("SCHEDULED_MAX_ATTEMPTS", 3),
+		maxDelay:    int64(getEnvInt("SCHEDULED_MAX_DELAY_SECONDS", 86400)),
+		sendTimeout: time.Duration(getEnvInt("SCHEDULED_SEND_TIMEOUT_SECONDS", 60)) * time.Second,
+		busy:        map[string]bool{},
+	}
+	if sched.maxAttempts < 1 {
+		sched.maxAttempts = 1
+	}
+	if sched.sendTimeout <= 0 {
+		sched.sendTimeout = 60 * time.Second
+	}
+	workers := getEnvInt("SCHEDULED_WORKERS", 10)
+	if workers < 1 {
+		workers = 1
+	}
+	sched.workers = make(chan struct{}, workers)
+	sched.settleInterrupted()
+	go sched.run()
+
+	log.Info().Int("maxAttempts", sched.maxAttempts).Int64("maxDelay", sched.maxDelay).Int("workers", workers).Msg("Message scheduler started")
+}
+
+// settleInterrupted decides the fate of the messages whose send was interrupted by a restart. The message
+// went out if the server acknowledged it, otherwise it is sent again with the same Id.
+func (sched *messageScheduler) settleInterrupted() {
+	interrupted := []scheduledMessage{}
+	err := sched.s.db.Select(&interrupted, "SELECT "+scheduledMessageColumns+" FROM scheduled_messages WHERE status=$1", scheduledSending)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load interrupted scheduled messages")
+		return
+	}
+	for _, m := range interrupted {
+		sent, sentAt := false, int64(0)
+		if m.MessageID != "" {
+			if sent, sentAt, err = messageAcknowledged(sched.s.db, m.UserID, m.MessageID); err != nil {
+				log.Error().Err(err).Str("id", m.ID).Msg("Could not check interrupted scheduled message")
+				continue
+			}
+		}
+		if sent {
+			m.Attempts++
+			sched.finish(m, scheduledSent, "", sentAt)
+			continue
+		}
+		_, err = sched.s.db.Exec("UPDATE scheduled_messages SET status=$1 WHERE id=$2", scheduledPending, m.ID)
+		if err != nil {
+			log.Error().Err(err).Str("id", m.ID).Msg("Could not reset interrupted scheduled message")
+		}
+	}
+}
+
+func (sched *messageScheduler) run() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		users := []string{}
+		err := sched.s.db.Select(&users, "SELECT DISTINCT user_id FROM scheduled_messages WHERE status=$1 AND next_attempt_at <= $2",
+			scheduledPending, time.Now().Unix())
+		if err != nil {
+			log.Error().Err(err).Msg("Could not load due scheduled messages")
+			continue
+		}
+		for _, userID := range users {
+			sched.mu.Lock()
+			busy := sched.busy[userID]
+			sched.busy[userID] = true
+			sched.mu.Unlock()
+			if busy {
+				continue
+			}
+			sched.workers <- struct{}{}
+			go func(userID string) {
+				defer func() {
+					sched.mu.Lock()
+					delete(sched.busy, userID)
+					sched.mu.Unlock()
+					<-sched.workers
+				}()
+				sched.runUser(userID)
+			}(userID)
+		}
+	}
+}
+
+// runUser sends the due messages of a user. They are sent one at a time, so the ones due together arrive in order.
+func (sched *messageScheduler) runUser(userID string) {
+	due := []scheduledMessage{}
+	err := sched.s.db.Select(&due, "SELECT "+scheduledMessageColumns+" FROM scheduled_messages WHERE user_id=$1 AND status=$2 AND next_attempt_at <= $3 ORDER BY next_attempt_at, created_at LIMIT 100",
+		userID, scheduledPending, time.Now().Unix())
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Could not load due scheduled messages")
+		return
+	}
+	for _, m := range due {
+		sched.dispatch(m)
+	}
+}
+
+// dispatch sends a due message through its send endpoint. While the session is disconnected the message
+// waits, up to the allowed delay after which it is skipped. Sends that fail on the server side are retried.
+func (sched *messageScheduler) dispatch(m scheduledMessage) {
+	db := sched.s.db
+	now := time.Now().Unix()
+
+	cli := connectedClient(m.UserID)
+	if cli == nil {
+		if sched.maxDelay > 0 && now-m.SendAt > sched.maxDelay {
+			sched.finish(m, scheduledSkipped, "session was not connected", 0)
+			return
+		}
+		sched.retryAt(m, now+int64(scheduledSessionWait/time.Second), m.Attempts, m.Error)
+		return
+	}
+	userinfo, err := sched.s.lookupUserInfoByID(m.UserID)
+	if err != nil {
+		log.Error().Err(err).Str("id", m.ID).Msg("Could not look up scheduled message user")
+		sched.retryAt(m, now+int64(scheduledSessionWait/time.Second), m.Attempts, m.Error)
+		return
+	}
+
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(m.Payload), &payload); err != nil {
+		sched.finish(m, scheduledFailed, "could not decode stored payload", 0)
+		return
+	}
+	// The Id is reserved before sending and kept when a send is retried, so the message cannot arrive twice.
+	// The Id of an edit is the one of the edited message.
+	if m.Action != "send.edit" {
+		if id, _ := payload["Id"].(string); id != "" {
+			m.MessageID = id
+		} else if m.MessageID == "" {
+			m.MessageID = cli.GenerateMessageID()
+		}
+		payload["Id"] = m.MessageID
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		sched.finish(m, scheduledFailed, err.Error(), 0)
+		return
+	}
+	res, err := db.Exec("UPDATE scheduled_messages SET status=$1, message_id=$2 WHERE id=$3 AND status=$4",
+		scheduledSending, m.MessageID, m.ID, scheduledPending)
+	if err != nil {
+		log.Error().Err(err).Str("id", m.ID).Msg("Could not claim scheduled message")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Cancelled in the meantime
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sched.sendTimeout)
+	code, envelope := sched.s.executeCommand(ctx, userinfo, m.Action, data)
+	cancel()
+	if code == http.StatusOK {
+		m.Attempts++
+		sentAt := time.Now().Unix()
+		if result, ok := envelope["data"].(map[string]interface{}); ok {
+			if id, ok := result["Id"].(string); ok && id != "" {
+				m.MessageID = id
+			}
+			if ts, ok := result["Timestamp"].(float64); ok {
+				sentAt = int64(ts)
+			}
+		}
+		sched.finish(m, scheduledSent, "", sentAt)
+		return
+	}
+
+	errText, _ := envelope["error"].(string)
+	if errText == "" {
+		errText = fmt.Sprintf("send failed with status %d", code)
+	}
+	if connectedClient(m.UserID) == nil {
+		// The session dropped during the send, it does not count as an attempt
+		sched.retryAt(m, time.Now().Unix()+int64(scheduledSessionWait/time.Second), m.Attempts, errText)
+		return
+	}
+	if delay, ok := sched.retryDelay(code, m.Attempts); ok {
+		sched.retryAt(m, time.Now().Unix()+delay, m.Attempts+1, errText)
+		return
+	}
+	m.Attempts++
+	sched.finish(m, scheduledFailed, errText, 0)
+}
+
+// retryDelay returns how many seconds to wait before sending again a message whose send failed with code
+// after the given number of attempts, false when it has failed for good. Only server side errors are retried.
+func (sched *messageScheduler) retryDelay(code, attempts int) (int64, bool) {
+	if code < http.StatusInternalServerError || attempts+1 >= sched.maxAttempts {
+		return 0, false
+	}
+	return int64(30) << attempts, true
+}
+
+// retryAt puts a message back in the queue until the given time
+func (sched *messageScheduler) retryAt(m scheduledMessage, at int64, attempts int, errText string) {
+	_, err := sched.s.db.Exec("UPDATE scheduled_messages SET status=$1, next_attempt_at=$2, attempts=$3, message_id=$4, error=$5 WHERE id=$6 AND status IN ($7,$8)",
+		scheduledPending, at, attempts, m.MessageID, errText, m.ID, scheduledPending, scheduledSending)
+	if err != nil {
+		log.Error().Err(err).Str("id", m.ID).Msg("Could not reschedule message")
+	}
+}
+
+// finish records the outcome of a scheduled message and reports it with a ScheduledMessage event. A message
+// cancelled in the meantime is left as it is.
+func (sched *messageScheduler) finish(m scheduledMessage, status, errText string, sentAt int64) {
+	now := time.Now().Unix()
+	res, err := sched.s.db.Exec("UPDATE scheduled_messages SET status=$1, attempts=$2, message_id=$3, error=$4, finished_at=$5 WHERE id=$6 AND status IN ($7,$8)",
+		status, m.Attempts, m.MessageID, errText, now, m.ID, scheduledPending, scheduledSending)
+	if err != nil {
+		log.Error().Err(err).Str("id", m.ID).Str("status", status).Msg("Could not record scheduled message result")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+	log.Info().Str("id", m.ID).Str("action", m.Action).Str("status", status).Str("error", errText).Msg("Scheduled message processed")
+
+	sendSystemEvent(sched.s.db, m.UserID, map[string]interface{}{
+		"type": "ScheduledMessage",
+		"event": map[string]interface{}{
+			"id":         m.ID,
+			"action":     m.Action,
+			"chat":       m.Chat,
+			"status":     status,
+			"message_id": m.MessageID,
+			"send_at":    m.SendAt,
+			"sent_at":    sentAt,
+			"attempts":   m.Attempts,
+			"error":      errText,
+		},
+	})
+}
+
+// isSendAction reports whether an action sends a message, those accept a SendAt
+func isSendAction(action string) bool {
+	return strings.HasPrefix(action, "send.")
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// serveSchedulable sends body to a schedulable endpoint for the test user. It returns the response and
+// the body the endpoint received, empty when the request did not reach it.
+func serveSchedulable(t *testing.T, s *server, action, body string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	passed := ""
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		passed = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r := httptest.NewRequest("POST", "/chat/send/text", strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), "userinfo", Values{map[string]string{"Id": "user"}}))
+	w := httptest.NewRecorder()
+	s.schedulable(action, next).ServeHTTP(w, r)
+	return w, passed
+}
+
+func TestSchedulablePassesThrough(t *testing.T) {
+	s := &server{db: newTestDB(t)}
+	past := time.Now().Add(-time.Minute).Unix()
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "no SendAt", body: `{"Phone":"5491155551234","Body":"hi"}`},
+		{name: "null SendAt", body: `{"Phone":"5491155551234","Body":"hi","SendAt":null}`},
+		{name: "past SendAt", body: fmt.Sprintf(`{"Phone":"5491155551234","Body":"hi","SendAt":%d}`, past)},
+		{name: "not JSON", body: `Phone=5491155551234`},
+	}
+	for _, tt := range tests {
+		w, passed := serveSchedulable(t, s, "send.text", tt.body)
+		if w.Code != http.StatusNoContent || passed != tt.body {
+			t.Errorf("%s: got status %d and body %q, want the request passed through", tt.name, w.Code, passed)
+		}
+	}
+	var count int
+	if err := s.db.Get(&count, "SELECT COUNT(*) FROM scheduled_messages"); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("got %d scheduled messages, want 0", count)
+	}
+}
+
+func TestSchedulableRejects(t *testing.T) {
+	s := &server{db: newTestDB(t)}
+	future := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name   string
+		action string
+		body   string
+		want   string
+	}{
+		{
+			name:   "SendAt as text",
+			action: "send.text",
+			body:   `{"Phone":"5491155551234","SendAt":"tomorrow"}`,
+			want:   "invalid SendAt, it must be a unix timestamp in seconds",
+		},
+		{
+			name:   "missing Phone",
+			action: "send.text",
+			body:   fmt.Sprintf(`{"Body":"hi","SendAt":%d}`, future),
+			want:   "missing Phone in Payload",
+		},
+		{
+			name:   "poll without group",
+			action: "send.poll",
+			body:   fmt.Sprintf(`{"Phone":"5491155551234","SendAt":%d}`, future),
+			want:   "missing group in Payload",
+		},
+		{
+			name:   "invalid Phone",
+			action: "send.text",
+			body:   fmt.Sprintf(`{"Phone":"@s.whatsapp.net","SendAt":%d}`, future),
+			want:   "could not parse Phone",
+		},
+	}
+	for _, tt := range tests {
+		w, passed := serveSchedulable(t, s, tt.action, tt.body)
+		var response struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusBadRequest || response.Error != tt.want || passed != "" {
+			t.Errorf("%s: got status %d, error %q, passed %t, want 400 %q", tt.name, w.Code, response.Error, passed != "", tt.want)
+		}
+	}
+}
+
+func TestSchedulableSchedules(t *testing.T) {
+	s := &server{db: newTestDB(t)}
+	future := time.Now().Add(time.Hour).Unix()
+	w, passed := serveSchedulable(t, s, "send.text", fmt.Sprintf(`{"Phone":"5491155551234","Body":"hi","SendAt":%d}`, future))
+	if w.Code != http.StatusOK || passed != "" {
+		t.Fatalf("got status %d, passed %t, want 200 without calling the endpoint", w.Code, passed != "")
+	}
+	var response struct {
+		Data struct {
+			Details     string
+			ScheduledId string
+			SendAt      int64
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Data.Details != "Scheduled" || response.Data.ScheduledId == "" || response.Data.SendAt != future {
+		t.Fatalf("got response %+v", response.Data)
+	}
+
+	var m scheduledMessage
+	if err := s.db.Get(&m, "SELECT * FROM scheduled_messages WHERE id = $1", response.Data.ScheduledId); err != nil {
+		t.Fatal(err)
+	}
+	if m.UserID != "user" || m.Action != "send.text" || m.Chat != "5491155551234@s.whatsapp.net" ||
+		m.SendAt != future || m.NextAttemptAt != future || m.Status != scheduledPending {
+		t.Errorf("got scheduled message %+v", m)
+	}
+	// SendAt is not part of the payload sent when the message is due
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(m.Payload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := payload["SendAt"]; ok || payload["Body"] != "hi" {
+		t.Errorf("got payload %v", payload)
+	}
+}
+
+// newTestScheduler returns a scheduler that tries each message 3 times and skips it an hour after its time
+func newTestScheduler(db *sqlx.DB) *messageScheduler {
+	return &messageScheduler{
+		s:           &server{db: db},
+		maxAttempts: 3,
+		maxDelay:    3600,
+		sendTimeout: time.Minute,
+		workers:     make(chan struct{}, 1),
+		busy:        map[string]bool{},
+	}
+}
+
+// scheduleTestMessage schedules a text message of the test user at sendAt
+func scheduleTestMessage(t *testing.T, db *sqlx.DB, sendAt int64) scheduledMessage {
+	t.Helper()
+	m, err := scheduleMessage(db, "user", "send.text", map[string]interface{}{"Phone": "5491155551234", "Body": "hi"}, sendAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *m
+}
+
+// recordScheduledEvents subscribes the test user to every event and returns the sink they are sent to
+func recordScheduledEvents(t *testing.T, db *sqlx.DB) *recordingSink {
+	t.Helper()
+	if _, err := db.Exec("INSERT INTO user_webhooks (id, user_id, url, events) VALUES ('hook', 'user', 'http://example.com', 'All')"); err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{name: "events"}
+	withEventSinks(t, registeredSink{sink: sink, scope: sinkScopeAll})
+	return sink
+}
+
+// scheduledEventStatuses returns the status of each ScheduledMessage event sent
+func scheduledEventStatuses(t *testing.T, sink *recordingSink) []string {
+	t.Helper()
+	statuses := []string{}
+	for _, evt := range sink.events {
+		var payload struct {
+			Type  string `json:"type"`
+			Event struct {
+				Status string `json:"status"`
+			} `json:"event"`
+		}
+		if err := json.Unmarshal(evt.Data, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Type == "ScheduledMessage" {
+			statuses = append(statuses, payload.Event.Status)
+		}
+	}
+	return statuses
+}
+
+func TestSchedulerRetryDelay(t *testing.T) {
+	sched := newTestScheduler(nil)
+	tests := []struct {
+		code      int
+		attempts  int
+		wantDelay int64
+		wantRetry bool
+	}{
+		{code: http.StatusInternalServerError, attempts: 0, wantDelay: 30, wantRetry: true},
+		{code: http.StatusServiceUnavailable, attempts: 1, wantDelay: 60, wantRetry: true},
+		{code: http.StatusInternalServerError, attempts: 2, wantRetry: false},
+		{code: http.StatusBadRequest, attempts: 0, wantRetry: false},
+		{code: http.StatusUnauthorized, attempts: 0, wantRetry: false},
+	}
+	for _, tt := range tests {
+		delay, retry := sched.retryDelay(tt.code, tt.attempts)
+		if delay != tt.wantDelay || retry != tt.wantRetry {
+			t.Errorf("retryDelay(%d, %d) = %d, %t, want %d, %t", tt.code, tt.attempts, delay, retry, tt.wantDelay, tt.wantRetry)
+		}
+	}
+}
+
+func TestSchedulerDispatchWithoutSession(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name       string
+		late       int64
+		maxDelay   int64
+		wantStatus string
+		wantEvents []string
+	}{
+		{name: "waits for the session", late: 60, maxDelay: 3600, wantStatus: scheduledPending, wantEvents: []string{}},
+		{name: "too late", late: 7200, maxDelay: 3600, wantStatus: scheduledSkipped, wantEvents: []string{scheduledSkipped}},
+		{name: "waits forever", late: 7200, maxDelay: 0, wantStatus: scheduledPending, wantEvents: []string{}},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		events := recordScheduledEvents(t, db)
+		sched := newTestScheduler(db)
+		sched.maxDelay = tt.maxDelay
+		m := scheduleTestMessage(t, db, now-tt.late)
+
+		sched.dispatch(m)
+		got, err := getScheduledMessage(db, "user", m.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.wantStatus || got.Attempts != 0 {
+			t.Errorf("%s: got %s after %d attempts, want %s after none", tt.name, got.Status, got.Attempts, tt.wantStatus)
+		}
+		if got.Status == scheduledPending && got.NextAttemptAt < now+int64(scheduledSessionWait/time.Second) {
+			t.Errorf("%s: next attempt at %d, want it delayed by %s", tt.name, got.NextAttemptAt-now, scheduledSessionWait)
+		}
+		if statuses := scheduledEventStatuses(t, events); !reflect.DeepEqual(statuses, tt.wantEvents) {
+			t.Errorf("%s: got events %v, want %v", tt.name, statuses, tt.wantEvents)
+		}
+	}
+}
+
+func TestSchedulerFinish(t *testing.T) {
+	tests := []struct {
+		name       string
+		cancelled  bool
+		wantStatus string
+		wantEvents []string
+	}{
+		{name: "pending", wantStatus: scheduledSkipped, wantEvents: []string{scheduledSkipped}},
+		{name: "cancelled in the meantime", cancelled: true, wantStatus: scheduledCancelled, wantEvents: []string{}},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		events := recordScheduledEvents(t, db)
+		sched := newTestScheduler(db)
+		m := scheduleTestMessage(t, db, time.Now().Unix()-7200)
+		if tt.cancelled {
+			if _, err := cancelScheduledMessage(db, "user", m.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sched.finish(m, scheduledSkipped, "session was not connected", 0)
+		got, err := getScheduledMessage(db, "user", m.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.wantStatus {
+			t.Errorf("%s: got %s, want %s", tt.name, got.Status, tt.wantStatus)
+		}
+		if statuses := scheduledEventStatuses(t, events); !reflect.DeepEqual(statuses, tt.wantEvents) {
+			t.Errorf("%s: got events %v, want %v", tt.name, statuses, tt.wantEvents)
+		}
+	}
+}
+
+func TestSchedulerSettleInterrupted(t *testing.T) {
+	sentAt := time.Unix(1717240000, 0)
+	tests := []struct {
+		name         string
+		messageID    string
+		sent         string
+		wantStatus   string
+		wantAttempts int
+		wantEvents   []string
+	}{
+		{name: "no Id reserved", wantStatus: scheduledPending, wantEvents: []string{}},
+		{name: "not sent", messageID: "3EB0AA", wantStatus: scheduledPending, wantEvents: []string{}},
+		{name: "send failed", messageID: "3EB0AA", sent: messageStatusFailed, wantStatus: scheduledPending, wantEvents: []string{}},
+		{name: "acknowledged", messageID: "3EB0AA", sent: messageStatusSent, wantStatus: scheduledSent, wantAttempts: 1, wantEvents: []string{scheduledSent}},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		events := recordScheduledEvents(t, db)
+		sched := newTestScheduler(db)
+		m := scheduleTestMessage(t, db, sentAt.Unix())
+		_, err := db.Exec("UPDATE scheduled_messages SET status=$1, message_id=$2 WHERE id=$3", scheduledSending, tt.messageID, m.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chat := types.NewJID("5491155551234", types.DefaultUserServer)
+		switch tt.sent {
+		case messageStatusSent:
+			err = recordOutgoingMessage(db, "user", tt.messageID, chat, sentAt)
+		case messageStatusFailed:
+			storeFailedMessage(db, "user", chat, tt.messageID, errors.New("timed out"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sched.settleInterrupted()
+		got, err := getScheduledMessage(db, "user", m.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.wantStatus || got.Attempts != tt.wantAttempts || got.MessageID != tt.messageID {
+			t.Errorf("%s: got %s after %d attempts with Id %q, want %s after %d", tt.name, got.Status, got.Attempts, got.MessageID, tt.wantStatus, tt.wantAttempts)
+		}
+		if statuses := scheduledEventStatuses(t, events); !reflect.DeepEqual(statuses, tt.wantEvents) {
+			t.Errorf("%s: got events %v, want %v", tt.name, statuses, tt.wantEvents)
+		}
+	}
+}
+
+func TestCancelScheduledMessage(t *testing.T) {
+	db := newTestDB(t)
+	future := time.Now().Add(time.Hour).Unix()
+	pending := scheduleTestMessage(t, db, future)
+	sending := scheduleTestMessage(t, db, future)
+	if _, err := db.Exec("UPDATE scheduled_messages SET status=$1 WHERE id=$2", scheduledSending, sending.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		userID string
+		id     string
+		want   bool
+	}{
+		{name: "another user", userID: "other", id: pending.ID, want: false},
+		{name: "pending", userID: "user", id: pending.ID, want: true},
+		{name: "already cancelled", userID: "user", id: pending.ID, want: false},
+		{name: "being sent", userID: "user", id: sending.ID, want: false},
+		{name: "unknown", userID: "user", id: "missing", want: false},
+	}
+	for _, tt := range tests {
+		got, err := cancelScheduledMessage(db, tt.userID, tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	m, err := getScheduledMessage(db, "user", pending.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Status != scheduledCancelled || m.FinishedAt == 0 {
+		t.Errorf("got %s finished at %d, want cancelled", m.Status, m.FinishedAt)
+	}
+	if m, _ := getScheduledMessage(db, "user", sending.ID); m.Status != scheduledSending {
+		t.Errorf("got message being sent %s, want it left as it is", m.Status)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Message types understood by the message_types webhook filter
+var supportedMessageTypes = []string{
+	"text",
+	"image",
+	"video",
+	"audio",
+	"document",
+	"sticker",
+	"location",
+	"contact",
+	"reaction",
+	"poll",
+	"poll_vote",
+	"other",
+}
+
+// WebhookFilters narrows down which events a webhook receives, on top of its event types.
+// Events that are not tied to a chat (Connected, QR, ...) are never filtered out.
+type WebhookFilters struct {
+	IncludeChats []string `json:"include_chats,omitempty"`
+	ExcludeChats []string `json:"exclude_chats,omitempty"`
+	ChatType     string   `json:"chat_type,omitempty"` // "group", "direct" or empty for both
+	FromMe       *bool    `json:"from_me,omitempty"`
+	MessageTypes []string `json:"message_types,omitempty"`
+}
+
+// webhookEventContext holds the parts of an event the filters are evaluated against
+type webhookEventContext struct {
+	HasChat     bool
+	Chat        types.JID
+	IsGroup     bool
+	IsFromMe    bool
+	MessageType string
+}
+
+// validate checks filters sent to CreateWebhook and UpdateWebhook
+func (f WebhookFilters) validate() error {
+	switch f.ChatType {
+	case "", "group", "direct":
+	default:
+		return fmt.Errorf("invalid chat_type %q, use group or direct", f.ChatType)
+	}
+	for _, t := range f.MessageTypes {
+		if !Find(supportedMessageTypes, t) {
+			return fmt.Errorf("invalid message type %q", t)
+		}
+	}
+	return nil
+}
+
+// Match reports whether an event with the given context passes the filters
+func (f WebhookFilters) Match(ctx webhookEventContext) bool {
+	if !ctx.HasChat {
+		return true
+	}
+	if len(f.IncludeChats) > 0 && !matchChat(f.IncludeChats, ctx.Chat) {
+		return false
+	}
+	if matchChat(f.ExcludeChats, ctx.Chat) {
+		return false
+	}
+	if f.ChatType == "group" && !ctx.IsGroup {
+		return false
+	}
+	if f.ChatType == "direct" && ctx.IsGroup {
+		return false
+	}
+	if f.FromMe != nil && *f.FromMe != ctx.IsFromMe {
+		return false
+	}
+	// Message type filters only apply to messages
+	if len(f.MessageTypes) > 0 && ctx.MessageType != "" && !Find(f.MessageTypes, ctx.MessageType) {
+		return false
+	}
+	return true
+}
+
+// matchChat accepts full JIDs as well as bare phone numbers or group IDs
+func matchChat(chats []string, chat types.JID) bool {
+	full := chat.ToNonAD().String()
+	for _, c := range chats {
+		c = strings.TrimSpace(c)
+		if c == full || c == chat.User {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeWebhookFilters stores filters as a JSON object, empty filters are stored as ""
+func encodeWebhookFilters(f WebhookFilters) (string, error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return "", err
+	}
+	if string(data) == "{}" {
+		return "", nil
+	}
+	return string(data), nil
+}
+
+// decodeWebhookFilters parses filters stored by encodeWebhookFilters
+func decodeWebhookFilters(stored string) WebhookFilters {
+	var f WebhookFilters
+	if stored == "" {
+		return f
+	}
+	if err := json.Unmarshal([]byte(stored), &f); err != nil {
+		log.Warn().Err(err).Msg("Could not decode webhook filters")
+	}
+	return f
+}
+
+// eventContextFromPostmap extracts the chat, sender and message type from the raw whatsmeow event
+func eventContextFromPostmap(postmap map[string]interface{}) webhookEventContext {
+	var ctx webhookEventContext
+	switch evt := postmap["event"].(type) {
+	case *events.Message:
+		ctx = sourceEventContext(evt.Info.MessageSource)
+		ctx.MessageType = getMessageType(evt.Message)
+	case *events.Receipt:
+		ctx = sourceEventContext(evt.MessageSource)
+	case *events.ChatPresence:
+		ctx = sourceEventContext(evt.MessageSource)
+	case *events.Presence:
+		ctx = webhookEventContext{HasChat: true, Chat: evt.From}
+	case *pollVoteEvent:
+		ctx = sourceEventContext(evt.source)
+		ctx.MessageType = "poll_vote"
+	case *events.UndecryptableMessage:
+		ctx = sourceEventContext(evt.Info.MessageSource)
+	case *events.FBMessage:
+		ctx = sourceEventContext(evt.Info.MessageSource)
+	case *events.GroupInfo:
+		ctx = webhookEventContext{HasChat: true, Chat: evt.JID, IsGroup: true}
+	case *events.JoinedGroup:
+		ctx = webhookEventContext{HasChat: true, Chat: evt.JID, IsGroup: true}
+	case *events.Picture:
+		ctx = webhookEventContext{HasChat: true, Chat: evt.JID, IsGroup: evt.JID.Server == types.GroupServer}
+	case *events.CallOffer, *events.CallAccept, *events.CallTerminate, *events.CallOfferNotice, *events.CallRelayLatency:
+		if details, ok := postmap["call"].(map[string]interface{}); ok {
+			ctx = callEventContext(details)
+		}
+	}
+	return ctx
+}
+
+func sourceEventContext(source types.MessageSource) webhookEventContext {
+	return webhookEventContext{
+		HasChat:  true,
+		Chat:     source.Chat,
+		IsGroup:  source.IsGroup,
+		IsFromMe: source.IsFromMe,
+	}
+}
+
+// getMessageType returns a short name for the kind of content carried by a message
+func getMessageType(msg *waE2E.Message) string {
+	switch {
+	case msg == nil:
+		return "other"
+	case msg.GetConversation() != "" || msg.GetExtendedTextMessage() != nil:
+		return "text"
+	case msg.GetImageMessage() != nil:
+		return "image"
+	case msg.GetVideoMessage() != nil || msg.GetPtvMessage() != nil:
+		return "video"
+	case msg.GetAudioMessage() != nil:
+		return "audio"
+	case msg.GetDocumentMessage() != nil || msg.GetDocumentWithCaptionMessage() != nil:
+		return "document"
+	case msg.GetStickerMessage() != nil:
+		return "sticker"
+	case msg.GetLocationMessage() != nil || msg.GetLiveLocationMessage() != nil:
+		return "location"
+	case msg.GetContactMessage() != nil || msg.GetContactsArrayMessage() != nil:
+		return "contact"
+	case msg.GetReactionMessage() != nil || msg.GetEncReactionMessage() != nil:
+		return "reaction"
+	case msg.GetPollCreationMessage() != nil || msg.GetPollCreationMessageV2() != nil || msg.GetPollCreationMessageV3() != nil:
+		return "poll"
+	case msg.GetPollUpdateMessage() != nil:
+		return "poll_vote"
+	}
+	return "other"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWebhookFiltersMatch(t *testing.T) {
+	direct := types.NewJID("5491155551234", types.DefaultUserServer)
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	yes, no := true, false
+
+	tests := []struct {
+		name    string
+		filters WebhookFilters
+		ctx     webhookEventContext
+		want    bool
+	}{
+		{"no filters", WebhookFilters{}, webhookEventContext{HasChat: true, Chat: direct}, true},
+		{"event without chat", WebhookFilters{IncludeChats: []string{"other"}, ChatType: "group"}, webhookEventContext{}, true},
+		{"included by jid", WebhookFilters{IncludeChats: []string{direct.String()}}, webhookEventContext{HasChat: true, Chat: direct}, true},
+		{"included by number", WebhookFilters{IncludeChats: []string{" 5491155551234 "}}, webhookEventContext{HasChat: true, Chat: direct}, true},
+		{"included device jid", WebhookFilters{IncludeChats: []string{direct.String()}}, webhookEventContext{HasChat: true, Chat: types.NewADJID(direct.User, 0, 2)}, true},
+		{"not included", WebhookFilters{IncludeChats: []string{"5491100000000"}}, webhookEventContext{HasChat: true, Chat: direct}, false},
+		{"excluded", WebhookFilters{ExcludeChats: []string{group.User}}, webhookEventContext{HasChat: true, Chat: group, IsGroup: true}, false},
+		{"exclude wins over include", WebhookFilters{IncludeChats: []string{direct.User}, ExcludeChats: []string{direct.User}}, webhookEventContext{HasChat: true, Chat: direct}, false},
+		{"groups only, group", WebhookFilters{ChatType: "group"}, webhookEventContext{HasChat: true, Chat: group, IsGroup: true}, true},
+		{"groups only, direct", WebhookFilters{ChatType: "group"}, webhookEventContext{HasChat: true, Chat: direct}, false},
+		{"direct only, group", WebhookFilters{ChatType: "direct"}, webhookEventContext{HasChat: true, Chat: group, IsGroup: true}, false},
+		{"from me only, sent", WebhookFilters{FromMe: &yes}, webhookEventContext{HasChat: true, Chat: direct, IsFromMe: true}, true},
+		{"from me only, received", WebhookFilters{FromMe: &yes}, webhookEventContext{HasChat: true, Chat: direct}, false},
+		{"received only, sent", WebhookFilters{FromMe: &no}, webhookEventContext{HasChat: true, Chat: direct, IsFromMe: true}, false},
+		{"message type listed", WebhookFilters{MessageTypes: []string{"image", "video"}}, webhookEventContext{HasChat: true, Chat: direct, MessageType: "image"}, true},
+		{"message type not listed", WebhookFilters{MessageTypes: []string{"image"}}, webhookEventContext{HasChat: true, Chat: direct, MessageType: "text"}, false},
+		{"message types skip other events", WebhookFilters{MessageTypes: []string{"image"}}, webhookEventContext{HasChat: true, Chat: direct}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filters.Match(tt.ctx); got != tt.want {
+				t.Errorf("Match(%+v) = %v, want %v", tt.ctx, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookFiltersValidate(t *testing.T) {
+	tests := []struct {
+		filters WebhookFilters
+		wantErr bool
+	}{
+		{WebhookFilters{}, false},
+		{WebhookFilters{ChatType: "group", MessageTypes: []string{"text", "poll_vote"}}, false},
+		{WebhookFilters{ChatType: "channel"}, true},
+		{WebhookFilters{MessageTypes: []string{"gif"}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.filters.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) error = %v, want error %v", tt.filters, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWebhookFiltersEncoding(t *testing.T) {
+	yes := true
+	tests := []struct {
+		filters WebhookFilters
+		stored  string
+	}{
+		{WebhookFilters{}, ""},
+		{WebhookFilters{ChatType: "direct"}, `{"chat_type":"direct"}`},
+		{WebhookFilters{IncludeChats: []string{"1"}, FromMe: &yes}, `{"include_chats":["1"],"from_me":true}`},
+	}
+	for _, tt := range tests {
+		stored, err := encodeWebhookFilters(tt.filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != tt.stored {
+			t.Errorf("encodeWebhookFilters(%+v) = %q, want %q", tt.filters, stored, tt.stored)
+		}
+		decoded := decodeWebhookFilters(stored)
+		if again, _ := encodeWebhookFilters(decoded); again != stored {
+			t.Errorf("decoding %q gave %+v", stored, decoded)
+		}
+	}
+}
+
+func TestGetMessageType(t *testing.T) {
+	tests := []struct {
+		msg  *waE2E.Message
+		want string
+	}{
+		{nil, "other"},
+		{&waE2E.Message{}, "other"},
+		{&waE2E.Message{Conversation: proto.String("hi")}, "text"},
+		{&waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{Text: proto.String("hi")}}, "text"},
+		{&waE2E.Message{ImageMessage: &waE2E.ImageMessage{}}, "image"},
+		{&waE2E.Message{VideoMessage: &waE2E.VideoMessage{}}, "video"},
+		{&waE2E.Message{PtvMessage: &waE2E.VideoMessage{}}, "video"},
+		{&waE2E.Message{AudioMessage: &waE2E.AudioMessage{}}, "audio"},
+		{&waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{}}, "document"},
+		{&waE2E.Message{DocumentWithCaptionMessage: &waE2E.FutureProofMessage{}}, "document"},
+		{&waE2E.Message{StickerMessage: &waE2E.StickerMessage{}}, "sticker"},
+		{&waE2E.Message{LocationMessage: &waE2E.LocationMessage{}}, "location"},
+		{&waE2E.Message{LiveLocationMessage: &waE2E.LiveLocationMessage{}}, "location"},
+		{&waE2E.Message{ContactMessage: &waE2E.ContactMessage{}}, "contact"},
+		{&waE2E.Message{ContactsArrayMessage: &waE2E.ContactsArrayMessage{}}, "contact"},
+		{&waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{}}, "reaction"},
+		{&waE2E.Message{PollCreationMessageV3: &waE2E.PollCreationMessage{}}, "poll"},
+		{&waE2E.Message{PollUpdateMessage: &waE2E.PollUpdateMessage{}}, "poll_vote"},
+		{&waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{}}, "other"},
+	}
+	for _, tt := range tests {
+		if got := getMessageType(tt.msg); got != tt.want {
+			t.Errorf("getMessageType(%v) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestEventContextFromPostmap(t *testing.T) {
+	chat := types.NewJID("5491155551234", types.DefaultUserServer)
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	source := types.MessageSource{Chat: chat, Sender: chat, IsFromMe: true}
+
+	tests := []struct {
+		name  string
+		event interface{}
+		want  webhookEventContext
+	}{
+		{"message", &events.Message{Info: types.MessageInfo{MessageSource: source}, Message: &waE2E.Message{Conversation: proto.String("hi")}},
+			webhookEventContext{HasChat: true, Chat: chat, IsFromMe: true, MessageType: "text"}},
+		{"receipt", &events.Receipt{MessageSource: source}, webhookEventContext{HasChat: true, Chat: chat, IsFromMe: true}},
+		{"group info", &events.GroupInfo{JID: group}, webhookEventContext{HasChat: true, Chat: group, IsGroup: true}},
+		{"group picture", &events.Picture{JID: group}, webhookEventContext{HasChat: true, Chat: group, IsGroup: true}},
+		{"no chat", &events.Connected{}, webhookEventContext{}},
+	}
+	for _, tt := range tests {
+		if got := eventContextFromPostmap(map[string]interface{}{"event": tt.event}); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// Webhook delivery states
+const (
+	deliveryPending    = "pending"
+	deliveryProcessing = "processing"
+	deliveryDelivered  = "delivered"
+	deliveryDead       = "dead"
+)
+
+// Webhook health states kept by the circuit breaker
+const (
+	webhookHealthy   = "healthy"
+	webhookUnhealthy = "unhealthy"
+)
+
+// WebhookDelivery is one event waiting to be (or already) posted to a webhook URL
+type WebhookDelivery struct {
+	ID            string `db:"id"`
+	UserID        string `db:"user_id"`
+	WebhookID     string `db:"webhook_id"`
+	URL           string `db:"url"`
+	EventType     string `db:"event_type"`
+	Payload       string `db:"payload"`
+	FilePath      string `db:"file_path"`
+	Status        string `db:"status"`
+	Attempts      int    `db:"attempts"`
+	NextAttemptAt int64  `db:"next_attempt_at"`
+	LastError     string `db:"last_error"`
+	CreatedAt     int64  `db:"created_at"`
+	UpdatedAt     int64  `db:"updated_at"`
+	// ChatJID is only set for webhooks with ordered delivery, deliveries sharing it are sent one at a time in Seq order
+	ChatJID string `db:"chat_jid"`
+	Seq     int64  `db:"seq"`
+}
+
+// Columns selected whenever a WebhookDelivery is loaded
+const webhookDeliveryColumns = "id, user_id, webhook_id, url, event_type, payload, file_path, status, attempts, next_attempt_at, last_error, created_at, updated_at, chat_jid, seq"
+
+// WebhookAttempt records one request made for a delivery and what the receiver answered
+type WebhookAttempt struct {
+	ID           string `db:"id"`
+	DeliveryID   string `db:"delivery_id"`
+	WebhookID    string `db:"webhook_id"`
+	Attempt      int    `db:"attempt"`
+	StatusCode   int    `db:"status_code"`
+	LatencyMs    int64  `db:"latency_ms"`
+	ResponseBody string `db:"response_body"`
+	Error        string `db:"error"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+// Only the start of the receiver's response body is kept in the attempt history
+const maxAttemptResponseBytes = 1024
+
+// WebhookQueue persists webhook deliveries and retries them with exponential backoff
+type WebhookQueue struct {
+	db            *sqlx.DB
+	wake          chan struct{}
+	workers       chan struct{}
+	maxAttempts   int
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	retentionDays int
+	// Dead deliveries are kept longer than delivered ones, so failures can be inspected and replayed
+	deadRetentionDays int
+	// Circuit breaker: after breakerThreshold consecutive failures a webhook is paused,
+	// starting at breakerPause and doubling on every failed probe up to breakerMaxPause
+	breakerThreshold int
+	breakerPause     time.Duration
+	breakerMaxPause  time.Duration
+}
+
+// Global webhook queue instance, set by InitWebhookQueue
+var webhookQueue *WebhookQueue
+
+// InitWebhookQueue creates the delivery queue and starts its worker loop
+func InitWebhookQueue(db *sqlx.DB) {
+	workers := getEnvInt("WEBHOOK_WORKERS", 10)
+	if workers < 1 {
+		workers = 1
+	}
+	q := &WebhookQueue{
+		db:            db,
+		wake:          make(chan struct{}, 1),
+		workers:       make(chan struct{}, workers),
+		maxAttempts:   getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		baseDelay:     time.Duration(getEnvInt("WEBHOOK_RETRY_BASE_SECONDS", 5)) * time.Second,
+		maxDelay:      time.Duration(getEnvInt("WEBHOOK_RETRY_MAX_SECONDS", 3600)) * time.Second,
+		retentionDays: getEnvInt("WEBHOOK_DELIVERY_RETENTION_DAYS", 7),
+
+		deadRetentionDays: getEnvInt("WEBHOOK_DEAD_RETENTION_DAYS", 30),
+
+		breakerThreshold: getEnvInt("WEBHOOK_BREAKER_THRESHOLD", 10),
+		breakerPause:     time.Duration(getEnvInt("WEBHOOK_BREAKER_PAUSE_SECONDS", 60)) * time.Second,
+		breakerMaxPause:  time.Duration(getEnvInt("WEBHOOK_BREAKER_MAX_PAUSE_SECONDS", 3600)) * time.Second,
+	}
+
+	// Deliveries that were in flight when the server stopped are retried
+	_, err := db.Exec("UPDATE webhook_deliveries SET status=$1 WHERE status=$2", deliveryPending, deliveryProcessing)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not reset in-flight webhook deliveries")
+	}
+
+	webhookQueue = q
+	go q.run()
+
+	log.Info().
+		Int("maxAttempts", q.maxAttempts).
+		Dur("baseDelay", q.baseDelay).
+		Dur("maxDelay", q.maxDelay).
+		Int("breakerThreshold", q.breakerThreshold).
+		Msg("Webhook delivery queue started")
+}
+
+// lastSeq is the last sequence number handed out by nextSeq
+var lastSeq int64
+
+// nextSeq returns a strictly increasing number used to order deliveries of the same chat
+func nextSeq() int64 {
+	for {
+		last := atomic.LoadInt64(&lastSeq)
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastSeq, last, next) {
+			return next
+		}
+	}
+}
+
+// Enqueue stores a webhook delivery and wakes up the worker loop.
+// Deliveries with a chatJID are delivered in order with the other deliveries of that chat.
+func (q *WebhookQueue) Enqueue(userID, webhookID, url, eventType string, payload map[string]string, filePath string, chatJID string) (string, error) {
+	id, err := GenerateRandomID()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	_, err = q.db.Exec(`INSERT INTO webhook_deliveries (id, user_id, webhook_id, url, event_type, payload, file_path, status, attempts, next_attempt_at, last_error, created_at, updated_at, chat_jid, seq)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,0,$9,'',$10,$11,$12,$13)`,
+		id, userID, webhookID, url, eventType, string(data), filePath, deliveryPending, now, now, now, chatJID, nextSeq())
+	if err != nil {
+		return "", err
+	}
+	q.notify()
+	return id, nil
+}
+
+func (q *WebhookQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *WebhookQueue) run() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+		q.processDue()
+		if time.Since(lastPrune) > time.Hour {
+			q.prune()
+			lastPrune = time.Now()
+		}
+	}
+}
+
+// processDue claims due deliveries and hands them to the worker pool
+func (q *WebhookQueue) processDue() {
+	deliveries := []WebhookDelivery{}
+	// An ordered delivery waits until every earlier delivery of its chat is delivered or dead
+	err := q.db.Select(&deliveries, `SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries d
+		WHERE status=$1 AND next_attempt_at <= $2
+		AND (chat_jid = '' OR NOT EXISTS (
+			SELECT 1 FROM webhook_deliveries e
+			WHERE e.webhook_id = d.webhook_id AND e.chat_jid = d.chat_jid AND e.seq < d.seq AND e.status IN ($3,$4)))
+		ORDER BY next_attempt_at ASC, seq ASC LIMIT 100`,
+		deliveryPending, time.Now().Unix(), deliveryPending, deliveryProcessing)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not fetch due webhook deliveries")
+		return
+	}
+
+	for _, d := range deliveries {
+		select {
+		case q.workers <- struct{}{}:
+		default:
+			// All workers busy, the rest is picked up on the next tick
+			return
+		}
+		res, err := q.db.Exec("UPDATE webhook_deliveries SET status=$1, updated_at=$2 WHERE id=$3 AND status=$4",
+			deliveryProcessing, time.Now().Unix(), d.ID, deliveryPending)
+		if err != nil {
+			<-q.workers
+			log.Error().Err(err).Str("id", d.ID).Msg("Could not claim webhook delivery")
+			continue
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			<-q.workers
+			continue
+		}
+		go func(d WebhookDelivery) {
+			defer func() { <-q.workers }()
+			q.deliver(d)
+			if d.ChatJID != "" {
+				// The next delivery of this chat can go out now
+				q.notify()
+			}
+		}(d)
+	}
+}
+
+// deliver posts one delivery and records the outcome
+func (q *WebhookQueue) deliver(d WebhookDelivery) {
+	opts, err := getWebhookOptions(q.db, d.WebhookID)
+	if errors.Is(err, sql.ErrNoRows) {
+		q.markDead(d, d.Attempts, "webhook no longer exists")
+		return
+	}
+
+	if d.WebhookID != "" {
+		if until, ok := q.checkBreaker(d.WebhookID); !ok {
+			q.deferDelivery(d, until)
+			return
+		}
+	}
+
+	opts.DeliveryID = d.ID
+	attempts := d.Attempts + 1
+
+	payload := map[string]string{}
+	if err == nil {
+		err = json.Unmarshal([]byte(d.Payload), &payload)
+	}
+	if err == nil {
+		var resp *webhookResponse
+		if d.FilePath == "" {
+			resp, err = callHook(d.URL, payload, d.UserID, opts)
+		} else if _, statErr := os.Stat(d.FilePath); statErr != nil {
+			// The attachment is gone, retrying will not bring it back
+			q.markDead(d, attempts, "attachment no longer available: "+statErr.Error())
+			return
+		} else {
+			resp, err = callHookFile(d.URL, payload, d.UserID, d.FilePath, opts)
+		}
+		q.recordAttempt(d, attempts, resp, err)
+		if d.WebhookID != "" {
+			q.recordHealth(d, err)
+		}
+	}
+
+	now := time.Now().Unix()
+
+	if err == nil {
+		_, dbErr := q.db.Exec("UPDATE webhook_deliveries SET status=$1, attempts=$2, last_error='', updated_at=$3 WHERE id=$4",
+			deliveryDelivered, attempts, now, d.ID)
+		if dbErr != nil {
+			log.Error().Err(dbErr).Str("id", d.ID).Msg("Could not mark webhook delivery as delivered")
+		}
+		return
+	}
+
+	if attempts >= q.maxAttempts {
+		q.markDead(d, attempts, err.Error())
+		return
+	}
+
+	delay := q.backoff(attempts)
+	log.Warn().Err(err).
+		Str("id", d.ID).
+		Str("url", d.URL).
+		Str("userID", d.UserID).
+		Int("attempt", attempts).
+		Dur("retryIn", delay).
+		Msg("Webhook delivery failed, will retry")
+	_, dbErr := q.db.Exec("UPDATE webhook_deliveries SET status=$1, attempts=$2, next_attempt_at=$3, last_error=$4, updated_at=$5 WHERE id=$6",
+		deliveryPending, attempts, time.Now().Add(delay).Unix(), err.Error(), now, d.ID)
+	if dbErr != nil {
+		log.Error().Err(dbErr).Str("id", d.ID).Msg("Could not reschedule webhook delivery")
+	}
+}
+
+// recordAttempt stores the outcome of one request in the delivery history
+func (q *WebhookQueue) recordAttempt(d WebhookDelivery, attempt int, resp *webhookResponse, callErr error) {
+	id, err := GenerateRandomID()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not generate webhook attempt ID")
+		return
+	}
+	a := WebhookAttempt{
+		ID:         id,
+		DeliveryID: d.ID,
+		WebhookID:  d.WebhookID,
+		Attempt:    attempt,
+		CreatedAt:  time.Now().Unix(),
+	}
+	if resp != nil {
+		a.StatusCode = resp.StatusCode
+		a.LatencyMs = resp.Latency.Milliseconds()
+		body := resp.Body
+		if len(body) > maxAttemptResponseBytes {
+			body = body[:maxAttemptResponseBytes]
+		}
+		a.ResponseBody = strings.ToValidUTF8(string(body), "")
+	}
+	if callErr != nil {
+		a.Error = callErr.Error()
+	}
+	_, err = q.db.Exec(`INSERT INTO webhook_attempts (id, delivery_id, webhook_id, attempt, status_code, latency_ms, response_body, error, created_at)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)`,
+		a.ID, a.DeliveryID, a.WebhookID, a.Attempt, a.StatusCode, a.LatencyMs, a.ResponseBody, a.Error, a.CreatedAt)
+	if err != nil {
+		log.Error().Err(err).Str("id", d.ID).Msg("Could not record webhook attempt")
+	}
+}
+
+// checkBreaker reports whether a delivery to the webhook may be sent now, or until when it has to wait
+func (q *WebhookQueue) checkBreaker(webhookID string) (int64, bool) {
+	var h UserWebhook
+	err := q.db.Get(&h, "SELECT health, consecutive_failures, paused_until FROM user_webhooks WHERE id=$1", webhookID)
+	if err != nil || h.Health != webhookUnhealthy {
+		return 0, true
+	}
+	now := time.Now().Unix()
+	if now < h.PausedUntil {
+		return h.PausedUntil, false
+	}
+
+	// The pause is over: the first delivery to move paused_until probes the receiver,
+	// the others wait for the next pause window or for the probe to succeed
+	next := now + int64(q.breakerPauseFor(h.ConsecutiveFailures).Seconds())
+	res, err := q.db.Exec("UPDATE user_webhooks SET paused_until=$1 WHERE id=$2 AND paused_until=$3", next, webhookID, h.PausedUntil)
+	if err != nil {
+		log.Error().Err(err).Str("webhookID", webhookID).Msg("Could not start webhook probe")
+		return next, false
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return next, false
+	}
+	log.Info().Str("webhookID", webhookID).Msg("Probing paused webhook")
+	return 0, true
+}
+
+// deferDelivery puts a delivery back in the queue without counting an attempt
+func (q *WebhookQueue) deferDelivery(d WebhookDelivery, until int64) {
+	_, err := q.db.Exec("UPDATE webhook_deliveries SET status=$1, next_attempt_at=$2, updated_at=$3 WHERE id=$4",
+		deliveryPending, until, time.Now().Unix(), d.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", d.ID).Msg("Could not defer webhook delivery")
+	}
+}
+
+// breakerPauseFor returns how long a webhook stays paused after the given number of consecutive failures
+func (q *WebhookQueue) breakerPauseFor(failures int) time.Duration {
+	trips := failures - q.breakerThreshold
+	if trips < 0 {
+		trips = 0
+	}
+	pause := q.breakerMaxPause
+	if trips < 31 {
+		if p := q.breakerPause << uint(trips); p > 0 && p < q.breakerMaxPause {
+			pause = p
+		}
+	}
+	return pause
+}
+
+// recordHealth updates the failure counters of a webhook and opens or closes its circuit breaker
+func (q *WebhookQueue) recordHealth(d WebhookDelivery, callErr error) {
+	now := time.Now().Unix()
+
+	if callErr == nil {
+		res, err := q.db.Exec("UPDATE user_webhooks SET health=$1, paused_until=0 WHERE id=$2 AND health=$3", webhookHealthy, d.WebhookID, webhookUnhealthy)
+		if err != nil {
+			log.Error().Err(err).Str("webhookID", d.WebhookID).Msg("Could not update webhook health")
+			return
+		}
+		_, err = q.db.Exec("UPDATE user_webhooks SET consecutive_failures=0, last_success_at=$1 WHERE id=$2", now, d.WebhookID)
+		if err != nil {
+			log.Error().Err(err).Str("webhookID", d.WebhookID).Msg("Could not update webhook health")
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			log.Info().Str("webhookID", d.WebhookID).Str("url", d.URL).Msg("Webhook recovered")
+			q.releaseDeferred(d.WebhookID)
+			go sendSystemEvent(q.db, d.UserID, map[string]interface{}{
+				"type": "WebhookRecovered",
+				"event": map[string]interface{}{
+					"webhook_id": d.WebhookID,
+					"url":        d.URL,
+				},
+			})
+		}
+		return
+	}
+
+	_, err := q.db.Exec("UPDATE user_webhooks SET consecutive_failures=consecutive_failures+1, last_error=$1, last_error_at=$2 WHERE id=$3",
+		callErr.Error(), now, d.WebhookID)
+	if err != nil {
+		log.Error().Err(err).Str("webhookID", d.WebhookID).Msg("Could not update webhook health")
+		return
+	}
+	if q.breakerThreshold <= 0 {
+		return
+	}
+
+	var h UserWebhook
+	if err := q.db.Get(&h, "SELECT health, consecutive_failures FROM user_webhooks WHERE id=$1", d.WebhookID); err != nil {
+		return
+	}
+	if h.ConsecutiveFailures < q.breakerThreshold {
+		return
+	}
+
+	pausedUntil := now + int64(q.breakerPauseFor(h.ConsecutiveFailures).Seconds())
+	if h.Health == webhookUnhealthy {
+		// A failed probe, wait longer before the next one
+		q.db.Exec("UPDATE user_webhooks SET paused_until=$1 WHERE id=$2", pausedUntil, d.WebhookID)
+		return
+	}
+	res, err := q.db.Exec("UPDATE user_webhooks SET health=$1, paused_until=$2 WHERE id=$3 AND health=$4",
+		webhookUnhealthy, pausedUntil, d.WebhookID, webhookHealthy)
+	if err != nil {
+		log.Error().Err(err).Str("webhookID", d.WebhookID).Msg("Could not pause webhook")
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return
+	}
+
+	log.Warn().
+		Str("webhookID", d.WebhookID).
+		Str("url", d.URL).
+		Str("userID", d.UserID).
+		Int("consecutiveFailures", h.ConsecutiveFailures).
+		Msg("Webhook marked unhealthy and paused")
+	// Keep the workers from claiming the waiting deliveries until the pause is over
+	q.db.Exec("UPDATE webhook_deliveries SET next_attempt_at=$1 WHERE webhook_id=$2 AND status=$3 AND next_attempt_at < $1",
+		pausedUntil, d.WebhookID, deliveryPending)
+	go sendSystemEvent(q.db, d.UserID, map[string]interface{}{
+		"type": "WebhookUnhealthy",
+		"event": map[string]interface{}{
+			"webhook_id":           d.WebhookID,
+			"url":                  d.URL,
+			"consecutive_failures": h.ConsecutiveFailures,
+			"last_error":           callErr.Error(),
+			"paused_until":         pausedUntil,
+		},
+	})
+}
+
+// releaseDeferred makes the deliveries held back for a webhook due immediately
+func (q *WebhookQueue) releaseDeferred(webhookID string) {
+	_, err := q.db.Exec("UPDATE webhook_deliveries SET next_attempt_at=$1 WHERE webhook_id=$2 AND status=$3",
+		time.Now().Unix(), webhookID, deliveryPending)
+	if err != nil {
+		log.Error().Err(err).Str("webhookID", webhookID).Msg("Could not release deferred webhook deliveries")
+		return
+	}
+	q.notify()
+}
+
+// markDead moves a delivery to the dead-letter state, where it is kept for inspection
+func (q *WebhookQueue) markDead(d WebhookDelivery, attempts int, reason string) {
+	log.Error().
+		Str("id", d.ID).
+		Str("url", d.URL).
+		Str("userID", d.UserID).
+		Str("eventType", d.EventType).
+		Int("attempts", attempts).
+		Str("error", reason).
+		Msg("Webhook delivery moved to dead-letter")
+	_, err := q.db.Exec("UPDATE webhook_deliveries SET status=$1, attempts=$2, last_error=$3, updated_at=$4 WHERE id=$5",
+		deliveryDead, attempts, reason, time.Now().Unix(), d.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", d.ID).Msg("Could not mark webhook delivery as dead")
+	}
+}
+
+// backoff returns an exponential delay with jitter for the given attempt number
+func (q *WebhookQueue) backoff(attempts int) time.Duration {
+	delay := q.maxDelay
+	if attempts < 31 {
+		if d := q.baseDelay << uint(attempts-1); d > 0 && d < q.maxDelay {
+			delay = d
+		}
+	}
+	// Keep at least half of the delay so retries do not collapse to zero
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// prune removes delivered and dead events older than their retention period, their attempts go with them
+func (q *WebhookQueue) prune() {
+	q.pruneStatus(deliveryDelivered, q.retentionDays)
+	q.pruneStatus(deliveryDead, q.deadRetentionDays)
+}
+
+// pruneStatus removes the deliveries with the given status last updated more than days ago, 0 keeps them forever
+func (q *WebhookQueue) pruneStatus(status string, days int) {
+	if days <= 0 {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).Unix()
+	res, err := q.db.Exec("DELETE FROM webhook_deliveries WHERE status=$1 AND updated_at < $2", status, cutoff)
+	if err != nil {
+		log.Error().Err(err).Str("status", status).Msg("Could not prune webhook deliveries")
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Info().Int64("count", n).Str("status", status).Msg("Pruned old webhook deliveries")
+	}
+}
+
+// enqueueWebhook queues a delivery, falling back to a direct call when it cannot be stored
+func enqueueWebhook(userID, webhookID, url, eventType string, payload map[string]string, filePath string, chatJID string) {
+	if webhookQueue == nil {
+		log.Error().Str("url", url).Msg("Webhook queue is not initialized, dropping event")
+		return
+	}
+	_, err := webhookQueue.Enqueue(userID, webhookID, url, eventType, payload, filePath, chatJID)
+	if err == nil {
+		return
+	}
+	log.Error().Err(err).Str("url", url).Msg("Could not enqueue webhook delivery, sending directly")
+	go func() {
+		opts, err := getWebhookOptions(webhookQueue.db, webhookID)
+		if err != nil {
+			log.Error().Err(err).Str("url", url).Msg("Could not load webhook options")
+			return
+		}
+		if filePath == "" {
+			_, err = callHook(url, payload, userID, opts)
+		} else {
+			_, err = callHookFile(url, payload, userID, filePath, opts)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("url", url).Msg("Error calling webhook")
+		}
+	}()
+}
+
+var errWebhookStatus = errors.New("webhook returned non-success status")
+
+// getEnvInt reads a positive integer from the environment, returning def when unset or invalid
+func getEnvInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Warn().Str(name, v).Int("default", def).Msg("Invalid integer in environment, using default")
+		return def
+	}
+	return n
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestQueue returns a queue on db without its worker loop, deliveries are made by calling deliver
+func newTestQueue(db *sqlx.DB) *WebhookQueue {
+	return &WebhookQueue{
+		db:                db,
+		wake:              make(chan struct{}, 1),
+		workers:           make(chan struct{}, 10),
+		maxAttempts:       3,
+		baseDelay:         5 * time.Second,
+		maxDelay:          time.Hour,
+		retentionDays:     7,
+		deadRetentionDays: 30,
+		breakerThreshold:  3,
+		breakerPause:      time.Minute,
+		breakerMaxPause:   time.Hour,
+	}
+}
+
+// getTestDelivery loads a delivery by id
+func getTestDelivery(t *testing.T, db *sqlx.DB, id string) WebhookDelivery {
+	t.Helper()
+	var d WebhookDelivery
+	if err := db.Get(&d, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id=$1", id); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestWebhookQueueBackoff(t *testing.T) {
+	q := &WebhookQueue{baseDelay: 5 * time.Second, maxDelay: time.Hour}
+	tests := []struct {
+		attempts int
+		delay    time.Duration // before jitter, the result is between half of it and all of it
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{6, 160 * time.Second},
+		{10, 2560 * time.Second},
+		{11, time.Hour},
+		{40, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if got := q.backoff(tt.attempts); got < tt.delay/2 || got > tt.delay {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", tt.attempts, got, tt.delay/2, tt.delay)
+				break
+			}
+		}
+	}
+}
+
+func TestWebhookQueueDeliver(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		attempts     int // made before this one
+		wantStatus   string
+		wantAttempts int
+		wantRetry    bool
+	}{
+		{"delivered", http.StatusOK, 0, deliveryDelivered, 1, false},
+		{"accepted", http.StatusAccepted, 1, deliveryDelivered, 2, false},
+		{"retried", http.StatusInternalServerError, 0, deliveryPending, 1, true},
+		{"client error retried", http.StatusBadRequest, 1, deliveryPending, 2, true},
+		{"dead after the last attempt", http.StatusServiceUnavailable, 2, deliveryDead, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer receiver.Close()
+
+			db := newTestDB(t)
+			q := newTestQueue(db)
+			id, err := q.Enqueue("user", "", receiver.URL, "Message", map[string]string{"jsonData": "{}"}, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec("UPDATE webhook_deliveries SET attempts=$1 WHERE id=$2", tt.attempts, id); err != nil {
+				t.Fatal(err)
+			}
+
+			q.deliver(getTestDelivery(t, db, id))
+			d := getTestDelivery(t, db, id)
+			if d.Status != tt.wantStatus || d.Attempts != tt.wantAttempts {
+				t.Errorf("got status %s after %d attempts, want %s after %d", d.Status, d.Attempts, tt.wantStatus, tt.wantAttempts)
+			}
+			if retry := d.NextAttemptAt > time.Now().Unix(); retry != tt.wantRetry {
+				t.Errorf("next attempt at %d, retry scheduled = %v, want %v", d.NextAttemptAt, retry, tt.wantRetry)
+			}
+			var history int
+			db.Get(&history, "SELECT COUNT(*) FROM webhook_attempts WHERE delivery_id=$1", id)
+			if history != 1 {
+				t.Errorf("%d attempts recorded, want 1", history)
+			}
+		})
+	}
+}
+
+func TestWebhookQueueDeliverMissingAttachment(t *testing.T) {
+	db := newTestDB(t)
+	q := newTestQueue(db)
+	id, err := q.Enqueue("user", "", "http://127.0.0.1:1", "Message", map[string]string{}, t.TempDir()+"/gone.jpg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.deliver(getTestDelivery(t, db, id))
+	if d := getTestDelivery(t, db, id); d.Status != deliveryDead {
+		t.Errorf("got status %s, want %s", d.Status, deliveryDead)
+	}
+}
+
+func TestWebhookQueuePrune(t *testing.T) {
+	db := newTestDB(t)
+	q := newTestQueue(db)
+	day := int64(24 * 60 * 60)
+	now := time.Now().Unix()
+	tests := []struct {
+		status  string
+		age     int64
+		removed bool
+	}{
+		{deliveryDelivered, 1 * day, false},
+		{deliveryDelivered, 8 * day, true},
+		{deliveryDead, 8 * day, false},
+		{deliveryDead, 31 * day, true},
+		{deliveryPending, 60 * day, false},
+		{deliveryProcessing, 60 * day, false},
+	}
+	ids := make([]string, len(tests))
+	for i, tt := range tests {
+		id, err := q.Enqueue("user", "", "http://example.com", "Message", map[string]string{}, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+		if _, err := db.Exec("UPDATE webhook_deliveries SET status=$1, updated_at=$2 WHERE id=$3", tt.status, now-tt.age, id); err != nil {
+			t.Fatal(err)
+		}
+		q.recordAttempt(getTestDelivery(t, db, id), 1, nil, nil)
+	}
+
+	q.prune()
+	for i, tt := range tests {
+		var deliveries, attempts int
+		db.Get(&deliveries, "SELECT COUNT(*) FROM webhook_deliveries WHERE id=$1", ids[i])
+		db.Get(&attempts, "SELECT COUNT(*) FROM webhook_attempts WHERE delivery_id=$1", ids[i])
+		if removed := deliveries == 0; removed != tt.removed {
+			t.Errorf("%s delivery %d days old: removed = %v, want %v", tt.status, tt.age/day, removed, tt.removed)
+		}
+		if tt.removed && attempts != 0 {
+			t.Errorf("%s delivery %d days old: its attempts were kept", tt.status, tt.age/day)
+		}
+	}
+
+	// A retention of 0 keeps everything
+	q.retentionDays, q.deadRetentionDays = 0, 0
+	var before, after int
+	db.Get(&before, "SELECT COUNT(*) FROM webhook_deliveries")
+	db.Exec("UPDATE webhook_deliveries SET updated_at=0")
+	q.prune()
+	db.Get(&after, "SELECT COUNT(*) FROM webhook_deliveries")
+	if after != before {
+		t.Errorf("%d of %d deliveries left with retention disabled", after, before)
+	}
+}
+
+func TestWebhookBreakerPauseFor(t *testing.T) {
+	q := &WebhookQueue{breakerThreshold: 3, breakerPause: time.Minute, breakerMaxPause: time.Hour}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{8, 32 * time.Minute},
+		{9, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := q.breakerPauseFor(tt.failures); got != tt.want {
+			t.Errorf("breakerPauseFor(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// webhookHealth is the breaker state of a webhook
+func webhookHealth(t *testing.T, db *sqlx.DB, id string) UserWebhook {
+	t.Helper()
+	var h UserWebhook
+	if err := db.Get(&h, "SELECT health, consecutive_failures, paused_until FROM user_webhooks WHERE id=$1", id); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestWebhookCircuitBreaker(t *testing.T) {
+	db := newTestDB(t)
+	q := newTestQueue(db)
+	if _, err := db.Exec("INSERT INTO user_webhooks (id, user_id, url, events) VALUES ('hook', 'user', 'http://example.com', 'All')"); err != nil {
+		t.Fatal(err)
+	}
+	waiting, err := q.Enqueue("user", "hook", "http://example.com", "Message", map[string]string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := WebhookDelivery{UserID: "user", WebhookID: "hook", URL: "http://example.com"}
+	failure := errWebhookStatus
+
+	// Failures below the threshold keep the webhook healthy
+	for i := 1; i < q.breakerThreshold; i++ {
+		q.recordHealth(d, failure)
+	}
+	if h := webhookHealth(t, db, "hook"); h.Health != webhookHealthy || h.ConsecutiveFailures != q.breakerThreshold-1 {
+		t.Fatalf("after %d failures got %+v", q.breakerThreshold-1, h)
+	}
+
+	// Reaching it pauses the webhook and holds its deliveries back
+	q.recordHealth(d, failure)
+	h := webhookHealth(t, db, "hook")
+	if h.Health != webhookUnhealthy || h.PausedUntil <= time.Now().Unix() {
+		t.Fatalf("after %d failures got %+v, want a paused webhook", q.breakerThreshold, h)
+	}
+	if next := getTestDelivery(t, db, waiting).NextAttemptAt; next != h.PausedUntil {
+		t.Errorf("waiting delivery is due at %d, want the end of the pause %d", next, h.PausedUntil)
+	}
+	if until, ok := q.checkBreaker("hook"); ok || until != h.PausedUntil {
+		t.Errorf("checkBreaker during the pause = %d, %v", until, ok)
+	}
+
+	// Once the pause is over a single delivery probes the receiver
+	db.Exec("UPDATE user_webhooks SET paused_until=$1 WHERE id='hook'", time.Now().Unix()-1)
+	if _, ok := q.checkBreaker("hook"); !ok {
+		t.Error("no probe allowed after the pause")
+	}
+	if _, ok := q.checkBreaker("hook"); ok {
+		t.Error("a second probe was allowed")
+	}
+
+	// A failed probe pauses it for longer
+	q.recordHealth(d, failure)
+	h = webhookHealth(t, db, "hook")
+	want := time.Now().Unix() + int64(q.breakerPauseFor(q.breakerThreshold+1).Seconds())
+	if h.Health != webhookUnhealthy || h.PausedUntil < want-1 || h.PausedUntil > want {
+		t.Errorf("after a failed probe got %+v, want paused until %d", h, want)
+	}
+
+	// A successful one resumes it and releases its deliveries
+	q.recordHealth(d, nil)
+	if h := webhookHealth(t, db, "hook"); h.Health != webhookHealthy || h.ConsecutiveFailures != 0 || h.PausedUntil != 0 {
+		t.Errorf("after a success got %+v, want a healthy webhook", h)
+	}
+	if next := getTestDelivery(t, db, waiting).NextAttemptAt; next > time.Now().Unix() {
+		t.Errorf("waiting delivery is still held back until %d", next)
+	}
+	if _, ok := q.checkBreaker("hook"); !ok {
+		t.Error("checkBreaker refused a healthy webhook")
+	}
+}
+
+func TestWebhookCircuitBreakerDisabled(t *testing.T) {
+	db := newTestDB(t)
+	q := newTestQueue(db)
+	q.breakerThreshold = 0
+	if _, err := db.Exec("INSERT INTO user_webhooks (id, user_id, url, events) VALUES ('hook', 'user', 'http://example.com', 'All')"); err != nil {
+		t.Fatal(err)
+	}
+	d := WebhookDelivery{UserID: "user", WebhookID: "hook", URL: "http://example.com"}
+	for i := 0; i < 20; i++ {
+		q.recordHealth(d, errWebhookStatus)
+	}
+	if h := webhookHealth(t, db, "hook"); h.Health != webhookHealthy || h.ConsecutiveFailures != 20 {
+		t.Errorf("got %+v, want a healthy webhook counting its failures", h)
+	}
+}
+
+func TestWebhookQueueDeliverPaused(t *testing.T) {
+	db := newTestDB(t)
+	q := newTestQueue(db)
+	pausedUntil := time.Now().Unix() + 600
+	_, err := db.Exec("INSERT INTO user_webhooks (id, user_id, url, events, health, paused_until) VALUES ('hook', 'user', 'http://127.0.0.1:1', 'All', $1, $2)",
+		webhookUnhealthy, pausedUntil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := q.Enqueue("user", "hook", "http://127.0.0.1:1", "Message", map[string]string{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A delivery to a paused webhook waits for the end of the pause, it is not an attempt
+	q.deliver(getTestDelivery(t, db, id))
+	d := getTestDelivery(t, db, id)
+	if d.Status != deliveryPending || d.Attempts != 0 || d.NextAttemptAt != pausedUntil {
+		t.Errorf("got status %s, %d attempts, due at %d, want pending with no attempt until %d", d.Status, d.Attempts, d.NextAttemptAt, pausedUntil)
+	}
+}
+
+// waitIdle waits until the deliveries handed to the workers of q are done
+func waitIdle(t *testing.T, q *WebhookQueue) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(q.workers) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("deliveries still running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookQueueChatOrder(t *testing.T) {
+	db := newTestDB(t)
+	q := newTestQueue(db)
+	// The first delivery of chat A fails, the others succeed. Requests wait for release, so the
+	// deliveries claimed can be checked while they are being made.
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if r.URL.Query().Get("id") == "A1" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+	if _, err := db.Exec("INSERT INTO user_webhooks (id, user_id, url, events, ordered) VALUES ('hook', 'user', $1, 'All', true)", receiver.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]string{}
+	for _, d := range []struct{ name, chat string }{
+		{"A1", "a@s.whatsapp.net"},
+		{"A2", "a@s.whatsapp.net"},
+		{"B1", "b@s.whatsapp.net"},
+		{"B2", "b@s.whatsapp.net"},
+		{"N1", ""},
+	} {
+		id, err := q.Enqueue("user", "hook", receiver.URL+"?id="+d.name, "Message", map[string]string{"jsonData": "{}"}, "", d.chat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[d.name] = id
+	}
+	statuses := func() map[string]string {
+		got := map[string]string{}
+		for name, id := range ids {
+			got[name] = getTestDelivery(t, db, id).Status
+		}
+		return got
+	}
+	check := func(step string, want map[string]string) {
+		t.Helper()
+		if got := statuses(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", step, got, want)
+		}
+	}
+
+	// Only the first delivery of each chat is claimed, unordered deliveries go right away
+	q.processDue()
+	check("first round", map[string]string{"A1": deliveryProcessing, "A2": deliveryPending, "B1": deliveryProcessing, "B2": deliveryPending, "N1": deliveryProcessing})
+	close(release)
+	waitIdle(t, q)
+	check("first round done", map[string]string{"A1": deliveryPending, "A2": deliveryPending, "B1": deliveryDelivered, "B2": deliveryPending, "N1": deliveryDelivered})
+
+	// B1 was delivered so B2 goes, A2 waits for the retry of A1
+	q.processDue()
+	waitIdle(t, q)
+	check("second round", map[string]string{"A1": deliveryPending, "A2": deliveryPending, "B1": deliveryDelivered, "B2": deliveryDelivered, "N1": deliveryDelivered})
+	if a2 := getTestDelivery(t, db, ids["A2"]); a2.Attempts != 0 {
+		t.Errorf("A2 was tried %d times before A1 was done", a2.Attempts)
+	}
+
+	// A dead delivery no longer holds back its chat
+	if _, err := db.Exec("UPDATE webhook_deliveries SET status=$1 WHERE id=$2", deliveryDead, ids["A1"]); err != nil {
+		t.Fatal(err)
+	}
+	q.processDue()
+	waitIdle(t, q)
+	check("after A1 is dead", map[string]string{"A1": deliveryDead, "A2": deliveryDelivered, "B1": deliveryDelivered, "B2": deliveryDelivered, "N1": deliveryDelivered})
+}
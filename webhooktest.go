@@ -0,0 +1,164 @@
+package main
+
+import (
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// buildTestEvent returns a postmap shaped like a real event of the given type, for testing webhook receivers.
+// ownJID is the account the event is delivered to, an example number is used when the user is not paired.
+func buildTestEvent(eventType string, ownJID types.JID) map[string]interface{} {
+	if ownJID.IsEmpty() {
+		ownJID = types.NewJID("5491155550000", types.DefaultUserServer)
+	}
+	contact := types.NewJID("5491155551234", types.DefaultUserServer)
+	now := time.Now().Truncate(time.Second)
+	source := types.MessageSource{
+		Chat:   contact,
+		Sender: contact,
+	}
+
+	postmap := map[string]interface{}{
+		"type": eventType,
+		"test": true,
+	}
+
+	switch eventType {
+	case "Message":
+		evt := &events.Message{
+			Info: types.MessageInfo{
+				MessageSource: source,
+				ID:            "3EB0TEST" + randomTestSuffix(),
+				PushName:      "Test Contact",
+				Timestamp:     now,
+				Type:          "text",
+			},
+			Message: &waE2E.Message{
+				Conversation: proto.String("This is a test message from wuzapi"),
+			},
+		}
+		postmap["event"] = evt
+		postmap["info"] = messageInfoDetails(evt.Info)
+		postmap["content"] = eventMessageContent(evt)
+	case "ReadReceipt", "Receipt":
+		postmap["type"] = "ReadReceipt"
+		postmap["state"] = "Read"
+		postmap["event"] = &events.Receipt{
+			MessageSource: source,
+			MessageIDs:    []types.MessageID{"3EB0TEST" + randomTestSuffix()},
+			Timestamp:     now,
+			Type:          types.ReceiptTypeRead,
+		}
+	case "QR":
+		postmap["event"] = "code"
+		postmap["qrCodeBase64"] = "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+	case "Presence":
+		postmap["state"] = "online"
+		postmap["event"] = &events.Presence{From: contact}
+	case "ChatPresence":
+		postmap["event"] = &events.ChatPresence{
+			MessageSource: source,
+			State:         types.ChatPresenceComposing,
+		}
+	case "Connected":
+		postmap["event"] = &events.Connected{}
+	case "Disconnected":
+		postmap["event"] = &events.Disconnected{}
+	case "ConnectFailure":
+		postmap["event"] = &events.ConnectFailure{Reason: events.ConnectFailureServiceUnavailable, Message: "test"}
+	case "LoggedOut":
+		postmap["type"] = "LoggedOut"
+		postmap["event"] = &events.LoggedOut{Reason: events.ConnectFailureLoggedOut}
+	case "CallOffer":
+		evt := &events.CallOffer{
+			BasicCallMeta: types.BasicCallMeta{
+				From:        contact,
+				Timestamp:   now,
+				CallCreator: contact,
+				CallID:      "TESTCALL" + randomTestSuffix(),
+			},
+			CallRemoteMeta: types.CallRemoteMeta{RemotePlatform: "android", RemoteVersion: "2.24.10.79"},
+		}
+		postmap["event"] = evt
+		postmap["call"] = callDetails(evt)
+		postmap["rejected"] = false
+	case "CallTerminate":
+		evt := &events.CallTerminate{
+			BasicCallMeta: types.BasicCallMeta{
+				From:        contact,
+				Timestamp:   now,
+				CallCreator: contact,
+				CallID:      "TESTCALL" + randomTestSuffix(),
+			},
+			Reason: "timeout",
+		}
+		postmap["event"] = evt
+		postmap["call"] = callDetails(evt)
+	case "GroupInfo":
+		name := "Test Group"
+		evt := &events.GroupInfo{
+			JID:       types.NewJID("120363000000000000", types.GroupServer),
+			Sender:    &contact,
+			Timestamp: now,
+			Name:      &types.GroupName{Name: name, NameSetAt: now, NameSetBy: contact},
+			Join:      []types.JID{ownJID},
+		}
+		postmap["event"] = evt
+		setEventDetails(postmap, evt)
+	case "Picture":
+		evt := &events.Picture{JID: contact, Author: contact, Timestamp: now, PictureID: "1700000000"}
+		postmap["event"] = evt
+		setEventDetails(postmap, evt)
+	case "BlocklistChange":
+		change := events.BlocklistChange{JID: contact, Action: events.BlocklistChangeActionBlock}
+		postmap["event"] = change
+		postmap["details"] = blocklistChangeDetails(change)
+	case "UserAbout":
+		evt := &events.UserAbout{JID: contact, Status: "Hey there! I am using WhatsApp.", Timestamp: now}
+		postmap["event"] = evt
+		setEventDetails(postmap, evt)
+	case "HistorySync":
+		postmap["event"] = &events.HistorySync{}
+	case "ScheduledMessage":
+		postmap["event"] = map[string]interface{}{
+			"id":         "test",
+			"action":     "send.text",
+			"chat":       contact.String(),
+			"status":     scheduledSent,
+			"message_id": "3EB0TEST" + randomTestSuffix(),
+			"send_at":    now.Unix(),
+			"sent_at":    now.Unix(),
+			"attempts":   1,
+			"error":      "",
+		}
+	case "WebhookUnhealthy":
+		postmap["event"] = map[string]interface{}{
+			"webhook_id":           "test",
+			"url":                  "https://example.net/webhook",
+			"consecutive_failures": 10,
+			"last_error":           "webhook returned non-success status: 503",
+			"paused_until":         now.Add(time.Minute).Unix(),
+		}
+	case "WebhookRecovered":
+		postmap["event"] = map[string]interface{}{
+			"webhook_id": "test",
+			"url":        "https://example.net/webhook",
+		}
+	default:
+		postmap["event"] = map[string]interface{}{}
+	}
+	return postmap
+}
+
+// randomTestSuffix keeps test message IDs unique so receivers that deduplicate still process them
+func randomTestSuffix() string {
+	id, err := GenerateRandomID()
+	if err != nil || len(id) < 12 {
+		return "000000000000"
+	}
+	return id[:12]
+}
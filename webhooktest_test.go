@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestBuildTestEvent(t *testing.T) {
+	t.Setenv("WEBHOOK_RAW_MESSAGE", "")
+	// The types API.md lists as having realistic payloads
+	advertised := []string{"Message", "ReadReceipt", "QR", "Presence", "ChatPresence", "Connected", "Disconnected", "ConnectFailure",
+		"LoggedOut", "CallOffer", "CallTerminate", "GroupInfo", "Picture", "BlocklistChange", "UserAbout", "HistorySync",
+		"ScheduledMessage", "WebhookUnhealthy", "WebhookRecovered"}
+	for _, eventType := range advertised {
+		data, err := json.Marshal(deliveryPayload(buildTestEvent(eventType, types.EmptyJID)))
+		if err != nil {
+			t.Errorf("%s: could not encode payload: %v", eventType, err)
+			continue
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload["type"] != eventType || payload["test"] != true {
+			t.Errorf("%s: got type %v and test %v", eventType, payload["type"], payload["test"])
+		}
+		_, hasEvent := payload["event"]
+		if eventType == "Message" {
+			if hasEvent || payload["info"] == nil || payload["content"] == nil {
+				t.Errorf("%s: got %s, want info and content without the raw event", eventType, data)
+			}
+		} else if !hasEvent {
+			t.Errorf("%s: got %s, want an event", eventType, data)
+		}
+	}
+}
+
+func TestBuildTestEventTypes(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		raw       string // WEBHOOK_RAW_MESSAGE
+		wantType  string
+		wantEvent string
+	}{
+		{"receipt alias", "Receipt", "", "ReadReceipt", ""},
+		{"raw message", "Message", "true", "Message", ""},
+		{"no realistic payload", "NewsletterJoin", "", "NewsletterJoin", "{}"},
+	}
+	for _, tt := range tests {
+		t.Setenv("WEBHOOK_RAW_MESSAGE", tt.raw)
+		data, err := json.Marshal(deliveryPayload(buildTestEvent(tt.eventType, types.EmptyJID)))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var payload map[string]json.RawMessage
+		if err := json.Unmarshal(data, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if string(payload["type"]) != `"`+tt.wantType+`"` {
+			t.Errorf("%s: got type %s, want %s", tt.name, payload["type"], tt.wantType)
+		}
+		event, ok := payload["event"]
+		if !ok || (tt.wantEvent != "" && string(event) != tt.wantEvent) {
+			t.Errorf("%s: got event %s, want %s", tt.name, event, tt.wantEvent)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 50 * time.Second
+	wsMaxMessage = 64 << 20 // commands may carry base64 media
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Requests are authenticated with the user token, so any origin is accepted like for the REST API
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsCommand is a request sent by the client, id is echoed back in the response
+type wsCommand struct {
+	ID     string          `json:"id"`
+	Action string          `json:"action"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// wsMessage is anything sent to the client: an event or the response to a command
+type wsMessage struct {
+	Type    string          `json:"type"`
+	ID      interface{}     `json:"id,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Action  string          `json:"action,omitempty"`
+	Code    int             `json:"code,omitempty"`
+	Success *bool           `json:"success,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// wsSession is one WebSocket connection of a user
+type wsSession struct {
+	s        *server
+	conn     *websocket.Conn
+	userinfo Values
+	out      chan wsMessage
+
+	mu     sync.Mutex
+	filter map[string]bool
+}
+
+// run streams events and executes commands until the connection is closed
+func (ws *wsSession) run(lastID uint64) {
+	userID := ws.userinfo.Get("Id")
+	backlog, events, cancel := eventBroker.Subscribe(userID, lastID)
+	defer cancel()
+
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	go ws.writeLoop(done)
+
+	frames := make(chan []byte)
+	readErr := make(chan error, 1)
+	go ws.readLoop(frames, readErr, quit)
+
+	ctx, stop := context.WithCancel(context.Background())
+	var pending sync.WaitGroup
+	defer func() {
+		// Let running commands answer before the connection goes away
+		pending.Wait()
+		stop()
+		close(quit)
+		close(ws.out)
+		<-done
+	}()
+
+	for _, evt := range backlog {
+		ws.sendEvent(evt)
+	}
+
+	for {
+		select {
+		case err := <-readErr:
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Warn().Err(err).Str("userID", userID).Msg("WebSocket closed")
+			}
+			return
+		case evt, ok := <-events:
+			if !ok {
+				log.Warn().Str("userID", userID).Msg("WebSocket client too slow, closing")
+				return
+			}
+			ws.sendEvent(evt)
+		case frame := <-frames:
+			var cmd wsCommand
+			if err := json.Unmarshal(frame, &cmd); err != nil {
+				ws.send(wsMessage{Type: "response", Code: http.StatusBadRequest, Success: boolPtr(false), Error: "could not decode command"})
+				continue
+			}
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				ws.handleCommand(ctx, cmd)
+			}()
+		}
+	}
+}
+
+func (ws *wsSession) readLoop(frames chan<- []byte, readErr chan<- error, quit <-chan struct{}) {
+	ws.conn.SetReadLimit(wsMaxMessage)
+	ws.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	ws.conn.SetPongHandler(func(string) error {
+		return ws.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, frame, err := ws.conn.ReadMessage()
+		if err != nil {
+			readErr <- err
+			return
+		}
+		select {
+		case frames <- frame:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// writeLoop is the only writer of the connection, as required by gorilla/websocket
+func (ws *wsSession) writeLoop(done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	defer ws.conn.Close()
+	for {
+		select {
+		case msg, ok := <-ws.out:
+			ws.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := ws.conn.WriteJSON(msg); err != nil {
+				// Keep draining so senders never block on a dead connection
+				for range ws.out {
+				}
+				return
+			}
+		case <-ticker.C:
+			ws.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := ws.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				for range ws.out {
+				}
+				return
+			}
+		}
+	}
+}
+
+func (ws *wsSession) send(msg wsMessage) {
+	ws.out <- msg
+}
+
+func (ws *wsSession) sendEvent(evt StreamEvent) {
+	ws.mu.Lock()
+	filter := ws.filter
+	ws.mu.Unlock()
+	if len(filter) > 0 && !filter[evt.Type] {
+		return
+	}
+	ws.send(wsMessage{Type: "event", ID: evt.ID, Event: evt.Type, Data: evt.Data})
+}
+
+// handleCommand runs one client command and sends back the response with the same id
+func (ws *wsSession) handleCommand(ctx context.Context, cmd wsCommand) {
+	if cmd.Action == "subscribe" {
+		ws.subscribe(cmd)
+		return
+	}
+
+	status, envelope := ws.s.executeCommand(ctx, ws.userinfo, cmd.Action, cmd.Data)
+	resp := wsMessage{Type: "response", ID: cmd.ID, Action: cmd.Action, Code: status, Success: boolPtr(status < 400)}
+	if errMsg, ok := envelope["error"].(string); ok {
+		resp.Error = errMsg
+	}
+	if data, ok := envelope["data"]; ok {
+		resp.Data, _ = json.Marshal(data)
+	}
+	ws.send(resp)
+}
+
+// subscribe replaces the event filter of the connection, an empty list or "All" receives everything
+func (ws *wsSession) subscribe(cmd wsCommand) {
+	var req struct {
+		Events []string `json:"events"`
+	}
+	if len(cmd.Data) > 0 {
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			ws.send(wsMessage{Type: "response", ID: cmd.ID, Action: cmd.Action, Code: http.StatusBadRequest, Success: boolPtr(false), Error: "could not decode payload"})
+			return
+		}
+	}
+	filter, err := parseEventFilter(req.Events)
+	if err != nil {
+		ws.send(wsMessage{Type: "response", ID: cmd.ID, Action: cmd.Action, Code: http.StatusBadRequest, Success: boolPtr(false), Error: err.Error()})
+		return
+	}
+	ws.mu.Lock()
+	ws.filter = filter
+	ws.mu.Unlock()
+	data, _ := json.Marshal(map[string]interface{}{"events": req.Events})
+	ws.send(wsMessage{Type: "response", ID: cmd.ID, Action: cmd.Action, Code: http.StatusOK, Success: boolPtr(true), Data: data})
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -39,7 +39,7 @@ type MyClient struct {
 	db             *sqlx.DB
 }
 
-func sendToGlobalWebHook(jsonData []byte, token string, userID string) {
+func sendToGlobalWebHook(jsonData []byte, token string, userID string, eventType string) {
 	jsonDataStr := string(jsonData)
 
 	instance_name := ""
@@ -57,7 +57,7 @@ func sendToGlobalWebHook(jsonData []byte, token string, userID string) {
 			"userID":       userID,
 			"instanceName": instance_name,
 		}
-		callHook(*globalWebhook, globalData, userID)
+		enqueueWebhook(userID, "", *globalWebhook, eventType, globalData, "", "")
 	}
 }
 
@@ -82,6 +82,18 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 		return
 	}
 
+	// Prepare event data
+	jsonData, err := json.Marshal(deliveryPayload(postmap))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal postmap to JSON")
+		return
+	}
+
+	// Live subscribers pick their own events, so they are fed before the webhook subscription check
+	if eventBroker != nil {
+		eventBroker.Publish(mycli.userID, eventType, jsonData)
+	}
+
 	// Log subscription details for debugging
 	log.Debug().
 		Str("userID", mycli.userID).
@@ -95,20 +107,29 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 		return
 	}
 
-	// Prepare webhook data
-	jsonData, err := json.Marshal(postmap)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to marshal postmap to JSON")
-		return
-	}
-
-	// Call user webhooks if configured
-	dispatchUserWebhooks(mycli.db, mycli.userID, mycli.token, eventType, jsonData, path)
-
-	// Get global webhook if configured
-	go sendToGlobalWebHook(jsonData, mycli.token, mycli.userID)
+	// Webhooks, RabbitMQ and the other configured sinks
+	dispatchEvent(mycli.db, SinkEvent{
+		UserID:   mycli.userID,
+		Token:    mycli.token,
+		Type:     eventType,
+		Data:     jsonData,
+		FilePath: path,
+		Context:  eventContextFromPostmap(postmap),
+	})
+}
 
-	go sendToGlobalRabbit(jsonData)
+// sendSystemEvent emits an event raised by wuzapi itself, it works whether or not the user is connected
+func sendSystemEvent(db *sqlx.DB, userID string, postmap map[string]interface{}) {
+	mycli := clientManager.GetMyClient(userID)
+	if mycli == nil {
+		var token string
+		if err := db.Get(&token, "SELECT token FROM users WHERE id=$1", userID); err != nil {
+			log.Error().Err(err).Str("userID", userID).Msg("Could not load user for system event")
+			return
+		}
+		mycli = &MyClient{userID: userID, token: token, db: db}
+	}
+	sendEventWithWebHook(mycli, postmap, "")
 }
 
 func checkIfSubscribedToEvent(subscribedEvents []string, eventType string, userId string) bool {
@@ -455,8 +476,12 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 				log.Info().Msg("Marked self as available")
 			}
 		}
+		dowebhook = 1
+		setEventDetails(postmap, evt)
 	case *events.Connected, *events.PushNameSetting:
+		// Connected has no details, a changed pushname is delivered as PushNameSetting
 		postmap["type"] = "Connected"
+		setEventDetails(postmap, evt)
 		dowebhook = 1
 		if len(mycli.WAClient.Store.PushName) == 0 {
 			break
@@ -495,9 +520,12 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			userinfocache.Set(token, v, cache.NoExpiration)
 			log.Info().Str("jid", jid.String()).Str("userid", txtid).Str("token", token).Msg("User information set")
 		}
+		dowebhook = 1
+		setEventDetails(postmap, evt)
 	case *events.StreamReplaced:
 		log.Info().Msg("Received StreamReplaced event")
-		return
+		dowebhook = 1
+		setEventDetails(postmap, evt)
 	case *events.Message:
 
 		var s3Config struct {
@@ -520,6 +548,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		}
 
 		postmap["type"] = "Message"
+		postmap["info"] = messageInfoDetails(evt.Info)
+		postmap["content"] = eventMessageContent(evt)
 		dowebhook = 1
 		metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", evt.Info.Timestamp)}
 		if evt.Info.Type != "" {
@@ -537,6 +567,19 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 
 		log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Str("parts", strings.Join(metaParts, ", ")).Msg("Message Received")
 
+		// Polls are remembered so that votes, which only carry option hashes, can be named and counted
+		if poll := pollCreation(evt.Message); poll != nil {
+			err := recordPoll(mycli.db, mycli.userID, evt.Info.ID, evt.Info.Chat, evt.Info.Sender, poll, evt.Info.Timestamp)
+			if err != nil {
+				log.Error().Err(err).Str("id", evt.Info.ID).Msg("Failed to store poll")
+			}
+		}
+		if evt.Message.GetPollUpdateMessage() != nil {
+			mycli.handlePollVote(evt)
+		}
+		mycli.storeReceivedMessage(evt)
+		mycli.recordReceivedChatMessage(evt)
+
 		if !*skipMedia {
 			// try to get Image if any
 			img := evt.Message.GetImageMessage()
@@ -591,6 +634,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						log.Error().Err(err).Msg("Failed to upload image to S3")
 					} else {
 						postmap["s3"] = s3Data
+						if key, ok := s3Data["key"].(string); ok {
+							mycli.setStoredMessageS3Key(evt.Info, key)
+						}
 					}
 				}
 
@@ -679,6 +725,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						log.Error().Err(err).Msg("Failed to upload audio to S3")
 					} else {
 						postmap["s3"] = s3Data
+						if key, ok := s3Data["key"].(string); ok {
+							mycli.setStoredMessageS3Key(evt.Info, key)
+						}
 					}
 				}
 
@@ -772,6 +821,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						log.Error().Err(err).Msg("Failed to upload document to S3")
 					} else {
 						postmap["s3"] = s3Data
+						if key, ok := s3Data["key"].(string); ok {
+							mycli.setStoredMessageS3Key(evt.Info, key)
+						}
 					}
 				}
 
@@ -854,6 +906,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						log.Error().Err(err).Msg("Failed to upload video to S3")
 					} else {
 						postmap["s3"] = s3Data
+						if key, ok := s3Data["key"].(string); ok {
+							mycli.setStoredMessageS3Key(evt.Info, key)
+						}
 					}
 				}
 
@@ -887,6 +942,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Receipt:
 		postmap["type"] = "ReadReceipt"
 		dowebhook = 1
+		mycli.recordReceipt(evt)
 		//if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
 		if evt.Type == types.ReceiptTypeRead || evt.Type == types.ReceiptTypeReadSelf {
 			log.Info().Strs("id", evt.MessageIDs).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%v", evt.Timestamp)).Msg("Message was read")
@@ -895,14 +951,19 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 				postmap["state"] = "Read"
 			} else {
 				postmap["state"] = "ReadSelf"
+				// Read on another device of the account
+				if err := markChatRead(mycli.db, mycli.userID, evt.Chat); err != nil {
+					log.Error().Err(err).Msg("Failed to update chat unread count")
+				}
 			}
 			//} else if evt.Type == events.ReceiptTypeDelivered {
 		} else if evt.Type == types.ReceiptTypeDelivered {
 			postmap["state"] = "Delivered"
 			log.Info().Str("id", evt.MessageIDs[0]).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%v", evt.Timestamp)).Msg("Message delivered")
 		} else {
-			// Discard webhooks for inactive or other delivery types
-			return
+			// Other receipt types (played, sender, retry, inactive, ...) are delivered with their raw type as state
+			postmap["type"] = "Receipt"
+			postmap["state"] = string(evt.Type)
 		}
 	case *events.Presence:
 		postmap["type"] = "Presence"
@@ -921,10 +982,22 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.HistorySync:
 		postmap["type"] = "HistorySync"
 		dowebhook = 1
+		mycli.ingestHistorySync(evt)
 	case *events.AppState:
 		log.Info().Str("index", fmt.Sprintf("%+v", evt.Index)).Str("actionValue", fmt.Sprintf("%+v", evt.SyncActionValue)).Msg("App state event received")
+		dowebhook = 1
+		setEventDetails(postmap, evt)
+		mycli.applyChatAppState(evt)
+	case *events.GroupInfo:
+		dowebhook = 1
+		setEventDetails(postmap, evt)
+		mycli.recordGroupChat(evt.JID, evt.Name, evt.Ephemeral)
+	case *events.JoinedGroup:
+		dowebhook = 1
+		setEventDetails(postmap, evt)
+		mycli.recordGroupChat(evt.JID, &evt.GroupName, &evt.GroupEphemeral)
 	case *events.LoggedOut:
-		postmap["type"] = "Logged Out"
+		postmap["type"] = "LoggedOut"
 		dowebhook = 1
 		log.Info().Str("reason", evt.Reason.String()).Msg("Logged out")
 		killchannel[mycli.userID] <- true
@@ -940,14 +1013,30 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		log.Info().Str("state", fmt.Sprintf("%s", evt.State)).Str("media", fmt.Sprintf("%s", evt.Media)).Str("chat", evt.MessageSource.Chat.String()).Str("sender", evt.MessageSource.Sender.String()).Msg("Chat Presence received")
 	case *events.CallOffer:
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call offer")
+		postmap["type"] = "CallOffer"
+		postmap["call"] = callDetails(evt)
+		postmap["rejected"] = mycli.rejectCall(evt)
+		dowebhook = 1
 	case *events.CallAccept:
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call accept")
+		postmap["type"] = "CallAccept"
+		postmap["call"] = callDetails(evt)
+		dowebhook = 1
 	case *events.CallTerminate:
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call terminate")
+		postmap["type"] = "CallTerminate"
+		postmap["call"] = callDetails(evt)
+		dowebhook = 1
 	case *events.CallOfferNotice:
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call offer notice")
+		postmap["type"] = "CallOfferNotice"
+		postmap["call"] = callDetails(evt)
+		dowebhook = 1
 	case *events.CallRelayLatency:
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call relay latency")
+		postmap["type"] = "CallRelayLatency"
+		postmap["call"] = callDetails(evt)
+		dowebhook = 1
 	case *events.Disconnected:
 		postmap["type"] = "Disconnected"
 		dowebhook = 1
@@ -956,8 +1045,23 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		postmap["type"] = "ConnectFailure"
 		dowebhook = 1
 		log.Error().Str("reason", fmt.Sprintf("%+v", evt)).Msg("Failed to connect to Whatsapp")
+	case *events.Blocklist:
+		setEventDetails(postmap, evt)
+		dowebhook = 1
+		// Each change is also delivered on its own, for subscribers of BlocklistChange
+		for _, change := range evt.Changes {
+			sendEventWithWebHook(mycli, map[string]interface{}{
+				"type":    "BlocklistChange",
+				"event":   change,
+				"details": blocklistChangeDetails(change),
+			}, "")
+		}
 	default:
-		log.Warn().Str("event", fmt.Sprintf("%+v", evt)).Msg("Unhandled event")
+		if setEventDetails(postmap, evt) {
+			dowebhook = 1
+		} else {
+			log.Warn().Str("event", fmt.Sprintf("%+v", evt)).Msg("Unhandled event")
+		}
 	}
 
 	if dowebhook == 1 {